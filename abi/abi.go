@@ -1,7 +1,9 @@
 package abi
 
 import (
+	"bytes"
 	"debug/elf"
+	"encoding/binary"
 	"errors"
 	"io"
 
@@ -9,8 +11,9 @@ import (
 )
 
 var (
-	ErrMemEqualNotFound = errors.New("runtime.memequal0 not found")
-	ErrWrongInstruction = errors.New("MOVL not first instruction of runtime.memequal0")
+	ErrMemEqualNotFound   = errors.New("runtime.memequal0 not found")
+	ErrWrongInstruction   = errors.New("MOVL not first instruction of runtime.memequal0")
+	ErrUnsupportedMachine = errors.New("runtime.memequal0 is only decoded for amd64, arm64 and s390x")
 )
 
 // Regs returns true if passing arguments in registers is enabled
@@ -37,13 +40,19 @@ func Regs(r io.ReaderAt) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-
-	symbolName := "runtime.memequal0"
-
 	symbols, err := file.Symbols()
 	if err != nil {
 		return false, err
 	}
+	return RegsSymbols(file, symbols)
+}
+
+// RegsSymbols is Regs for an ELF file whose symbols have already been read
+func RegsSymbols(file *elf.File, symbols []elf.Symbol) (bool, error) {
+	if file.Machine != elf.EM_X86_64 && file.Machine != elf.EM_S390 && file.Machine != elf.EM_AARCH64 {
+		return false, ErrUnsupportedMachine
+	}
+	symbolName := "runtime.memequal0"
 
 	var symbol elf.Symbol
 	found := false
@@ -61,15 +70,18 @@ func Regs(r io.ReaderAt) (bool, error) {
 
 	section := file.Sections[symbol.Section]
 
-	text, err := section.Data()
-	if err != nil {
+	// only the function is read rather than all of the text section
+	function := make([]byte, symbol.Size)
+	if _, err := section.ReadAt(function, int64(symbol.Value-section.Addr)); err != nil {
 		return false, err
 	}
 
-	start := symbol.Value - section.Addr
-	end := start + symbol.Size
-
-	function := text[start:end]
+	switch file.Machine {
+	case elf.EM_S390:
+		return s390xRegs(function)
+	case elf.EM_AARCH64:
+		return arm64Regs(function)
+	}
 
 	inst, err := x86asm.Decode(function, 64)
 	if err != nil {
@@ -81,3 +93,54 @@ func Regs(r io.ReaderAt) (bool, error) {
 	}
 	return (inst.Args[0].String() == "EAX" && inst.Args[1].String() == "0x1"), nil
 }
+
+// s390xRegs tells the calling convention from the first instruction of
+// runtime.memequal0 on s390x
+// e.g for register based
+//
+//	alg.go:276		0x239d0			a7290001		MOVB $1, R2
+//	alg.go:276		0x239d4			07fe			RET
+//
+// for stack based
+//
+//	alg.go:202		0x143d0			9201f018		MVI 24(R15), $1
+//	alg.go:202		0x143d4			07fe			RET
+func s390xRegs(function []byte) (bool, error) {
+	switch {
+	case bytes.HasPrefix(function, []byte{0xa7, 0x29, 0x00, 0x01}):
+		return true, nil
+	case bytes.HasPrefix(function, []byte{0x92, 0x01}):
+		return false, nil
+	}
+	return false, ErrWrongInstruction
+}
+
+// arm64RET is the RET instruction, returning to the address in R30
+const arm64RET = 0xd65f03c0
+
+// arm64Regs tells the calling convention from runtime.memequal0 on arm64,
+// whose instructions are 4 bytes little endian
+// e.g for register based
+//
+//	alg.go:276		0x22df0			b24003e0		ORR $1, ZR, R0
+//	alg.go:276		0x22df4			d65f03c0		RET
+//
+// for stack based the result is stored above the stack pointer
+//
+//	alg.go:202		0x1c0c0			d2800020		MOVD $1, R0
+//	alg.go:202		0x1c0c4			390063e0		MOVB R0, 24(RSP)
+//	alg.go:202		0x1c0c8			d65f03c0		RET
+func arm64Regs(function []byte) (bool, error) {
+	for i := 0; i+8 <= len(function); i += 4 {
+		inst := binary.LittleEndian.Uint32(function[i:])
+		// STRB (immediate) with RSP as the base register
+		if inst&0xffc003e0 == 0x390003e0 {
+			return false, nil
+		}
+		// a single instruction setting R0 followed by RET
+		if i == 0 && inst&0x1f == 0 && binary.LittleEndian.Uint32(function[i+4:]) == arm64RET {
+			return true, nil
+		}
+	}
+	return false, ErrWrongInstruction
+}
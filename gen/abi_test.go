@@ -0,0 +1,104 @@
+package gen
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/layout"
+)
+
+// param gives a parameter as layout would with the stack ABI offset left
+// for assignRegisters to replace
+func param(name string, size, align, ints, floats int, stackOnly bool) layout.Param {
+	return layout.Param{Name: name, Size: size, Align: align, Words: 1 + (size-1)/8, IntRegs: ints, FloatRegs: floats, StackOnly: stackOnly}
+}
+
+func TestAssignRegisters(t *testing.T) {
+	amd64 := goArches["amd64"]
+	words := func(params []layout.Param) (got [][4]int) {
+		for _, p := range params {
+			stack := 0
+			if p.Stack {
+				stack = 1
+			}
+			got = append(got, [4]int{p.Word, p.Words, stack, p.Offset})
+		}
+		return got
+	}
+	tests := []struct {
+		name   string
+		params []layout.Param
+		// Word, Words, Stack and Offset of each
+		want [][4]int
+	}{
+		{
+			"ints and a string",
+			[]layout.Param{param("a", 8, 8, 1, 0, false), param("s", 16, 8, 2, 0, false), param("b", 1, 1, 1, 0, false)},
+			[][4]int{{0, 1, 0, 0}, {1, 2, 0, 0}, {3, 1, 0, 0}},
+		},
+		{
+			"floats take their own registers",
+			[]layout.Param{param("f", 8, 8, 0, 1, false), param("a", 8, 8, 1, 0, false)},
+			[][4]int{{-1, 1, 0, 0}, {0, 1, 0, 0}},
+		},
+		{
+			// a slice needing three registers after eight are taken goes on
+			// the stack, but the int after it still gets the ninth
+			"a slice spilled while a later int fits",
+			[]layout.Param{
+				param("a0", 8, 8, 1, 0, false), param("a1", 8, 8, 1, 0, false),
+				param("a2", 8, 8, 1, 0, false), param("a3", 8, 8, 1, 0, false),
+				param("a4", 8, 8, 1, 0, false), param("a5", 8, 8, 1, 0, false),
+				param("a6", 8, 8, 1, 0, false), param("a7", 8, 8, 1, 0, false),
+				param("s", 24, 8, 3, 0, false), param("b", 4, 4, 1, 0, false),
+				param("c", 2, 2, 1, 0, false),
+			},
+			[][4]int{
+				{0, 1, 0, 0}, {1, 1, 0, 0}, {2, 1, 0, 0}, {3, 1, 0, 0},
+				{4, 1, 0, 0}, {5, 1, 0, 0}, {6, 1, 0, 0}, {7, 1, 0, 0},
+				{-1, 3, 1, 0}, {8, 1, 0, 0}, {-1, 1, 1, 24},
+			},
+		},
+		{
+			"arrays of more than one element go on the stack",
+			[]layout.Param{param("a", 1, 1, 0, 0, true), param("b", 2, 2, 0, 0, true), param("p", 8, 8, 1, 0, false)},
+			[][4]int{{-1, 1, 1, 0}, {-1, 1, 1, 2}, {0, 1, 0, 0}},
+		},
+		{
+			"a struct of an int and a float",
+			[]layout.Param{param("f", 8, 8, 0, 1, false), param("st", 16, 8, 1, 1, false)},
+			[][4]int{{-1, 1, 0, 0}, {0, 1, 0, 0}},
+		},
+		{
+			"too many floats",
+			append(repeat(param("f", 8, 8, 0, 1, false), 15), param("g", 4, 4, 0, 1, false), param("i", 8, 8, 1, 0, false)),
+			append(repeatWords([4]int{-1, 1, 0, 0}, 15), [4]int{-1, 1, 1, 0}, [4]int{0, 1, 0, 0}),
+		},
+	}
+	for _, test := range tests {
+		before := append([]layout.Param(nil), test.params...)
+		got := amd64.assignRegisters(test.params)
+		if !reflect.DeepEqual(words(got), test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, words(got), test.want)
+		}
+		if !reflect.DeepEqual(test.params, before) {
+			t.Errorf("%s: the parameters given were changed", test.name)
+		}
+	}
+}
+
+func repeat(p layout.Param, n int) []layout.Param {
+	params := make([]layout.Param, n)
+	for i := range params {
+		params[i] = p
+	}
+	return params
+}
+
+func repeatWords(w [4]int, n int) [][4]int {
+	words := make([][4]int, n)
+	for i := range words {
+		words[i] = w
+	}
+	return words
+}
@@ -0,0 +1,158 @@
+package gen
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// The sources of the ABI a target, or a function in it, is taken to use
+const (
+	abiDetected = "detected"
+	abiVersion  = "from the Go version"
+	abiAssumed  = "assumed"
+	abiForced   = "forced"
+)
+
+// abiState is how a target's RegsABI was decided
+type abiState struct {
+	// detected is what newTarget found
+	detected       bool
+	detectedSource string
+	// source is where RegsABI came from once the abi arguments were
+	// applied and symbols the functions they forced
+	source  string
+	symbols map[string]bool
+}
+
+// abiOverrides is what the abi=regs|stack|auto arguments ask for: the ABI
+// of the whole target, if forced, and of functions given as
+// abi=regs:<function>[,<function>...]
+type abiOverrides struct {
+	regs    *bool
+	symbols map[string]bool
+}
+
+// parseABI parses the values of the abi argument
+func parseABI(values []string) (abiOverrides, error) {
+	o := abiOverrides{symbols: map[string]bool{}}
+	for _, v := range values {
+		mode, symbols, perSymbol := strings.Cut(v, ":")
+		var regs bool
+		switch mode {
+		case "regs":
+			regs = true
+		case "stack":
+		case "auto":
+			if perSymbol {
+				return o, fmt.Errorf("bad abi=%s: only regs or stack can be given for functions", v)
+			}
+			continue
+		default:
+			return o, fmt.Errorf("bad abi=%s: it must be regs, stack or auto, optionally followed by :<function>[,<function>...] for regs or stack", v)
+		}
+		if !perSymbol {
+			if o.regs != nil && *o.regs != regs {
+				return o, fmt.Errorf("abi=regs and abi=stack both given for the whole target")
+			}
+			o.regs = &regs
+			continue
+		}
+		for _, s := range strings.Split(symbols, ",") {
+			if s == "" {
+				return o, fmt.Errorf("bad abi=%s: empty function name", v)
+			}
+			if r, ok := o.symbols[s]; ok && r != regs {
+				return o, fmt.Errorf("abi=regs and abi=stack both given for %s", s)
+			}
+			o.symbols[s] = regs
+		}
+	}
+	return o, nil
+}
+
+// abiName names the ABI for messages
+func abiName(regs bool) string {
+	if regs {
+		return "register ABI"
+	}
+	return "stack ABI"
+}
+
+// applyABI sets RegsABI from what was detected in newTarget and any abi
+// arguments, logging the ABI and where it came from
+func (t *Target) applyABI() error {
+	o, err := parseABI(t.Arguments("abi"))
+	if err != nil {
+		return err
+	}
+	t.RegsABI, t.abi.source = t.abi.detected, t.abi.detectedSource
+	if o.regs != nil {
+		t.RegsABI, t.abi.source = *o.regs, abiForced
+	}
+	t.abi.symbols = o.symbols
+	for _, line := range t.abiSummary() {
+		log.Printf("%s: %s", t.ExePath, line)
+	}
+	return nil
+}
+
+// abiSummary describes the ABI of the target and of the functions it's
+// forced for, one line each
+func (t Target) abiSummary() []string {
+	lines := []string{fmt.Sprintf("arguments are read with the %s (%s)", abiName(t.RegsABI), t.abi.source)}
+	symbols := make([]string, 0, len(t.abi.symbols))
+	for s := range t.abi.symbols {
+		symbols = append(symbols, s)
+	}
+	sort.Strings(symbols)
+	for _, s := range symbols {
+		lines = append(lines, fmt.Sprintf("arguments of %s are read with the %s (%s)", s, abiName(t.abi.symbols[s]), abiForced))
+	}
+	return lines
+}
+
+// abiHeader gives the comment put at the top of scripts recording the ABI
+// the helpers read arguments with. It goes after any #! line.
+func (t Target) abiHeader(script string) string {
+	prefix := "//"
+	switch t.Format {
+	case FormatBCC, FormatUprobeEvents, FormatPerf:
+		prefix = "#"
+	}
+	var header strings.Builder
+	for _, line := range t.abiSummary() {
+		fmt.Fprintf(&header, "%s %s\n", prefix, line)
+	}
+	if strings.HasPrefix(script, "#!") {
+		if i := strings.IndexByte(script, '\n'); i >= 0 {
+			return script[:i+1] + header.String() + script[i+1:]
+		}
+	}
+	return header.String() + script
+}
+
+// fleetABIHeader is abiHeader for the targets of a fleet, named by their
+// ServicePrefix
+func fleetABIHeader(targets []*Target) string {
+	var header strings.Builder
+	for _, t := range targets {
+		for _, line := range t.abiSummary() {
+			fmt.Fprintf(&header, "// %s: %s\n", t.ServicePrefix, line)
+		}
+	}
+	return header.String()
+}
+
+// ABIFor returns the target as the helpers see it when reading the
+// arguments and results of function: with RegsABI as abi=regs:<function>
+// or abi=stack:<function> forced it, if either did, and otherwise as it
+// is. Templates probing functions given on the command line read their
+// arguments with it e.g. {{ $t := $.ABIFor $symbol }}{{ $t.Arg 0 }}.
+func (t Target) ABIFor(function string) Target {
+	if regs, ok := t.abi.symbols[function]; ok {
+		t.RegsABI = regs
+	}
+	return t
+}
@@ -0,0 +1,101 @@
+package gen_test
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+	"github.com/stevenjohnstone/go-bpf-gen/testtarget"
+)
+
+// renderABI renders the template text for a made up executable with the
+// given abi arguments
+func renderABI(t *testing.T, stackABI bool, text string, abi ...string) (string, error) {
+	t.Helper()
+	b := testtarget.Runtime()
+	b.StackABI = stackABI
+	target, err := testtarget.New("/bin/target", b,
+		gen.WithTemplates(fstest.MapFS{"abi.bt": {Data: []byte(text)}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	return gen.GenerateString("abi.bt", target, map[string][]string{"abi": abi})
+}
+
+func TestABIArguments(t *testing.T) {
+	const text = `{{ .Arg 0 }} {{ ($.ABIFor "main.main").Arg 0 }} {{ ($.ABIFor "runtime.execute").Arg 0 }}` + "\n"
+	regs, stack := `reg("ax")`, "sarg0"
+	tests := []struct {
+		name     string
+		stackABI bool
+		abi      []string
+		// the target's, main.main's and runtime.execute's first argument
+		want   [3]string
+		forced bool
+	}{
+		{"register ABI detected", false, nil, [3]string{regs, regs, regs}, false},
+		{"stack ABI detected", true, nil, [3]string{stack, stack, stack}, false},
+		{"auto", true, []string{"auto"}, [3]string{stack, stack, stack}, false},
+		{"stack forced", false, []string{"stack"}, [3]string{stack, stack, stack}, true},
+		{"register forced", true, []string{"regs"}, [3]string{regs, regs, regs}, true},
+		{"stack forced for a function", false, []string{"stack:main.main"}, [3]string{regs, stack, regs}, true},
+		{"register forced for a function", true, []string{"regs:main.main"}, [3]string{stack, regs, stack}, true},
+		{"both forced for functions", true, []string{"regs", "stack:main.main,runtime.execute"}, [3]string{regs, stack, stack}, true},
+	}
+	for _, test := range tests {
+		script, err := renderABI(t, test.stackABI, text, test.abi...)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(script), "\n")
+		got := lines[len(lines)-1]
+		if want := strings.Join(test.want[:], " "); got != want {
+			t.Errorf("%s: got %q, want %q", test.name, got, want)
+		}
+		if forced := strings.Contains(script, "(forced)"); forced != test.forced {
+			t.Errorf("%s: the ABI header is %q, want forced=%v", test.name, lines[0], test.forced)
+		}
+	}
+}
+
+func TestABIArgumentErrors(t *testing.T) {
+	for _, abi := range [][]string{
+		{"register"},
+		{"regs", "stack"},
+		{"auto:main.main"},
+		{"regs:main.main", "stack:main.main"},
+		{"stack:"},
+	} {
+		_, err := renderABI(t, false, "{{ .Arg 0 }}\n", abi...)
+		if err == nil || !strings.Contains(err.Error(), "abi") {
+			t.Errorf("abi=%v: got error %v, want one about the abi argument", abi, err)
+		}
+	}
+}
+
+// TestABIForParams checks the helpers reading parameters by name lay them
+// out for the ABI forced for their function
+func TestABIForParams(t *testing.T) {
+	const text = `{{ .ArgWords "main.handle" }} {{ .ArgIndex "main.handle" "name" }} {{ .ErrorResult "main.handle" }} {{ .ArgNamed "main.handle" "n" }}` + "\n"
+	for _, test := range []struct {
+		abi  string
+		want string
+	}{
+		// func handle(n int, name string) (err error)
+		{"regs:main.handle", `0 1 0 reg("ax")`},
+		{"stack:main.handle", "3 1 0 sarg0"},
+	} {
+		target := newFixtureTarget(t, gen.WithTemplates(fstest.MapFS{"abi.bt": {Data: []byte(text)}}))
+		script, err := gen.GenerateString("abi.bt", target, map[string][]string{"abi": {test.abi}})
+		if err != nil {
+			t.Fatalf("abi=%s: %v", test.abi, err)
+		}
+		lines := strings.Split(strings.TrimSpace(script), "\n")
+		if got := lines[len(lines)-1]; got != test.want {
+			t.Errorf("abi=%s: got %q, want %q", test.abi, got, test.want)
+		}
+	}
+}
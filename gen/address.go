@@ -0,0 +1,176 @@
+package gen
+
+import (
+	"debug/elf"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/stevenjohnstone/go-bpf-gen/layout"
+	"github.com/stevenjohnstone/go-bpf-gen/ret"
+)
+
+// addressSymbol is code given by address in a symbol= argument, as
+// 0x<address> or <name>@0x<address> with an optional +<size>, rather than
+// by the name of a symbol. Templates are given its name, which is made up
+// if none was given, and the helpers look the name up here before the
+// symbol table.
+type addressSymbol struct {
+	elf.Symbol
+	// function is the function the code is in, if it's in one, and entry
+	// is true if the code is its entry so it has its arguments
+	function string
+	entry    bool
+}
+
+// parseAddressSymbol parses a symbol= value giving code by address. ok is
+// false if value is the name of a symbol.
+func parseAddressSymbol(value string) (name string, address, size uint64, ok bool, err error) {
+	spec := value
+	if i := strings.LastIndex(value, "@0x"); i >= 0 {
+		name, spec = value[:i], value[i+1:]
+	} else if !strings.HasPrefix(value, "0x") {
+		return "", 0, 0, false, nil
+	}
+	spec, sizeText, sized := strings.Cut(spec, "+")
+	if address, err = strconv.ParseUint(strings.TrimPrefix(spec, "0x"), 16, 64); err != nil {
+		return "", 0, 0, true, fmt.Errorf("bad address in symbol=%s: %s isn't a hex address", value, spec)
+	}
+	if sized {
+		if size, err = strconv.ParseUint(sizeText, 0, 64); err != nil || size == 0 {
+			return "", 0, 0, true, fmt.Errorf("bad size in symbol=%s: %s isn't a number of bytes", value, sizeText)
+		}
+	}
+	return name, address, size, true, nil
+}
+
+// resolveAddresses finds the code given by address in the symbol
+// arguments and has the arguments give templates its name instead
+func (t *Target) resolveAddresses() error {
+	t.addresses = map[string]addressSymbol{}
+	if t.args == nil {
+		return nil
+	}
+	t.args.setRenames(nil)
+	renames := map[string]string{}
+	for _, value := range t.peekArgument("symbol") {
+		name, address, size, ok, err := parseAddressSymbol(value)
+		if !ok {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s, err := t.addressSymbol(value, name, address, size)
+		if err != nil {
+			return err
+		}
+		if other, ok := t.addresses[s.Name]; ok && other.Symbol != s.Symbol {
+			return fmt.Errorf("symbol=%s: %s is already 0x%x+%d", value, s.Name, other.Value, other.Size)
+		}
+		t.addresses[s.Name] = s
+		renames[value] = s.Name
+	}
+	t.args.setRenames(renames)
+	return nil
+}
+
+// addressSymbol makes up a symbol for the code at address given by the
+// symbol= value. Without a size the code runs to the end of the function
+// it's in, and without a name it's named after the function and its offset
+// in it.
+func (t Target) addressSymbol(value, name string, address, size uint64) (addressSymbol, error) {
+	var section *elf.Section
+	for _, s := range t.bin.exe.elf.Sections {
+		if s.Flags&elf.SHF_ALLOC != 0 && s.Flags&elf.SHF_TLS == 0 && address >= s.Addr && address < s.Addr+s.Size {
+			section = s
+			break
+		}
+	}
+	if section == nil {
+		return addressSymbol{}, fmt.Errorf("symbol=%s: 0x%x isn't in any section of %s", value, address, t.ExePath)
+	}
+	if section.Flags&elf.SHF_EXECINSTR == 0 {
+		return addressSymbol{}, fmt.Errorf("symbol=%s: 0x%x is in %s which isn't code", value, address, section.Name)
+	}
+	if size > section.Addr+section.Size-address {
+		return addressSymbol{}, fmt.Errorf("symbol=%s: 0x%x+%d runs past the end of %s", value, address, size, section.Name)
+	}
+	s := addressSymbol{Symbol: elf.Symbol{
+		Name:  name,
+		Info:  elf.ST_INFO(elf.STB_LOCAL, elf.STT_FUNC),
+		Value: address,
+		Size:  size,
+	}}
+	if f, err := t.bin.symbolData().function(address); err == nil {
+		s.function, s.entry = f.Name, address == f.Value
+		if s.Size == 0 {
+			s.Size = f.Value + f.Size - address
+		}
+		if s.Name == "" && s.entry {
+			s.Name = f.Name
+		} else if s.Name == "" {
+			s.Name = fmt.Sprintf("%s+0x%x", f.Name, address-f.Value)
+		}
+	}
+	if s.Name == "" {
+		s.Name = fmt.Sprintf("0x%x", address)
+	}
+	return s, nil
+}
+
+// isAddressSymbol is true if symbol is code given by address in a symbol=
+// argument, which can't be probed by name
+func (t Target) isAddressSymbol(symbol string) bool {
+	_, ok := t.addresses[symbol]
+	return ok
+}
+
+// pclntabSymbols gives the names of the functions of a target without a
+// symbol table which were only found in its .gopclntab. The tracers can't
+// look them up so they're probed by address, as code given by address is.
+func (t Target) pclntabSymbols() map[string]bool {
+	d := t.bin.symbolData()
+	d.symbolTable()
+	return d.pclntab
+}
+
+// probedByAddress is true if symbol can only be probed by its address
+func (t Target) probedByAddress(symbol string) bool {
+	return t.isAddressSymbol(symbol) || t.pclntabSymbols()[symbol]
+}
+
+// addressReturns finds the return offsets of code given by address. They
+// aren't cached as the name is only the address's for these arguments.
+func (t Target) addressReturns(s addressSymbol) ([]int, error) {
+	if s.Size == 0 {
+		spec := fmt.Sprintf("0x%x", s.Value)
+		if s.Name != spec {
+			spec = s.Name + "@" + spec
+		}
+		return nil, fmt.Errorf("%s isn't in a known function so its size must be given, as in symbol=%s+<size>, to find its returns", s.Name, spec)
+	}
+	code, err := t.bin.exe.code(s.Symbol)
+	if err != nil {
+		return nil, err
+	}
+	f := t.bin.exe.elf
+	return ret.DecodeMachine(code, f.Machine, f.ByteOrder)
+}
+
+// paramsFunction gives the function whose DWARF data has the parameters of
+// symbol: the function itself or, for code given by address, the function
+// whose entry it is
+func (t Target) paramsFunction(symbol string) (string, error) {
+	s, ok := t.addresses[symbol]
+	if !ok {
+		return symbol, nil
+	}
+	if !s.entry {
+		if s.function == "" {
+			return "", fmt.Errorf("%s: %w: 0x%x isn't in a known function", symbol, layout.ErrFunctionNotFound, s.Value)
+		}
+		return "", fmt.Errorf("%s: %w: 0x%x is inside %s rather than at its entry", symbol, layout.ErrFunctionNotFound, s.Value, s.function)
+	}
+	return s.function, nil
+}
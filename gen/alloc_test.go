@@ -0,0 +1,114 @@
+package gen_test
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+)
+
+// dryRunner returns the bpftrace to check scripts with --dry-run, skipping
+// the test unless it's on the PATH and the test is run as root
+func dryRunner(t testing.TB) string {
+	t.Helper()
+	bpftrace, err := exec.LookPath("bpftrace")
+	if err != nil {
+		t.Skip("no bpftrace to dry-run the script with")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("bpftrace needs root")
+	}
+	return bpftrace
+}
+
+// allocArgs are the arguments alloc.bt is rendered with by the tests: each
+// sampling rate, by default one in 97, with and without type names
+var allocArgs = []map[string][]string{
+	nil,
+	{"sample": {"1"}},
+	{"sample": {"1000"}},
+	{"sample": {"97"}, "types": {"1"}},
+}
+
+// TestAllocSample checks alloc.bt samples one in sample= allocations, one in
+// 97 by default, and scales the bytes and allocations counted to make up
+// for it, then has bpftrace dry-run the scripts when it can
+func TestAllocSample(t *testing.T) {
+	target := newFixtureTarget(t)
+	var scripts []string
+	for _, args := range allocArgs {
+		script, err := gen.GenerateString("alloc.bt", target, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sample := "97"
+		if s := args["sample"]; len(s) > 0 {
+			sample = s[0]
+		}
+		predicate := fmt.Sprintf("runtime.mallocgc /rand %% %s == 0/ {", sample)
+		if sample == "1" {
+			predicate = "runtime.mallocgc /1/ {"
+		}
+		for _, want := range []string{predicate, "sum($size * " + sample + ")", "@allocs[ustack(10)] = sum(" + sample + ")"} {
+			if !strings.Contains(script, want) {
+				t.Errorf("%v: no %s in\n%s", args, want, script)
+			}
+		}
+		if len(args["types"]) > 0 && !strings.Contains(script, `@typename[0x`) {
+			t.Errorf("%v: no type names in\n%s", args, script)
+		}
+		scripts = append(scripts, script)
+	}
+	if _, err := gen.GenerateString("alloc.bt", target, map[string][]string{"sample": {"often"}}); err == nil {
+		t.Error("sample=often was rendered")
+	}
+
+	bpftrace := dryRunner(t)
+	for i, script := range scripts {
+		if err := gen.DryRun(bpftrace, script); err != nil {
+			t.Errorf("%v: %s", allocArgs[i], err)
+		}
+	}
+}
+
+// BenchmarkAllocScript renders alloc.bt for the fixture with each of
+// allocArgs and, when bpftrace can be run, dry-runs the scripts to see how
+// long it takes to check and compile them, which naming types slows down
+func BenchmarkAllocScript(b *testing.B) {
+	for _, args := range allocArgs {
+		name := "default"
+		if len(args) > 0 {
+			var names []string
+			for _, arg := range []string{"sample", "types"} {
+				if v := args[arg]; len(v) > 0 {
+					names = append(names, arg+"="+v[0])
+				}
+			}
+			name = strings.Join(names, ",")
+		}
+		b.Run(name, func(b *testing.B) {
+			target := newFixtureTarget(b)
+			var script string
+			b.Run("render", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					var err error
+					if script, err = gen.GenerateString("alloc.bt", target, args); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(script)), "bytes/script")
+			})
+			b.Run("dry-run", func(b *testing.B) {
+				bpftrace := dryRunner(b)
+				for i := 0; i < b.N; i++ {
+					if err := gen.DryRun(bpftrace, script); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
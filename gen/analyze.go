@@ -0,0 +1,150 @@
+package gen
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// symbolHelpers are the helpers whose first argument is a function symbol.
+// SymbolsMatching takes a glob which is expanded.
+var symbolHelpers = map[string]bool{
+	"SymbolReturns":       true,
+	"SymbolReturnsNoFail": true,
+	"HasReturns":          true,
+	"HasSymbol":           true,
+	"SymbolAddress":       true,
+	"SymbolSize":          true,
+	"Probe":               true,
+	"ReturnProbes":        true,
+	"Params":              true,
+	"Results":             true,
+	"ErrorResult":         true,
+	"ArgIndex":            true,
+	"ArgNamed":            true,
+	"ArgWords":            true,
+	"SymbolsMatching":     true,
+}
+
+// templateSymbols returns the symbols and globs given as string constants to
+// symbolHelpers anywhere in tmpl, including templates it defines. Names
+// computed while the template runs can't be seen.
+func templateSymbols(tmpl *template.Template) []string {
+	seen := map[string]bool{}
+	walkCommands(tmpl, func(n *parse.CommandNode) {
+		if len(n.Args) > 1 && symbolHelpers[helperName(n.Args[0])] {
+			if s, ok := n.Args[1].(*parse.StringNode); ok {
+				seen[s.Text] = true
+			}
+		}
+	})
+	return sortedKeys(seen)
+}
+
+// walkCommands calls f for each command anywhere in tmpl, including
+// templates it defines and branches which may not be executed
+func walkCommands(tmpl *template.Template, f func(*parse.CommandNode)) {
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.IfNode:
+			walk(&n.BranchNode)
+		case *parse.RangeNode:
+			walk(&n.BranchNode)
+		case *parse.WithNode:
+			walk(&n.BranchNode)
+		case *parse.BranchNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.TemplateNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Cmds {
+				walk(c)
+			}
+		case *parse.CommandNode:
+			f(n)
+			for _, a := range n.Args {
+				walk(a)
+			}
+		}
+	}
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			walk(t.Tree.Root)
+		}
+	}
+}
+
+// sortedKeys returns the keys of set sorted
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// helperName is the method called by a command such as .Probe or $.Probe
+func helperName(node parse.Node) string {
+	var ident []string
+	switch n := node.(type) {
+	case *parse.FieldNode:
+		ident = n.Ident
+	case *parse.VariableNode:
+		ident = n.Ident
+	}
+	if len(ident) == 0 {
+		return ""
+	}
+	return ident[len(ident)-1]
+}
+
+// planSymbols expands what templateSymbols found in tmpl together with the
+// symbol arguments into the functions in the target. Names which aren't
+// functions, as with HasSymbol checks for functions only in some versions,
+// are left out.
+func (t Target) planSymbols(tmpl *template.Template) []string {
+	seen := map[string]bool{}
+	var symbols []string
+	add := func(s string) {
+		if !seen[s] {
+			seen[s] = true
+			symbols = append(symbols, s)
+		}
+	}
+	patterns := t.peekArgument("symbol")
+	if tmpl != nil {
+		patterns = append(patterns, templateSymbols(tmpl)...)
+	}
+	for _, p := range patterns {
+		if strings.ContainsAny(p, "*?") {
+			matches, _ := t.SymbolsMatching(p)
+			for _, m := range matches {
+				add(m)
+			}
+		} else if t.HasSymbol(p) {
+			add(p)
+		}
+	}
+	if t.opts.verbose {
+		log.Printf("resolving %d symbols for %s: %s", len(symbols), t.ExePath, strings.Join(symbols, " "))
+	}
+	return symbols
+}
@@ -0,0 +1,206 @@
+package gen
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// goArch describes how Go passes arguments on an architecture the helpers
+// generate register and stack reads for
+type goArch struct {
+	// args are the registers the register ABI passes integer arguments
+	// in, as bpftrace names them
+	args []string
+	// floats is the number of floating point registers the register ABI
+	// passes arguments in
+	floats int
+	// sp is the stack pointer as bpftrace names it
+	sp string
+	// frame is the number of 8 byte words from the stack pointer to the
+	// first argument when a function is entered with the stack ABI: the
+	// return address on amd64 and the space Go keeps for the callee to
+	// save the link register in on the others
+	frame int
+	// sargs is true if bpftrace's sarg built-ins, which are for the C
+	// calling convention, read the stack arguments
+	sargs bool
+	// regsSince is the release which first used the register ABI, if it's
+	// known
+	regsSince string
+}
+
+var goArches = map[string]goArch{
+	"amd64": {
+		args:      regs[:],
+		floats:    15,
+		sp:        "sp",
+		frame:     1,
+		sargs:     true,
+		regsSince: "go1.17",
+	},
+	"ppc64": {
+		args:      []string{"r3", "r4", "r5", "r6", "r7", "r8", "r9", "r10", "r14", "r15", "r16", "r17"},
+		floats:    12,
+		sp:        "r1",
+		frame:     4,
+		regsSince: "go1.18",
+	},
+	// bpftrace names the arm64 registers r0 to r30 after pt_regs' regs
+	// array rather than x0 to x30
+	"arm64": {
+		args:      []string{"r0", "r1", "r2", "r3", "r4", "r5", "r6", "r7", "r8", "r9", "r10", "r11", "r12", "r13", "r14", "r15"},
+		floats:    16,
+		sp:        "sp",
+		frame:     1,
+		regsSince: "go1.18",
+	},
+	// s390x took up the register ABI long after the others. Which ABI a
+	// target uses is only seen from its runtime.memequal0.
+	"s390x": {
+		args:   []string{"r2", "r3", "r4", "r5", "r6", "r7", "r8", "r9"},
+		floats: 16,
+		sp:     "r15",
+		frame:  1,
+	},
+}
+
+func init() {
+	goArches["ppc64le"] = goArches["ppc64"]
+}
+
+// arch returns how Go passes arguments on the target's architecture.
+// Architectures without an entry are treated as amd64 as they always have
+// been.
+func (t Target) arch() goArch {
+	if a, ok := goArches[t.GoArch()]; ok {
+		return a
+	}
+	return goArches["amd64"]
+}
+
+// bigEndian is true if the target's architecture is big endian
+func (t Target) bigEndian() bool {
+	return t.bin.exe.elf.ByteOrder == binary.BigEndian
+}
+
+// regsABIByVersion gives whether the target uses the register ABI going by
+// its Go version and architecture, for targets in which it can't be seen
+// from runtime.memequal0. ok is false if the version or the release which
+// brought in the register ABI isn't known.
+func (t Target) regsABIByVersion() (regs, ok bool) {
+	a := t.arch()
+	if a.regsSince == "" || t.GoVersion() == "" {
+		return false, false
+	}
+	regs, err := t.GoVersionAtLeast(a.regsSince)
+	return regs, err == nil
+}
+
+// gpr returns the number of a general purpose register named rN as the
+// arm64, ppc64 and s390x registers are
+func gpr(reg string) (int, bool) {
+	if !strings.HasPrefix(reg, "r") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(reg[1:])
+	return n, err == nil
+}
+
+// archRegister gives an expression reading the arm64, ppc64 or s390x
+// register reg in the target's format. The kernel calls the ppc64
+// registers gprN and the arm64 ones xN, and struct pt_regs keeps them in an
+// array named for the architecture.
+func (t Target) archRegister(reg string) (string, error) {
+	arm64 := t.GoArch() == "arm64"
+	if arm64 && reg == "sp" {
+		switch t.Format {
+		case FormatBCC, FormatLibbpf:
+			return "ctx->sp", nil
+		case FormatSystemTap:
+			return "register(\"sp\")", nil
+		case FormatUprobeEvents, FormatPerf, FormatJSON:
+			return "%sp", nil
+		default:
+			return "reg(\"sp\")", nil
+		}
+	}
+	n, ok := gpr(reg)
+	if !ok {
+		return "", fmt.Errorf("no register %s on %s", reg, t.GoArch())
+	}
+	ppc64 := strings.HasPrefix(t.GoArch(), "ppc64")
+	switch t.Format {
+	case FormatBCC, FormatLibbpf:
+		if arm64 {
+			return fmt.Sprintf("ctx->regs[%d]", n), nil
+		}
+		if ppc64 {
+			return fmt.Sprintf("ctx->gpr[%d]", n), nil
+		}
+		return fmt.Sprintf("ctx->gprs[%d]", n), nil
+	case FormatSystemTap:
+		if arm64 {
+			return fmt.Sprintf("register(\"x%d\")", n), nil
+		}
+		return fmt.Sprintf("register(\"%s\")", reg), nil
+	case FormatUprobeEvents, FormatPerf, FormatJSON:
+		if arm64 {
+			return fmt.Sprintf("%%x%d", n), nil
+		}
+		if ppc64 {
+			return fmt.Sprintf("%%gpr%d", n), nil
+		}
+		return "%" + reg, nil
+	default:
+		return fmt.Sprintf("reg(\"%s\")", reg), nil
+	}
+}
+
+// ArgRegisters gives the number of integer arguments the register ABI
+// passes in registers on the target's architecture, which Arg can read
+func (t Target) ArgRegisters() int {
+	return len(t.arch().args)
+}
+
+// ArgValue gives argument i, as Arg does, but of size bytes for templates
+// to cast e.g. (int32). Registers always have values in their low bytes as
+// little endian stack words do but big endian stack words, as on s390x,
+// have them in their high bytes so those are shifted down or, in the
+// formats with fetchargs, read at the size.
+func (t Target) ArgValue(i, size int) (string, error) {
+	if t.RegsABI || !t.bigEndian() {
+		return t.Arg(i)
+	}
+	return t.stackValue(i+t.arch().frame, size)
+}
+
+// RetValue is ArgValue for the results Ret reads
+func (t Target) RetValue(argWords, i, size int) (string, error) {
+	if t.RegsABI || !t.bigEndian() {
+		return t.Ret(argWords, i)
+	}
+	return t.stackValue(argWords+i+t.arch().frame, size)
+}
+
+// stackValue reads the value of size bytes at the start of the big endian
+// stack word i words above the stack pointer
+func (t Target) stackValue(i, size int) (string, error) {
+	if size <= 0 || size >= 8 {
+		return t.stackWord(i)
+	}
+	switch t.Format {
+	case FormatUprobeEvents, FormatPerf, FormatJSON:
+		sp, err := t.register(t.arch().sp)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("+%d(%s):u%d", 8*i, sp, 8*size), nil
+	}
+	word, err := t.stackWord(i)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("(%s >> %d)", word, 64-8*size), nil
+}
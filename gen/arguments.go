@@ -0,0 +1,243 @@
+package gen
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+)
+
+// arguments are the key=value arguments of a target. The keys read, by
+// templates or by the likes of container targets, are recorded so that
+// keys nothing read can be reported.
+type arguments struct {
+	values map[string][]string
+	mu     sync.Mutex
+	read   map[string]bool
+	// renames are the names symbol= values are given to templates as;
+	// see address.go
+	renames map[string]string
+}
+
+func newArguments(values map[string][]string) *arguments {
+	return &arguments{values: values, read: map[string]bool{}}
+}
+
+// get is the Arguments func of a target
+func (a *arguments) get(key string) []string {
+	a.mu.Lock()
+	a.read[key] = true
+	a.mu.Unlock()
+	return a.lookup(key)
+}
+
+// lookup returns the values of key, renamed, without recording it as read
+func (a *arguments) lookup(key string) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	values := a.values[key]
+	if key != "symbol" || len(a.renames) == 0 {
+		return values
+	}
+	renamed := make([]string, len(values))
+	for i, v := range values {
+		renamed[i] = v
+		if name, ok := a.renames[v]; ok {
+			renamed[i] = name
+		}
+	}
+	return renamed
+}
+
+// setRenames sets the names symbol= values are given as
+func (a *arguments) setRenames(renames map[string]string) {
+	a.mu.Lock()
+	a.renames = renames
+	a.mu.Unlock()
+}
+
+// peekArgument returns the values of key without it counting as read, for
+// looking ahead at arguments the template may not read
+func (t Target) peekArgument(key string) []string {
+	if t.args == nil {
+		return t.Arguments(key)
+	}
+	return t.args.lookup(key)
+}
+
+// unread returns the keys given which haven't been read, sorted
+func (a *arguments) unread() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	keys := map[string]bool{}
+	for k := range a.values {
+		if !a.read[k] {
+			keys[k] = true
+		}
+	}
+	return sortedKeys(keys)
+}
+
+// paramHelpers are the helpers whose first argument is the key of an
+// argument
+var paramHelpers = map[string]bool{
+	"Param":         true,
+	"ParamInt":      true,
+	"ParamDuration": true,
+}
+
+// templateKeys returns the keys given as string constants to paramHelpers
+// and to Arguments, with call, anywhere in tmpl whether or not they're
+// read when it's rendered
+func templateKeys(tmpl *template.Template) map[string]bool {
+	keys := map[string]bool{}
+	walkCommands(tmpl, func(n *parse.CommandNode) {
+		args := n.Args
+		if i, ok := args[0].(*parse.IdentifierNode); ok && i.Ident == "call" && len(args) > 2 && helperName(args[1]) == "Arguments" {
+			args = args[1:]
+		} else if !paramHelpers[helperName(args[0])] {
+			return
+		}
+		if len(args) > 1 {
+			if s, ok := args[1].(*parse.StringNode); ok {
+				keys[s.Text] = true
+			}
+		}
+	})
+	return keys
+}
+
+// ArgumentsError is the error for key=value arguments which the template
+// didn't read when it was rendered
+type ArgumentsError struct {
+	// Unknown are the keys the template never reads, each mapped to the
+	// key it reads which is most like it or to "" if none are
+	Unknown map[string]string
+	// Unread are keys the template reads, but only in parts which weren't
+	// rendered for the target or with the other arguments
+	Unread []string
+}
+
+func (e *ArgumentsError) Error() string {
+	var parts []string
+	for _, k := range sortedKeys(toSet(e.Unknown)) {
+		part := fmt.Sprintf("%s= isn't an argument of the template", k)
+		if s := e.Unknown[k]; s != "" {
+			part += fmt.Sprintf(", did you mean %s=?", s)
+		}
+		parts = append(parts, part)
+	}
+	if len(e.Unread) > 0 {
+		verb := "matter"
+		if len(e.Unread) == 1 {
+			verb = "matters"
+		}
+		parts = append(parts, fmt.Sprintf("%s= only %s to parts of the template which weren't rendered for this target or with these arguments",
+			strings.Join(e.Unread, "=, "), verb))
+	}
+	return "unused arguments: " + strings.Join(parts, "; ")
+}
+
+func toSet(m map[string]string) map[string]bool {
+	set := map[string]bool{}
+	for k := range m {
+		set[k] = true
+	}
+	return set
+}
+
+// WithStrictArguments has Generate fail with an ArgumentsError when
+// key=value arguments weren't read by the template rather than log it as
+// a warning
+func WithStrictArguments() Option {
+	return func(o *options) {
+		o.strictArguments = true
+	}
+}
+
+// checkArguments reports the arguments of targets, rendered with tmpl,
+// which weren't read. A key read for any of the targets was used. tmpl is
+// nil for probe plans which have no template.
+func checkArguments(tmpl *template.Template, targets []*Target) error {
+	unread := map[string]int{}
+	known := map[string]bool{}
+	for _, t := range targets {
+		if t.args == nil {
+			continue
+		}
+		for _, k := range t.args.unread() {
+			unread[k]++
+		}
+		t.args.mu.Lock()
+		for k := range t.args.read {
+			known[k] = true
+		}
+		t.args.mu.Unlock()
+	}
+	if tmpl != nil {
+		for k := range templateKeys(tmpl) {
+			known[k] = true
+		}
+	}
+	e := &ArgumentsError{Unknown: map[string]string{}}
+	for k, n := range unread {
+		if n < len(targets) {
+			continue
+		}
+		if known[k] {
+			e.Unread = append(e.Unread, k)
+		} else {
+			e.Unknown[k] = closestKey(k, known)
+		}
+	}
+	if len(e.Unknown) == 0 && len(e.Unread) == 0 {
+		return nil
+	}
+	sort.Strings(e.Unread)
+	return e
+}
+
+// closestKey returns the key of keys most like key, if any is within a
+// couple of edits of it
+func closestKey(key string, keys map[string]bool) string {
+	best, bestDistance := "", 3
+	for _, k := range sortedKeys(keys) {
+		if d := editDistance(key, k); d < bestDistance {
+			best, bestDistance = k, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,329 @@
+package gen
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The defaults of the budgets a rendered bpftrace script is checked
+// against. bpftrace refuses more probes than BPFTRACE_MAX_PROBES, which
+// defaults to 512, each map takes a file descriptor and each printf format
+// adds to the programs and to what bpftrace keeps for printing.
+const (
+	defaultMaxProbes  = 512
+	defaultMaxMaps    = 512
+	defaultMaxPrintfs = 1024
+)
+
+// ownProbes and fleetProbes name what a script has for the template
+// itself, rather than for a symbol= argument, and what a fleet's targets
+// share in budget breakdowns
+const (
+	ownProbes   = "the template's own probes"
+	fleetProbes = "the fleet's own probes"
+)
+
+// usage is what a script, or a part of it, needs of the budgets
+type usage struct {
+	probes, maps, printfs int
+}
+
+// scriptUsage is what a script needs of the budgets in all and by source:
+// the symbol= pattern, or the template, its probes are for
+type scriptUsage struct {
+	usage
+	by map[string]*usage
+}
+
+// probeSources finds the symbol= pattern each attach point of the targets'
+// scripts is for
+type probeSources struct {
+	targets []*Target
+	// patterns map each target's functions to the first pattern matching
+	// them
+	patterns []map[string]string
+	fleet    bool
+}
+
+func newProbeSources(targets []*Target, fleet bool) probeSources {
+	s := probeSources{targets: targets, fleet: fleet}
+	for _, t := range targets {
+		patterns := map[string]string{}
+		for _, p := range t.peekArgument("symbol") {
+			matches := []string{p}
+			if strings.ContainsAny(p, "*?") {
+				matches, _ = t.SymbolsMatching(p)
+			}
+			for _, m := range matches {
+				if _, ok := patterns[m]; !ok {
+					patterns[m] = p
+				}
+			}
+		}
+		s.patterns = append(s.patterns, patterns)
+	}
+	return s
+}
+
+// probedFunction matches the function probed by a uprobe attach point,
+// quoted, bare or as an address with the comment offsetProbes gives it
+var probedFunction = regexp.MustCompile(`^\s*("[^"]+"|[^\s,+/{]+)(?:\s*\+\s*[0-9]+)?(?:\s*/\*\s*([^\s*]+))?`)
+
+// source gives the source of the attach point point
+func (s probeSources) source(point string) string {
+	point = strings.TrimLeft(point, " \t\n,")
+	for i, t := range s.targets {
+		var rest string
+		for _, kind := range []string{"uprobe:", "uretprobe:"} {
+			if strings.HasPrefix(point, kind+t.ExePath+":") {
+				rest = point[len(kind+t.ExePath+":"):]
+			}
+		}
+		m := probedFunction.FindStringSubmatch(rest)
+		if m == nil {
+			continue
+		}
+		function := strings.Trim(m[1], `"`)
+		if m[2] != "" {
+			function = m[2]
+		}
+		if p, ok := s.patterns[i][function]; ok {
+			return s.label(t, "symbol="+p)
+		}
+		return s.label(t, ownProbes)
+	}
+	return s.shared()
+}
+
+// shared is the source of what isn't for any one target: BEGIN and END,
+// which are merged in a fleet, and maps used for several sources
+func (s probeSources) shared() string {
+	if s.fleet {
+		return fleetProbes
+	}
+	return ownProbes
+}
+
+// sharedBy is the source of a map used for the sources a and b: the
+// target's own in a fleet if they're both for one target
+func (s probeSources) sharedBy(a, b string) string {
+	if s.fleet {
+		for _, t := range s.targets {
+			prefix := t.ServicePrefix + ": "
+			if strings.HasPrefix(a, prefix) && strings.HasPrefix(b, prefix) {
+				return prefix + ownProbes
+			}
+		}
+	}
+	return s.shared()
+}
+
+// mapOwner is the own source of the target of a fleet whose prefix all of
+// maps have, or "" if there isn't one
+func (s probeSources) mapOwner(maps []string) string {
+	if !s.fleet || len(maps) == 0 {
+		return ""
+	}
+	owner := ""
+	for _, name := range maps {
+		prefix := ""
+		for _, t := range s.targets {
+			p := "@" + t.ServicePrefix
+			if (name == p || strings.HasPrefix(name, p+"_")) && len(p) > len(prefix) {
+				prefix = p
+			}
+		}
+		if prefix == "" || owner != "" && owner != prefix {
+			return ""
+		}
+		owner = prefix
+	}
+	return owner[1:] + ": " + ownProbes
+}
+
+func (s probeSources) label(t *Target, source string) string {
+	if s.fleet {
+		return t.ServicePrefix + ": " + source
+	}
+	return source
+}
+
+// attachPointsOf splits a probe header into its attach points
+func attachPointsOf(header string) []string {
+	starts := attachPoint.FindAllStringIndex(stringLiteral.ReplaceAllStringFunc(header, func(s string) string {
+		return `"` + strings.Repeat(" ", len(s)-2) + `"`
+	}), -1)
+	points := make([]string, len(starts))
+	for i, start := range starts {
+		end := len(header)
+		if i+1 < len(starts) {
+			end = starts[i+1][0]
+		}
+		points[i] = header[start[0]:end]
+	}
+	return points
+}
+
+// countUsage counts the attach points, distinct maps and printf formats of
+// a rendered bpftrace script. BEGIN and END count as one probe each like
+// other attach points whose wildcards bpftrace may expand to many. The maps
+// and printfs of a probe are counted for the source of its first attach
+// point and maps used by probes of different sources are shared.
+func countUsage(script string, sources probeSources) (scriptUsage, error) {
+	u := scriptUsage{by: map[string]*usage{}}
+	blocks, _, err := splitBlocks(script)
+	if err != nil {
+		return u, err
+	}
+	add := func(source string) *usage {
+		if u.by[source] == nil {
+			u.by[source] = &usage{}
+		}
+		return u.by[source]
+	}
+	mapSources := map[string]string{}
+	for _, b := range blocks {
+		if b.kind() == "struct" {
+			continue
+		}
+		var maps []string
+		printfs := 0
+		body := b.body
+		scanScript(body, func(i int) bool {
+			switch {
+			case body[i] == '@':
+				j := i + 1
+				for j < len(body) && isIdentByte(body[j]) {
+					j++
+				}
+				maps = append(maps, body[i:j])
+			case strings.HasPrefix(body[i:], "printf") && (i == 0 || !isIdentByte(body[i-1])) &&
+				strings.HasPrefix(strings.TrimLeft(body[i+len("printf"):], " \t"), "("):
+				printfs++
+			}
+			return true
+		})
+		points := []string{sources.shared()}
+		if kind := b.kind(); kind != "BEGIN" && kind != "END" {
+			points = points[:0]
+			for _, point := range attachPointsOf(b.header) {
+				s := sources.source(point)
+				if s == fleetProbes {
+					// probes such as interval ones are a target's if its
+					// maps are
+					if owner := sources.mapOwner(maps); owner != "" {
+						s = owner
+					}
+				}
+				points = append(points, s)
+			}
+		}
+		for _, p := range points {
+			add(p).probes++
+		}
+		source := sources.shared()
+		if len(points) > 0 {
+			source = points[0]
+		}
+		add(source).printfs += printfs
+		for _, name := range maps {
+			if s, ok := mapSources[name]; !ok {
+				mapSources[name] = source
+			} else if s != source {
+				mapSources[name] = sources.sharedBy(s, source)
+			}
+		}
+	}
+	for name, source := range mapSources {
+		if source == fleetProbes {
+			if owner := sources.mapOwner([]string{name}); owner != "" {
+				source = owner
+			}
+		}
+		add(source).maps++
+	}
+	for _, c := range u.by {
+		u.probes += c.probes
+		u.maps += c.maps
+		u.printfs += c.printfs
+	}
+	return u, nil
+}
+
+// budget is a limit on what a script may need, given by an argument
+type budget struct {
+	key   string
+	def   int
+	what  string
+	why   string
+	count func(usage) int
+}
+
+var budgets = []budget{
+	{"max_probes", defaultMaxProbes, "probes", "bpftrace's BPFTRACE_MAX_PROBES defaults to 512", func(u usage) int { return u.probes }},
+	{"max_maps", defaultMaxMaps, "maps", "each map takes a file descriptor", func(u usage) int { return u.maps }},
+	{"max_printfs", defaultMaxPrintfs, "printf formats", "each makes the programs bigger", func(u usage) int { return u.printfs }},
+}
+
+// checkBudgets fails when the bpftrace script rendered for targets needs
+// more of any budget than the first target's arguments allow, breaking the
+// counts down by source so the symbol= pattern contributing most can be
+// narrowed. With WithVerbose the counts are logged when it doesn't.
+func checkBudgets(targets []*Target, script string) error {
+	fleet := len(targets) > 1 || targets[0].ServicePrefix != ""
+	u, err := countUsage(script, newProbeSources(targets, fleet))
+	if err != nil {
+		return err
+	}
+	var over, counts []string
+	for _, b := range budgets {
+		max, err := targets[0].ParamInt(b.key, b.def)
+		if err != nil {
+			return err
+		}
+		n := b.count(u.usage)
+		counts = append(counts, fmt.Sprintf("%d of %s=%d %s", n, b.key, max, b.what))
+		if n <= max {
+			continue
+		}
+		over = append(over, fmt.Sprintf("the script needs %d %s which is more than %s=%d (%s); %s by source: %s",
+			n, b.what, b.key, max, b.why, b.what, u.breakdown(b.count)))
+	}
+	if len(over) > 0 {
+		return fmt.Errorf("%s; narrow the symbol= patterns needing most or raise the budget", strings.Join(over, "; "))
+	}
+	if targets[0].opts.verbose {
+		name := targets[0].ExePath
+		if fleet {
+			name = "fleet"
+		}
+		log.Printf("%s: the script needs %s and %s", name, strings.Join(counts[:len(counts)-1], ", "), counts[len(counts)-1])
+	}
+	return nil
+}
+
+// breakdown lists the sources needing any of what count counts, most
+// first
+func (u scriptUsage) breakdown(count func(usage) int) string {
+	var sources []string
+	for s, c := range u.by {
+		if count(*c) > 0 {
+			sources = append(sources, s)
+		}
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		a, b := count(*u.by[sources[i]]), count(*u.by[sources[j]])
+		if a != b {
+			return a > b
+		}
+		return sources[i] < sources[j]
+	})
+	parts := make([]string, len(sources))
+	for i, s := range sources {
+		parts[i] = fmt.Sprintf("%s %d", s, count(*u.by[s]))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,306 @@
+package gen
+
+import (
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stevenjohnstone/go-bpf-gen/layout"
+)
+
+// DefaultCacheDir is go-bpf-gen under the user's cache directory, where the
+// command keeps what's found in targets between runs
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "go-bpf-gen")
+}
+
+// goBuildID returns the Go build ID of an ELF file which changes whenever
+// the file is rebuilt with different inputs
+func goBuildID(f *elf.File) (string, error) {
+	s := f.Section(".note.go.buildid")
+	if s == nil {
+		return "", errors.New("no Go build ID")
+	}
+	id, err := noteDesc(f, s)
+	if err != nil {
+		return "", err
+	}
+	return string(id), nil
+}
+
+// toolID identifies the build of go-bpf-gen itself so results found by
+// other builds, which may find them differently, aren't used
+func toolID() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	f, err := elf.Open(exe)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return goBuildID(f)
+}
+
+// cacheEntry is what's been found in one build of a target. Only what
+// templates have asked for is kept.
+type cacheEntry struct {
+	BuildID string                    `json:"build_id"`
+	Tool    string                    `json:"tool"`
+	RegsABI *bool                     `json:"regs_abi,omitempty"`
+	Symbols map[string]elf.Symbol     `json:"symbols"`
+	Returns map[string][]int          `json:"returns"`
+	Params  map[string][]layout.Param `json:"params"`
+	Results map[string][]layout.Param `json:"results"`
+}
+
+// resolveCache is the cache entry of a target named after the hash of its
+// Go build ID and go-bpf-gen's so a rebuilt target gets a new entry. The
+// methods of a nil resolveCache find nothing.
+type resolveCache struct {
+	exe     string
+	path    string
+	verbose bool
+
+	mu           sync.Mutex
+	entry        cacheEntry
+	dirty        bool
+	hits, misses int
+}
+
+// openCache returns the cache entry in cacheDir for the exe or nil when
+// cacheDir is empty or the exe has no Go build ID
+func openCache(cacheDir, exe string, f *elf.File, verbose bool) *resolveCache {
+	if cacheDir == "" {
+		return nil
+	}
+	id, err := goBuildID(f)
+	if err != nil {
+		return nil
+	}
+	tool, err := toolID()
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(id + "\n" + tool))
+	c := &resolveCache{
+		exe:     exe,
+		path:    filepath.Join(cacheDir, hex.EncodeToString(sum[:])+".json"),
+		verbose: verbose,
+	}
+	data, err := os.ReadFile(c.path)
+	// the IDs are checked in case of a hash collision or a damaged file
+	if err != nil || json.Unmarshal(data, &c.entry) != nil || c.entry.BuildID != id || c.entry.Tool != tool {
+		c.entry = cacheEntry{BuildID: id, Tool: tool}
+	} else {
+		// pruneCache removes the entries which haven't been used
+		now := time.Now()
+		os.Chtimes(c.path, now, now)
+	}
+	if c.entry.Symbols == nil {
+		c.entry.Symbols = map[string]elf.Symbol{}
+	}
+	if c.entry.Returns == nil {
+		c.entry.Returns = map[string][]int{}
+	}
+	if c.entry.Params == nil {
+		c.entry.Params = map[string][]layout.Param{}
+	}
+	if c.entry.Results == nil {
+		c.entry.Results = map[string][]layout.Param{}
+	}
+	return c
+}
+
+// count records a lookup and returns found
+func (c *resolveCache) count(found bool) bool {
+	if found {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return found
+}
+
+func (c *resolveCache) regsABI() (bool, bool) {
+	if c == nil {
+		return false, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.count(c.entry.RegsABI != nil) {
+		return false, false
+	}
+	return *c.entry.RegsABI, true
+}
+
+func (c *resolveCache) setRegsABI(regs bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entry.RegsABI = &regs
+	c.dirty = true
+}
+
+func (c *resolveCache) symbol(name string) (elf.Symbol, bool) {
+	if c == nil {
+		return elf.Symbol{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.entry.Symbols[name]
+	return s, c.count(ok)
+}
+
+func (c *resolveCache) setSymbol(s elf.Symbol) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entry.Symbols[s.Name] = s
+	c.dirty = true
+}
+
+func (c *resolveCache) returns(symbol string) ([]int, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	offsets, ok := c.entry.Returns[symbol]
+	return offsets, c.count(ok)
+}
+
+func (c *resolveCache) setReturns(symbol string, offsets []int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entry.Returns[symbol] = offsets
+	c.dirty = true
+}
+
+// params returns a copy of the cached parameters, or results, of function
+// as callers renumber their words. They're nil if the DWARF data doesn't
+// describe function.
+func (c *resolveCache) params(function string, results bool) ([]layout.Param, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := c.entry.Params
+	if results {
+		m = c.entry.Results
+	}
+	params, ok := m[function]
+	if !c.count(ok) {
+		return nil, false
+	}
+	if params == nil {
+		return nil, true
+	}
+	return append([]layout.Param{}, params...), true
+}
+
+func (c *resolveCache) setParams(function string, results bool, params []layout.Param) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := c.entry.Params
+	if results {
+		m = c.entry.Results
+	}
+	if params != nil {
+		params = append([]layout.Param{}, params...)
+	}
+	m[function] = params
+	c.dirty = true
+}
+
+// save writes the entry if anything's been added to it
+func (c *resolveCache) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.verbose {
+		log.Printf("cache %s for %s: %d hits, %d misses", c.path, c.exe, c.hits, c.misses)
+	}
+	if !c.dirty {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(c.entry)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".entry-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	c.dirty = false
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// PruneCache removes the cache entries in dir which haven't been used for
+// longer than age, or all of them when age is 0, and returns how many were
+// removed
+func PruneCache(dir string, age time.Duration) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") && !strings.HasPrefix(e.Name(), ".entry-") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if age > 0 && time.Since(info.ModTime()) < age {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
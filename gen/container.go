@@ -0,0 +1,161 @@
+package gen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoContainer is returned when no container has the name or ID
+	// given by a container:<name or id> target
+	ErrNoContainer = errors.New("no such container")
+	// ErrContainerRuntime is returned when the container runtime can't be
+	// asked about a container
+	ErrContainerRuntime = errors.New("cannot talk to the container runtime")
+)
+
+// containerID matches what could be a container ID or a prefix of one, which
+// can be looked for in cgroups without the runtime's help
+var containerID = regexp.MustCompile(`^[0-9a-f]{12,64}$`)
+
+// containerPid finds the pid of the main process of the container called
+// name, or with an ID starting with name, by asking Docker. Without Docker
+// the cgroups of containerd and other runtimes are searched for the ID.
+func containerPid(name string) (int, error) {
+	pid, err := dockerPid(name)
+	if !errors.Is(err, ErrContainerRuntime) || !containerID.MatchString(name) {
+		return pid, err
+	}
+	pid, cgroupErr := cgroupPid(name)
+	if cgroupErr == nil || !errors.Is(cgroupErr, ErrNoContainer) {
+		return pid, cgroupErr
+	}
+	return 0, fmt.Errorf("%w and %s isn't the ID of a container in /sys/fs/cgroup", err, name)
+}
+
+// dockerSocket returns the path of the Docker API's socket from DOCKER_HOST
+// or the default
+func dockerSocket() string {
+	if host := os.Getenv("DOCKER_HOST"); strings.HasPrefix(host, "unix://") {
+		return strings.TrimPrefix(host, "unix://")
+	}
+	return "/var/run/docker.sock"
+}
+
+func dockerPid(name string) (int, error) {
+	socket := dockerSocket()
+	client := http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	resp, err := client.Get("http://docker/containers/" + url.PathEscape(name) + "/json")
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrContainerRuntime, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return 0, fmt.Errorf("%w: %s", ErrNoContainer, name)
+	default:
+		return 0, fmt.Errorf("%w: docker returned %s for %s", ErrContainerRuntime, resp.Status, name)
+	}
+	var container struct {
+		State struct {
+			Running bool
+			Pid     int
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&container); err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrContainerRuntime, err)
+	}
+	if !container.State.Running || container.State.Pid == 0 {
+		return 0, fmt.Errorf("container %s isn't running", name)
+	}
+	return container.State.Pid, nil
+}
+
+// cgroupPid returns the lowest pid in a cgroup whose name contains id, such
+// as docker-<id>.scope with systemd or <id> under a kubepods cgroup
+func cgroupPid(id string) (int, error) {
+	pid := 0
+	err := filepath.WalkDir("/sys/fs/cgroup", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || !strings.Contains(d.Name(), id) {
+			return nil
+		}
+		procs, err := os.ReadFile(filepath.Join(path, "cgroup.procs"))
+		if err != nil {
+			return nil
+		}
+		for _, field := range strings.Fields(string(procs)) {
+			if p, err := strconv.Atoi(field); err == nil && (pid == 0 || p < pid) {
+				pid = p
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if pid == 0 {
+		return 0, fmt.Errorf("%w: %s", ErrNoContainer, id)
+	}
+	return pid, nil
+}
+
+// containerProcess returns the lowest pid of the processes in the cgroups of
+// pid whose command name, in /proc/<pid>/comm, is comm. It's for
+// containers which run more than one program.
+func containerProcess(pid int, comm string) (int, error) {
+	// the kernel truncates command names to 15 bytes
+	if len(comm) > 15 {
+		comm = comm[:15]
+	}
+	cgroup, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return 0, procError(pid, err)
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	var pids []int
+	for _, e := range entries {
+		p, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		c, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", p))
+		if err != nil || !bytes.Equal(c, cgroup) {
+			continue
+		}
+		name, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", p))
+		if err == nil && strings.TrimSpace(string(name)) == comm {
+			pids = append(pids, p)
+		}
+	}
+	if len(pids) == 0 {
+		return 0, fmt.Errorf("no process called %s in the container of process %d", comm, pid)
+	}
+	sort.Ints(pids)
+	return pids[0], nil
+}
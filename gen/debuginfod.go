@@ -0,0 +1,162 @@
+package gen
+
+import (
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// elfBuildID returns the GNU build ID of an ELF file in hex. Go only
+// writes one when linking externally or with -ldflags=-B=gobuildid.
+func elfBuildID(f *elf.File) (string, error) {
+	s := f.Section(".note.gnu.build-id")
+	if s == nil {
+		return "", errors.New("no GNU build ID (link with -ldflags=-B=gobuildid to add one)")
+	}
+	id, err := noteDesc(f, s)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// noteDesc returns the descriptor of the one note in the section s such as
+// the ID in a build ID note
+func noteDesc(f *elf.File, s *elf.Section) ([]byte, error) {
+	note, err := s.Data()
+	if err != nil {
+		return nil, err
+	}
+	// namesz, descsz and type then the name e.g. "GNU\0" and the ID
+	if len(note) < 16 {
+		return nil, errors.New("short build ID note")
+	}
+	namesz := int(f.ByteOrder.Uint32(note[0:4]))
+	descsz := int(f.ByteOrder.Uint32(note[4:8]))
+	start := 12 + (namesz+3)&^3
+	if start+descsz > len(note) {
+		return nil, errors.New("malformed build ID note")
+	}
+	return note[start : start+descsz], nil
+}
+
+// debuginfodCache returns the directory debuginfod clients cache files in
+func debuginfodCache() string {
+	if dir := os.Getenv("DEBUGINFOD_CACHE_PATH"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "debuginfod_client")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".cache", "debuginfod_client")
+}
+
+// fetchDebugInfo returns the path of the debug file with the given build
+// ID from the debuginfod cache or else from the first of the servers in
+// DEBUGINFOD_URLS which has it. Servers aren't asked when offline is true.
+func fetchDebugInfo(id string, offline bool) (string, error) {
+	path := filepath.Join(debuginfodCache(), id, "debuginfo")
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if offline {
+		return "", fmt.Errorf("debug file for build ID %s isn't in %s", id, debuginfodCache())
+	}
+	urls := strings.Fields(os.Getenv("DEBUGINFOD_URLS"))
+	if len(urls) == 0 {
+		return "", errors.New("DEBUGINFOD_URLS isn't set")
+	}
+	timeout := 90 * time.Second
+	if s, err := strconv.Atoi(os.Getenv("DEBUGINFOD_TIMEOUT")); err == nil && s > 0 {
+		timeout = time.Duration(s) * time.Second
+	}
+	client := http.Client{Timeout: timeout}
+	var errs []string
+	for _, url := range urls {
+		err := download(&client, strings.TrimSuffix(url, "/")+"/buildid/"+id+"/debuginfo", path)
+		if err == nil {
+			return path, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return "", errors.New(strings.Join(errs, "; "))
+}
+
+// download gets url into path through a temporary file so a failed
+// download doesn't leave a partial file in the cache
+func download(client *http.Client, url, path string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".debuginfo")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("%s: %s", url, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// findDebugInfo uses debuginfod for the symbols and DWARF data of a target
+// without a symbol table. Probes are still attached to the target. If the
+// debug file can't be found the target is used as it is with a warning
+// when DEBUGINFOD_URLS is set or offline is true.
+func (t *Target) findDebugInfo(offline bool) {
+	if !t.Stripped() {
+		return
+	}
+	id, err := elfBuildID(t.bin.exe.elf)
+	if err == nil {
+		var path string
+		if path, err = fetchDebugInfo(id, offline); err == nil {
+			var debug *elfData
+			if debug, err = openDebugFile(path); err == nil {
+				t.debugFile = path
+				t.bin.debug = debug
+				return
+			}
+		}
+	}
+	// without servers to ask stripped targets are used quietly as before
+	if offline || os.Getenv("DEBUGINFOD_URLS") != "" {
+		log.Printf("%s is stripped and its debug file couldn't be fetched with debuginfod (%s)", t.ExePath, err)
+	}
+}
+
+// openDebugFile opens a fetched debug file making sure it's an ELF file
+// with a symbol table
+func openDebugFile(path string) (*elfData, error) {
+	d, err := openELF(path)
+	if err != nil {
+		return nil, err
+	}
+	if d.elf.Section(".symtab") == nil {
+		d.close()
+		return nil, fmt.Errorf("%s has no symbol table", path)
+	}
+	return d, nil
+}
@@ -0,0 +1,22 @@
+// Package gen generates bpftrace, BCC, libbpf, SystemTap and other scripts
+// probing Go programs from templates, as the go-bpf-gen command does.
+//
+// A Target is made for an executable, shared object or running process and
+// a template is rendered for it with Generate:
+//
+//	target, err := gen.NewTarget("/usr/local/bin/server",
+//		gen.WithArguments(map[string][]string{"symbol": {"main.handle"}}))
+//	if err != nil {
+//		return err
+//	}
+//	defer target.Close()
+//	err = gen.Generate(os.Stdout, "latency.bt", target, nil)
+//
+// The bundled templates are in templates.FS. Templates of your own are
+// found first when given with WithTemplates:
+//
+//	target, err := gen.NewTarget(path, gen.WithTemplates(os.DirFS("/etc/probes")))
+//
+// Errors in the target, its arguments or a template are returned rather
+// than ending the program.
+package gen
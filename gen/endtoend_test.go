@@ -0,0 +1,152 @@
+package gen_test
+
+import (
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+)
+
+// fixtureScript renders template for the fixture exe with args
+func fixtureScript(t *testing.T, exe, template string, args map[string][]string) string {
+	t.Helper()
+	target, err := gen.NewTarget(exe, gen.WithArguments(args), gen.WithStrictArguments())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	script, err := gen.GenerateString(template, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+// checkTrace checks the output of bpftrace has each of want
+func checkTrace(t *testing.T, output string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		if !strings.Contains(output, w) {
+			t.Errorf("no %s in the output of bpftrace:\n%s", w, output)
+		}
+	}
+}
+
+// TestHTTPServerTrace has the HTTP server fixture serve requests, traced by
+// http/server.bt when bpftrace can be run
+func TestHTTPServerTrace(t *testing.T) {
+	exe := buildTestdata(t, "local", "httpserver")
+	script := fixtureScript(t, exe, "http/server.bt", nil)
+	addr := startFixture(t, exec.Command(exe))
+	get := func(path string, status int) {
+		t.Helper()
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != status {
+			t.Fatalf("GET %s: got %s, %v, want %d", path, resp.Status, err, status)
+		}
+		if status == http.StatusOK && string(body) != "hello\n" {
+			t.Fatalf("GET %s: got %q", path, body)
+		}
+	}
+	workload := func() {
+		for i := 0; i < 3; i++ {
+			get("/hello", http.StatusOK)
+		}
+		get("/slow", http.StatusOK)
+		get("/missing", http.StatusNotFound)
+	}
+	// the fixture serves whether it's traced or not
+	workload()
+
+	output := trace(t, script, workload)
+	checkTrace(t, output, "@latency_us[/hello]:", "@latency_us[/slow]:", "@status[/hello, 200]: 3", "@status[/missing, 404]: 1")
+}
+
+// TestChannelsTrace runs the slow consumer fixture, whose sends block for
+// the 5ms its consumer takes over each value, traced by channels.bt when
+// bpftrace can be run. The blocked sends are counted by the site the
+// channel was made at, in main.main.
+func TestChannelsTrace(t *testing.T) {
+	exe := buildTestdata(t, "local", "slowconsumer")
+	script := fixtureScript(t, exe, "channels.bt", map[string][]string{"min_block": {"1000"}})
+	workload := func() {
+		start := time.Now()
+		out, err := exec.Command(exe).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", exe, err, out)
+		}
+		// the last value isn't waited for by its send
+		if elapsed := time.Since(start); elapsed < 19*5*time.Millisecond {
+			t.Fatalf("the sends took %s, not blocking on the consumer", elapsed)
+		}
+	}
+	workload()
+
+	output := trace(t, script, workload)
+	checkTrace(t, output, "@send_us_by_site[", "main.main")
+	if strings.Contains(output, "@send_us_by_stack[") {
+		t.Errorf("a send on a channel made while tracing wasn't attributed to where it was made:\n%s", output)
+	}
+}
+
+// TestDNSTrace has the resolver fixture look up names with its own DNS
+// server, which has an address for ok.test and no missing.test, traced by
+// dns.bt when bpftrace can be run
+func TestDNSTrace(t *testing.T) {
+	exe := buildTestdata(t, "local", "resolver")
+	script := fixtureScript(t, exe, "dns.bt", nil)
+	workload := func() {
+		out, err := exec.Command(exe, "ok.test", "missing.test", "ok.test").CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", exe, err, out)
+		}
+		for _, want := range []string{"ok.test [{127.0.0.2 }]", "lookup missing.test", "no such host"} {
+			if !strings.Contains(string(out), want) {
+				t.Fatalf("no %s in the fixture's lookups:\n%s", want, out)
+			}
+		}
+	}
+	workload()
+
+	output := trace(t, script, workload)
+	checkTrace(t, output, "@latency_us[ok.test]:", "@latency_us[missing.test]:", "@failures[missing.test]: 1", "lookup missing.test failed: no such host", "@lookups: 3", "@resolver[go]:")
+}
+
+// TestExecTrace has the execer fixture run itself to exit with codes 0 and
+// 3 and to be killed, and a command which doesn't exist, traced by exec.bt
+// when bpftrace can be run
+func TestExecTrace(t *testing.T) {
+	exe := buildTestdata(t, "local", "execer")
+	script := fixtureScript(t, exe, "exec.bt", nil)
+	workload := func() {
+		out, err := exec.Command(exe).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", exe, err, out)
+		}
+		for _, want := range []string{"hello world] ok", "-exit 3] exit status 3", "-kill] signal: killed", "/nonexistent/command] fork/exec"} {
+			if !strings.Contains(string(out), want) {
+				t.Fatalf("no %s in what the fixture ran:\n%s", want, out)
+			}
+		}
+	}
+	workload()
+
+	output := trace(t, script, workload)
+	checkTrace(t, output,
+		" start "+exe+": "+exe+" -exit 0 hello world\n",
+		" "+exe+" exited with code 0 after ",
+		" "+exe+" exited with code 3 after ",
+		" "+exe+" killed by signal 9 after ",
+		" failed to start /nonexistent/command\n",
+		"@runtime_ms["+exe+"]:",
+	)
+}
@@ -0,0 +1,114 @@
+package gen
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TemplateError is an error parsing or rendering a template. It names the
+// template and the line the error is on and, when a helper such as
+// SymbolReturns failed, the helper.
+type TemplateError struct {
+	Template string
+	Line     int
+	// Column is 0 for parse errors, which text/template only gives the line
+	// of
+	Column int
+	// Helper is the Target method or template function which failed, if it
+	// was one
+	Helper string
+	// Action is the action which failed e.g. $.SymbolReturns
+	Action string
+	// Partial is the template defined in the file, with define, which
+	// failed or empty for the file's main template
+	Partial string
+	Err     error
+	// excerpt has the line before the failing one and the failing one
+	excerpt string
+}
+
+func (e *TemplateError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s:%d", e.Template, e.Line)
+	if e.Column > 0 {
+		fmt.Fprintf(&b, ":%d", e.Column)
+	}
+	if e.Partial != "" {
+		fmt.Fprintf(&b, ": in %s", e.Partial)
+	}
+	switch {
+	case e.Helper != "":
+		fmt.Fprintf(&b, ": %s failed: %s", e.Helper, e.Err)
+	case e.Action != "":
+		fmt.Fprintf(&b, ": at <%s>: %s", e.Action, e.Err)
+	default:
+		fmt.Fprintf(&b, ": %s", e.Err)
+	}
+	b.WriteString(e.excerpt)
+	return b.String()
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	// text/template gives execution errors as
+	// template: <name>:<line>:<col>: executing "<name>" at <<action>>: <error>
+	execError = regexp.MustCompile(`(?s)^template: (.*):(\d+):(\d+): executing "(.*?)" at <(.*?)>: (.*)$`)
+	// and parse errors as template: <name>:<line>: <error>
+	parseError = regexp.MustCompile(`(?s)^template: (.*?):(\d+): (.*)$`)
+	// helpers which fail give error calling <name>: <error>
+	callError = regexp.MustCompile(`(?s)^error calling (\w+): (.*)$`)
+)
+
+// templateError gives err from parsing or executing the template source the
+// name and line of the template, the helper which failed and an excerpt of
+// the template. Errors it can't make sense of are returned as they are.
+func templateError(source string, err error) error {
+	e := &TemplateError{}
+	var message string
+	if m := execError.FindStringSubmatch(err.Error()); m != nil {
+		e.Template, e.Action, message = m[1], m[5], m[6]
+		if m[4] != e.Template {
+			e.Partial = m[4]
+		}
+		e.Line, _ = strconv.Atoi(m[2])
+		e.Column, _ = strconv.Atoi(m[3])
+	} else if m := parseError.FindStringSubmatch(err.Error()); m != nil {
+		e.Template, message = m[1], m[3]
+		e.Line, _ = strconv.Atoi(m[2])
+	} else {
+		return err
+	}
+	e.Err = errors.New(message)
+	if m := callError.FindStringSubmatch(message); m != nil {
+		e.Err = errors.New(m[2])
+		// a template's own panic, or unmet requirement, is its message
+		// for the user
+		if m[1] == "panic" || m[1] == "Requires" {
+			e.Action = ""
+		} else {
+			e.Helper = m[1]
+		}
+	}
+	// the helper's own error is kept so callers can check it with errors.Is
+	for inner := err; inner != nil; inner = errors.Unwrap(inner) {
+		if inner.Error() == e.Err.Error() {
+			e.Err = inner
+			break
+		}
+	}
+	var excerpt strings.Builder
+	lines := strings.Split(source, "\n")
+	for i := e.Line - 2; i < e.Line; i++ {
+		if i >= 0 && i < len(lines) {
+			fmt.Fprintf(&excerpt, "\n  %4d | %s", i+1, lines[i])
+		}
+	}
+	e.excerpt = excerpt.String()
+	return e
+}
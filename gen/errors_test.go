@@ -0,0 +1,105 @@
+package gen_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+	"github.com/stevenjohnstone/go-bpf-gen/testtarget"
+)
+
+// TestTemplateErrors checks the errors of broken templates name the
+// template, line and failing helper and quote the lines they fail on
+func TestTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		// want is the whole message
+		want string
+		// helper and partial are the ones the TemplateError names
+		helper, partial string
+	}{
+		{
+			name:     "helper failing",
+			template: "// probes\n{{ range .SymbolReturns \"main.nothing\" }}{{ . }}{{ end }}\n",
+			want: `broken.bt:2:9: SymbolReturns failed: main.nothing: symbol not found
+     1 | // probes
+     2 | {{ range .SymbolReturns "main.nothing" }}{{ . }}{{ end }}`,
+			helper: "SymbolReturns",
+		},
+		{
+			name:     "argument out of range",
+			template: "uprobe:{{ .ExePath }}:main.main {\n  $x = {{ .Arg 40 }};\n}\n",
+			want: `broken.bt:2:10: Arg failed: argument 40 out of bounds, only 9 are passed in registers. roll your own
+     1 | uprobe:{{ .ExePath }}:main.main {
+     2 |   $x = {{ .Arg 40 }};`,
+			helper: "Arg",
+		},
+		{
+			name:     "bad version",
+			template: "{{ if .GoVersionAtLeast \"1.21\" }}new{{ end }}\n",
+			want: `broken.bt:1:6: GoVersionAtLeast failed: bad version "1.21", must be like go1.21 or v1.2.3
+     1 | {{ if .GoVersionAtLeast "1.21" }}new{{ end }}`,
+			helper: "GoVersionAtLeast",
+		},
+		{
+			name:     "template panicking",
+			template: "BEGIN {}\n{{ panic \"broken.bt needs symbol=<function>\" }}\n",
+			want: `broken.bt:2:3: broken.bt needs symbol=<function>
+     1 | BEGIN {}
+     2 | {{ panic "broken.bt needs symbol=<function>" }}`,
+		},
+		{
+			name:     "parse error",
+			template: "BEGIN {}\n{{ if .HasDWARF }}",
+			want: `broken.bt:2: unexpected EOF
+     1 | BEGIN {}
+     2 | {{ if .HasDWARF }}`,
+		},
+		{
+			name:     "missing helper",
+			template: "{{ .Nothing }}\n",
+			want: `broken.bt:1:3: at <.Nothing>: can't evaluate field Nothing in type *gen.Target
+     1 | {{ .Nothing }}`,
+		},
+		{
+			name:     "in a partial",
+			template: "{{ template \"probe\" . }}\n{{ define \"probe\" }}\n  {{ .SymbolSize \"main.nothing\" }}\n{{ end }}\n",
+			want: `broken.bt:3:5: in probe: SymbolSize failed: main.nothing: symbol not found
+     2 | {{ define "probe" }}
+     3 |   {{ .SymbolSize "main.nothing" }}`,
+			helper:  "SymbolSize",
+			partial: "probe",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, err := testtarget.New("/bin/target", testtarget.Runtime(),
+				gen.WithTemplates(fstest.MapFS{"broken.bt": {Data: []byte(test.template)}}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+			var script strings.Builder
+			err = gen.Generate(&script, "broken.bt", target, nil)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if err.Error() != test.want {
+				t.Errorf("got\n%s\nwant\n%s", err, test.want)
+			}
+			var e *gen.TemplateError
+			if !errors.As(err, &e) {
+				t.Fatalf("%T isn't a TemplateError", err)
+			}
+			if e.Template != "broken.bt" || e.Helper != test.helper || e.Partial != test.partial {
+				t.Errorf("got template %q, helper %q and partial %q, want broken.bt, %q and %q", e.Template, e.Helper, e.Partial, test.helper, test.partial)
+			}
+			if script.Len() > 0 {
+				t.Errorf("%d bytes were written", script.Len())
+			}
+		})
+	}
+}
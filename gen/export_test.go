@@ -0,0 +1,21 @@
+package gen
+
+import "sort"
+
+// RuntimeOffsetFields returns the type.field names of the runtime structs
+// RuntimeOffset has offsets for in release without DWARF data
+func RuntimeOffsetFields(release string) []string {
+	var fields []string
+	for field := range runtimeOffsets[release] {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// MapNames returns the names of the maps used by a bpftrace script, sorted
+var MapNames = mapNames
+
+// DryRun has bpftrace, the command at the path given, check a script with
+// --dry-run as the selftest does
+var DryRun = dryRun
@@ -0,0 +1,361 @@
+package gen
+
+import (
+	"bytes"
+	"debug/buildinfo"
+	"debug/elf"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/stevenjohnstone/go-bpf-gen/abi"
+	"github.com/stevenjohnstone/go-bpf-gen/layout"
+	"github.com/stevenjohnstone/go-bpf-gen/ret"
+)
+
+// elfData is an opened ELF file with its symbols and DWARF data, which are
+// read the first time they're needed and kept. The file is mapped into
+// memory where it can be so that code is decoded where it lies rather than
+// sections being read into the heap.
+type elfData struct {
+	r io.ReaderAt
+	// closer closes the file opened by openELF. It's nil for the readers
+	// given to NewTargetReader, which the caller closes.
+	closer io.Closer
+	// mapped is the mapped file or nil when it's read instead
+	mapped []byte
+	elf    *elf.File
+
+	symbolsOnce sync.Once
+	symbols     []elf.Symbol
+	symbolsErr  error
+	// pclntab has the names of the functions only found in .gopclntab,
+	// for files without a symbol table
+	pclntab map[string]bool
+
+	// byName has the indices in symbols of the symbols with each name and
+	// byAddress the indices of the functions sorted by address
+	indexOnce sync.Once
+	byName    map[string][]int
+	byAddress []int
+
+	dwarfOnce sync.Once
+	dwarf     *layout.Data
+	dwarfErr  error
+}
+
+func openELF(path string) (*elfData, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &elfData{r: f, closer: f}
+	if m, err := mmap(f); err == nil {
+		d.mapped = m
+		d.r = bytes.NewReader(m)
+	}
+	if d.elf, err = elf.NewFile(d.r); err != nil {
+		d.close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// readELF is openELF for an ELF file read from r
+func readELF(r io.ReaderAt) (*elfData, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return &elfData{r: r, elf: f}, nil
+}
+
+// code returns the machine code of the function symbol, sliced from the
+// mapped file when it can be
+func (d *elfData) code(symbol elf.Symbol) ([]byte, error) {
+	section, err := ret.Section(d.elf, symbol)
+	if err != nil {
+		return nil, err
+	}
+	start := section.Offset + symbol.Value - section.Addr
+	if d.mapped != nil && start+symbol.Size <= uint64(len(d.mapped)) {
+		return d.mapped[start : start+symbol.Size], nil
+	}
+	code := make([]byte, symbol.Size)
+	if _, err := d.r.ReadAt(code, int64(start)); err != nil {
+		return nil, err
+	}
+	return code, nil
+}
+
+// symbolTable returns the symbols found by elfSymbols or, for Go
+// executables stripped of them, the functions of their .gopclntab
+func (d *elfData) symbolTable() ([]elf.Symbol, error) {
+	d.symbolsOnce.Do(func() {
+		d.symbols, d.symbolsErr = elfSymbols(d.elf)
+		if d.elf.Section(".symtab") != nil {
+			return
+		}
+		functions, err := ret.PclntabSymbols(d.elf)
+		if err != nil {
+			return
+		}
+		// the dynamic symbols come first so they're found by lookup
+		seen := map[string]bool{}
+		for _, s := range d.symbols {
+			seen[s.Name] = true
+		}
+		d.pclntab = map[string]bool{}
+		for _, s := range functions {
+			if !seen[s.Name] {
+				d.symbols = append(d.symbols, s)
+				d.pclntab[s.Name] = true
+			}
+		}
+		d.symbolsErr = nil
+	})
+	return d.symbols, d.symbolsErr
+}
+
+// index builds byName and byAddress the first time a symbol is looked up
+func (d *elfData) index() error {
+	symbols, err := d.symbolTable()
+	if err != nil {
+		return err
+	}
+	d.indexOnce.Do(func() {
+		d.byName = make(map[string][]int, len(symbols))
+		for i, s := range symbols {
+			d.byName[s.Name] = append(d.byName[s.Name], i)
+			if elf.ST_TYPE(s.Info) == elf.STT_FUNC {
+				d.byAddress = append(d.byAddress, i)
+			}
+		}
+		sort.SliceStable(d.byAddress, func(i, j int) bool {
+			return symbols[d.byAddress[i]].Value < symbols[d.byAddress[j]].Value
+		})
+	})
+	return nil
+}
+
+// lookup returns the first symbol called name
+func (d *elfData) lookup(name string) (elf.Symbol, error) {
+	if err := d.index(); err != nil {
+		return elf.Symbol{}, err
+	}
+	i, ok := d.byName[name]
+	if !ok {
+		return elf.Symbol{}, ret.ErrSymbolNotFound
+	}
+	return d.symbols[i[0]], nil
+}
+
+// function returns the function symbol whose code includes address
+func (d *elfData) function(address uint64) (elf.Symbol, error) {
+	if err := d.index(); err != nil {
+		return elf.Symbol{}, err
+	}
+	// the last function starting at or before address
+	n := sort.Search(len(d.byAddress), func(i int) bool {
+		return d.symbols[d.byAddress[i]].Value > address
+	})
+	if n == 0 {
+		return elf.Symbol{}, ret.ErrSymbolNotFound
+	}
+	s := d.symbols[d.byAddress[n-1]]
+	if address >= s.Value+s.Size {
+		return elf.Symbol{}, ret.ErrSymbolNotFound
+	}
+	return s, nil
+}
+
+func (d *elfData) dwarfData() (*layout.Data, error) {
+	d.dwarfOnce.Do(func() {
+		data, err := d.elf.DWARF()
+		if err != nil {
+			d.dwarfErr = err
+			return
+		}
+		symbols, err := d.symbolTable()
+		if err != nil {
+			d.dwarfErr = err
+			return
+		}
+		d.dwarf = layout.NewData(data, symbols)
+	})
+	return d.dwarf, d.dwarfErr
+}
+
+// reader reads the file, from memory when it's mapped
+func (d *elfData) reader() io.ReaderAt {
+	return d.r
+}
+
+func (d *elfData) close() error {
+	if d.mapped != nil {
+		munmap(d.mapped)
+		d.mapped = nil
+	}
+	if d.closer == nil {
+		return nil
+	}
+	return d.closer.Close()
+}
+
+// targetFiles is a target's executable, and the debug file giving its symbols
+// and DWARF data when it's stripped, opened once for all the helpers.
+// Target holds it by pointer so the copies of a Target passed to helpers
+// share it.
+type targetFiles struct {
+	exe   *elfData
+	debug *elfData
+
+	infoOnce sync.Once
+	info     *buildinfo.BuildInfo
+	infoErr  error
+
+	// returnOffsets has the offsets found by SymbolReturns
+	returnsMu     sync.Mutex
+	returnOffsets map[string][]int
+
+	// cache keeps what's found between runs; see cache.go
+	cache *resolveCache
+}
+
+func openTargetFiles(path string, opts options) (*targetFiles, error) {
+	exe, err := openELF(path)
+	if err != nil {
+		return nil, err
+	}
+	return newTargetFiles(exe, path, opts), nil
+}
+
+func newTargetFiles(exe *elfData, path string, opts options) *targetFiles {
+	return &targetFiles{
+		exe:           exe,
+		returnOffsets: map[string][]int{},
+		cache:         openCache(opts.cacheDir, path, exe.elf, opts.verbose),
+	}
+}
+
+// symbolData is the file to read symbols and DWARF data from
+func (b *targetFiles) symbolData() *elfData {
+	if b.debug != nil {
+		return b.debug
+	}
+	return b.exe
+}
+
+func (b *targetFiles) buildInfo() (*buildinfo.BuildInfo, error) {
+	b.infoOnce.Do(func() {
+		b.info, b.infoErr = buildinfo.Read(b.exe.reader())
+	})
+	return b.info, b.infoErr
+}
+
+func (b *targetFiles) returns(symbol string) ([]int, bool) {
+	b.returnsMu.Lock()
+	defer b.returnsMu.Unlock()
+	offsets, ok := b.returnOffsets[symbol]
+	if !ok {
+		if offsets, ok = b.cache.returns(symbol); ok {
+			b.returnOffsets[symbol] = offsets
+		}
+	}
+	return offsets, ok
+}
+
+func (b *targetFiles) setReturns(symbol string, offsets []int) {
+	b.returnsMu.Lock()
+	defer b.returnsMu.Unlock()
+	b.returnOffsets[symbol] = offsets
+	b.cache.setReturns(symbol, offsets)
+}
+
+// symbol looks up name in the symbols found by elfSymbols
+func (b *targetFiles) symbol(name string) (elf.Symbol, error) {
+	if s, ok := b.cache.symbol(name); ok {
+		return s, nil
+	}
+	s, err := b.symbolData().lookup(name)
+	if err == nil {
+		b.cache.setSymbol(s)
+	}
+	return s, err
+}
+
+// inlinedCallers returns the functions which function was inlined into
+// using the DWARF data, if there is any
+func (b *targetFiles) inlinedCallers(function string) ([]string, error) {
+	data, err := b.symbolData().dwarfData()
+	if err != nil {
+		return nil, err
+	}
+	return data.InlinedCallers(function)
+}
+
+// regsABI returns true if the executable passes arguments in registers
+func (b *targetFiles) regsABI() (bool, error) {
+	if regs, ok := b.cache.regsABI(); ok {
+		return regs, nil
+	}
+	symbols, err := b.exe.symbolTable()
+	if err != nil {
+		return false, err
+	}
+	regs, err := abi.RegsSymbols(b.exe.elf, symbols)
+	if err == nil {
+		b.cache.setRegsABI(regs)
+	}
+	return regs, err
+}
+
+// params returns the parameters, or results, of function from the DWARF
+// data
+func (b *targetFiles) params(function string, results bool) ([]layout.Param, error) {
+	if params, ok := b.cache.params(function, results); ok {
+		if params == nil {
+			return nil, layout.ErrFunctionNotFound
+		}
+		return params, nil
+	}
+	data, err := b.symbolData().dwarfData()
+	if err != nil {
+		return nil, err
+	}
+	var params []layout.Param
+	if results {
+		params, err = data.Results(function)
+	} else {
+		params, err = data.Params(function)
+	}
+	switch {
+	case err == nil:
+		b.cache.setParams(function, results, params)
+	case errors.Is(err, layout.ErrFunctionNotFound):
+		// functions such as those written in assembly are left out
+		b.cache.setParams(function, results, nil)
+	}
+	return params, err
+}
+
+func (b *targetFiles) close() error {
+	if err := b.cache.save(); err != nil {
+		log.Printf("couldn't save cache: %s", err)
+	}
+	err := b.exe.close()
+	if b.debug != nil {
+		if debugErr := b.debug.close(); err == nil {
+			err = debugErr
+		}
+	}
+	return err
+}
+
+// Close closes the target's files. Helpers can't be used afterwards.
+func (t *Target) Close() error {
+	return t.bin.close()
+}
@@ -0,0 +1,136 @@
+package gen
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/ret"
+)
+
+// symbolsData returns elfData with the symbols given rather than those of a
+// file
+func symbolsData(symbols []elf.Symbol) *elfData {
+	d := &elfData{}
+	d.symbolsOnce.Do(func() { d.symbols = symbols })
+	return d
+}
+
+func funcSymbol(name string, address, size uint64) elf.Symbol {
+	return elf.Symbol{Name: name, Value: address, Size: size, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)}
+}
+
+// manySymbols returns n functions of 16 bytes, each with a data symbol
+// after it, as a large Go executable's symbol table has
+func manySymbols(n int) []elf.Symbol {
+	symbols := make([]elf.Symbol, 0, 2*n)
+	for i := 0; i < n; i++ {
+		symbols = append(symbols,
+			funcSymbol(fmt.Sprintf("pkg%d.f%d", i%100, i), 0x401000+uint64(32*i), 16),
+			elf.Symbol{Name: fmt.Sprintf("pkg%d.v%d", i%100, i), Value: 0x900000 + uint64(8*i), Size: 8, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT)})
+	}
+	return symbols
+}
+
+func TestLookup(t *testing.T) {
+	d := symbolsData([]elf.Symbol{
+		funcSymbol("main.b", 0x2000, 0x10),
+		funcSymbol("main.a", 0x1000, 0x20),
+		// a duplicate name, as static functions of C code linked in can
+		// have
+		funcSymbol("main.a", 0x3000, 0x20),
+		{Name: "main.v", Value: 0x1010, Size: 8, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT)},
+	})
+	if d.byName != nil {
+		t.Fatal("the index was built before a lookup")
+	}
+	for name, want := range map[string]uint64{"main.a": 0x1000, "main.b": 0x2000, "main.v": 0x1010} {
+		s, err := d.lookup(name)
+		if err != nil || s.Value != want {
+			t.Errorf("lookup(%s) = 0x%x, %v, want 0x%x", name, s.Value, err, want)
+		}
+	}
+	if _, err := d.lookup("main.c"); !errors.Is(err, ret.ErrSymbolNotFound) {
+		t.Errorf("lookup(main.c) gave %v", err)
+	}
+	for address, want := range map[uint64]string{
+		0x1000: "main.a",
+		0x1010: "main.a",
+		0x101f: "main.a",
+		0x2008: "main.b",
+		0x3000: "main.a",
+		0x0fff: "",
+		0x1020: "",
+		0x2010: "",
+		0x4000: "",
+	} {
+		s, err := d.function(address)
+		if want == "" {
+			if !errors.Is(err, ret.ErrSymbolNotFound) {
+				t.Errorf("function(0x%x) = %s, %v, want none", address, s.Name, err)
+			}
+		} else if err != nil || s.Name != want {
+			t.Errorf("function(0x%x) = %s, %v, want %s", address, s.Name, err, want)
+		}
+	}
+}
+
+// BenchmarkLookup looks up 1,000 names among 200,000 symbols with the index
+// and by scanning the symbols as each lookup did before it, and 1,000
+// addresses with the index
+func BenchmarkLookup(b *testing.B) {
+	symbols := manySymbols(100000)
+	var names []string
+	var addresses []uint64
+	for i := 0; i < 1000; i++ {
+		s := symbols[i*len(symbols)/1000]
+		names = append(names, s.Name)
+		addresses = append(addresses, 0x401000+uint64(i*3200)+8)
+	}
+	b.Run("index", func(b *testing.B) {
+		d := symbolsData(symbols)
+		d.index()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, name := range names {
+				if _, err := d.lookup(name); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, name := range names {
+				found := false
+				for _, s := range symbols {
+					if s.Name == name {
+						found = true
+						break
+					}
+				}
+				if !found {
+					b.Fatalf("no %s", name)
+				}
+			}
+		}
+	})
+	b.Run("address", func(b *testing.B) {
+		d := symbolsData(symbols)
+		d.index()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, address := range addresses {
+				if _, err := d.function(address); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("building the index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			symbolsData(symbols).index()
+		}
+	})
+}
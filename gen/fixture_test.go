@@ -0,0 +1,94 @@
+package gen_test
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+)
+
+var (
+	fixtureOnce sync.Once
+	fixtureDir  string
+	fixturePath string
+	fixtureErr  error
+)
+
+func TestMain(m *testing.M) {
+	// the helpers log what they find about targets, which would bury the
+	// test output
+	log.SetOutput(io.Discard)
+	code := m.Run()
+	if fixtureDir != "" {
+		os.RemoveAll(fixtureDir)
+	}
+	for _, dir := range toolchainDirs {
+		os.RemoveAll(dir)
+	}
+	os.Exit(code)
+}
+
+// fixture returns the selftest's fixture, built once for all the tests
+// needing a real Go program with DWARF data. Tests are skipped if there's
+// no go command to build it with.
+func fixture(t testing.TB) string {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go command to build the fixture with")
+	}
+	fixtureOnce.Do(func() {
+		if fixtureDir, fixtureErr = os.MkdirTemp("", "go-bpf-gen-fixture"); fixtureErr != nil {
+			return
+		}
+		fixturePath, fixtureErr = gen.BuildSelfTestFixture(fixtureDir)
+	})
+	if fixtureErr != nil {
+		t.Fatal(fixtureErr)
+	}
+	return fixturePath
+}
+
+// newFixtureTarget returns a Target for the fixture made with opts, closed
+// when the test ends
+func newFixtureTarget(t testing.TB, opts ...gen.Option) *gen.Target {
+	t.Helper()
+	target, err := gen.NewTarget(fixture(t), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.Close() })
+	return target
+}
+
+// startFixture starts a fixture which runs until its standard input is
+// closed, as it is when the test ends, and returns the first line it
+// writes, which it writes once it's ready
+func startFixture(t testing.TB, cmd *exec.Cmd) string {
+	t.Helper()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stdin.Close()
+		cmd.Wait()
+	})
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("%s never got ready: %v", cmd.Path, err)
+	}
+	return strings.TrimSpace(line)
+}
@@ -0,0 +1,243 @@
+package gen
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// servicePrefixes names each target after the base name of its executable
+// with _2, _3 and so on added when names collide
+func servicePrefixes(targets []*Target) []string {
+	prefixes := make([]string, len(targets))
+	used := map[string]bool{}
+	for i, t := range targets {
+		base := t.ShortName(filepath.Base(t.ExePath))
+		prefix := base
+		for n := 2; used[prefix]; n++ {
+			prefix = fmt.Sprintf("%s_%d", base, n)
+		}
+		used[prefix] = true
+		prefixes[i] = prefix
+	}
+	return prefixes
+}
+
+// block is a top level part of a bpftrace script: a probe or struct
+// definition and the comments before it
+type block struct {
+	leading string
+	header  string
+	body    string
+}
+
+// kind is BEGIN, END, struct or probe
+func (b block) kind() string {
+	header := strings.TrimSpace(b.header)
+	switch {
+	case header == "BEGIN" || header == "END":
+		return header
+	case strings.HasPrefix(header, "struct "):
+		return "struct"
+	}
+	return "probe"
+}
+
+// scanScript calls f for each byte of script outside comments and string
+// literals with its index. f returns false to stop.
+func scanScript(script string, f func(i int) bool) {
+	for i := 0; i < len(script); i++ {
+		switch {
+		case strings.HasPrefix(script[i:], "//"):
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				return
+			}
+			i += end + 3
+		case script[i] == '"':
+			for i++; i < len(script) && script[i] != '"'; i++ {
+				if script[i] == '\\' {
+					i++
+				}
+			}
+		default:
+			if !f(i) {
+				return
+			}
+		}
+	}
+}
+
+// splitBlocks splits a rendered bpftrace script into its top level blocks.
+// Text after the last block is returned too.
+func splitBlocks(script string) ([]block, string, error) {
+	var blocks []block
+	depth, start, open := 0, 0, 0
+	var err error
+	scanScript(script, func(i int) bool {
+		switch script[i] {
+		case '{':
+			if depth == 0 {
+				open = i
+			}
+			depth++
+		case '}':
+			depth--
+			if depth < 0 {
+				err = fmt.Errorf("unbalanced } at byte %d", i)
+				return false
+			}
+			if depth == 0 {
+				end := i + 1
+				// struct definitions end with };
+				if rest := strings.TrimLeft(script[end:], " \t"); strings.HasPrefix(rest, ";") {
+					end = len(script) - len(rest) + 1
+				}
+				leading, header := splitHeader(script[start:open])
+				blocks = append(blocks, block{leading: leading, header: header, body: script[open:end]})
+				start = end
+			}
+		}
+		return true
+	})
+	if err == nil && depth != 0 {
+		err = fmt.Errorf("unbalanced { in script")
+	}
+	return blocks, script[start:], err
+}
+
+// splitHeader splits the text before a block into the comments and blank
+// lines leading up to it and the header itself
+func splitHeader(text string) (string, string) {
+	lines := strings.SplitAfter(text, "\n")
+	i := 0
+	for ; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line != "" && !strings.HasPrefix(line, "//") {
+			break
+		}
+	}
+	return strings.Join(lines[:i], ""), strings.Join(lines[i:], "")
+}
+
+// prefixMaps renames the maps in script from @name to @prefix_name and the
+// anonymous map @ to @prefix
+func prefixMaps(script, prefix string) string {
+	var b strings.Builder
+	last := 0
+	scanScript(script, func(i int) bool {
+		if script[i] != '@' {
+			return true
+		}
+		b.WriteString(script[last : i+1])
+		b.WriteString(prefix)
+		if i+1 < len(script) && isIdentByte(script[i+1]) {
+			b.WriteString("_")
+		}
+		last = i + 1
+		return true
+	})
+	b.WriteString(script[last:])
+	return b.String()
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// attachPoint matches the start of a bpftrace attach point in a probe header
+// with its string literals removed
+var attachPoint = regexp.MustCompile(`(?:^|[\s,])(?:uprobe|uretprobe|kprobe|kretprobe|tracepoint|rawtracepoint|usdt|interval|profile|software|hardware|watchpoint|kfunc|kretfunc|fentry|fexit):`)
+
+var stringLiteral = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+
+// mergeFleet combines the scripts rendered for each target of a fleet into
+// one script. Maps are prefixed with each target's ServicePrefix, which
+// mustn't make two targets' maps the same, the bodies of BEGIN and END
+// probes are merged into one BEGIN and one END and identical struct
+// definitions are only given once.
+func mergeFleet(targets []*Target, scripts []string) (string, error) {
+	var top, structs, begin, end, probes strings.Builder
+	structDefs := map[string]string{}
+	seenBegin, seenEnd := map[string]bool{}, map[string]bool{}
+	prefixed := make([]string, len(targets))
+	names := make([]string, len(targets))
+	for i, t := range targets {
+		prefixed[i], names[i] = prefixMaps(scripts[i], t.ServicePrefix), t.ServicePrefix
+	}
+	if err := checkMapCollisions(names, prefixed); err != nil {
+		return "", err
+	}
+	for i, t := range targets {
+		blocks, trailing, err := splitBlocks(prefixed[i])
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", t.ServicePrefix, err)
+		}
+		fmt.Fprintf(&probes, "\n// %s: %s\n", t.ServicePrefix, t.ExePath)
+		for j, b := range blocks {
+			if i == 0 && j == 0 {
+				// the template's description
+				top.WriteString(strings.TrimRight(b.leading, "\n") + "\n")
+			}
+			switch b.kind() {
+			case "BEGIN":
+				mergeBody(&begin, seenBegin, b.body)
+			case "END":
+				mergeBody(&end, seenEnd, b.body)
+			case "struct":
+				name := strings.Fields(b.header)[1]
+				if def, ok := structDefs[name]; ok {
+					if def != b.body {
+						return "", fmt.Errorf("%s: struct %s is defined differently for %s", t.ServicePrefix, name, targets[0].ServicePrefix)
+					}
+					continue
+				}
+				structDefs[name] = b.body
+				fmt.Fprintf(&structs, "%s%s\n", b.header, b.body)
+			default:
+				if j > 0 || i > 0 {
+					probes.WriteString(b.leading)
+				}
+				probes.WriteString(b.header)
+				probes.WriteString(b.body)
+			}
+		}
+		probes.WriteString(trailing)
+	}
+	var script strings.Builder
+	script.WriteString(top.String())
+	script.WriteString(structs.String())
+	if begin.Len() > 0 {
+		fmt.Fprintf(&script, "BEGIN {\n%s}\n", begin.String())
+	}
+	script.WriteString(probes.String())
+	if end.Len() > 0 {
+		fmt.Fprintf(&script, "\nEND {\n%s}\n", end.String())
+	}
+	// the templates' whitespace adds up
+	return regexp.MustCompile(`\n{3,}`).ReplaceAllString(script.String(), "\n\n"), nil
+}
+
+// mergeBody adds the lines of a BEGIN or END body to b leaving out printf
+// statements already added, such as the "Hit CTRL+C" message of each target
+func mergeBody(b *strings.Builder, seen map[string]bool, body string) {
+	body = strings.TrimSuffix(strings.TrimPrefix(body, "{"), "}")
+	for _, line := range strings.Split(body, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "printf(") {
+			if seen[trimmed] {
+				continue
+			}
+			seen[trimmed] = true
+		}
+		b.WriteString(line + "\n")
+	}
+}
@@ -0,0 +1,419 @@
+package gen
+
+import (
+	"debug/elf"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Output formats. A template is written for one format and the helpers
+// giving probe points and argument expressions (Probe, ReturnProbes, Arg
+// and Ret) give them in its syntax.
+const (
+	// FormatBpftrace is a bpftrace script, the default
+	FormatBpftrace = "bpftrace"
+	// FormatBCC is a Python program using BCC with the BPF C in a string
+	FormatBCC = "bcc"
+	// FormatLibbpf is BPF C for compiling with clang and loading with
+	// libbpf, or the userspace C loading it
+	FormatLibbpf = "libbpf"
+	// FormatSystemTap is a SystemTap script
+	FormatSystemTap = "stap"
+	// FormatUprobeEvents is probe definitions for tracefs's uprobe_events
+	// file, usually in a shell script writing them
+	FormatUprobeEvents = "uprobe_events"
+	// FormatPerf is perf probe commands, usually in a shell script
+	FormatPerf = "perf"
+	// FormatJSON is the probe plan in plan.go rather than a rendered
+	// template
+	FormatJSON = "json"
+)
+
+var formats = []string{FormatBpftrace, FormatBCC, FormatLibbpf, FormatSystemTap, FormatUprobeEvents, FormatPerf, FormatJSON}
+
+func validFormat(format string) bool {
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatFor picks the output format of a template from its file name:
+// .py.tmpl is BCC, .c.tmpl libbpf, .stp SystemTap, .events.tmpl
+// uprobe_events, .perf.tmpl perf and anything else bpftrace
+func FormatFor(scriptFile string) string {
+	switch {
+	case strings.HasSuffix(scriptFile, ".py.tmpl"):
+		return FormatBCC
+	case strings.HasSuffix(scriptFile, ".c.tmpl"):
+		return FormatLibbpf
+	case strings.HasSuffix(scriptFile, ".stp"):
+		return FormatSystemTap
+	case strings.HasSuffix(scriptFile, ".events.tmpl"):
+		return FormatUprobeEvents
+	case strings.HasSuffix(scriptFile, ".perf.tmpl"):
+		return FormatPerf
+	}
+	return FormatBpftrace
+}
+
+// bpftraceOnly matches bpftrace constructs which mean a template isn't
+// written for SystemTap. Templates are checked before rendering so the
+// error can give the line of the template.
+var bpftraceOnly = regexp.MustCompile(`\b(uprobe|uretprobe|tracepoint|interval|kprobe):|\breg\("|\bsarg[0-9]|\b(hist|lhist|ustack|kstack)\(|^\s*(BEGIN|END)\b`)
+
+// checkTemplate returns an error naming the first line of the template
+// source which uses constructs the format doesn't have
+func checkTemplate(format, name, source string) error {
+	if format != FormatSystemTap {
+		return nil
+	}
+	for i, line := range strings.Split(source, "\n") {
+		if m := bpftraceOnly.FindString(line); m != "" {
+			return fmt.Errorf("%s:%d: %s is bpftrace syntax which SystemTap doesn't have: %s", name, i+1, strings.TrimSpace(m), strings.TrimSpace(line))
+		}
+	}
+	return nil
+}
+
+// cRegs gives the BPF C expressions for the registers of the Go register
+// ABI, using the PT_REGS macros where a register has one. Those without
+// need the kernel's struct pt_regs which BCC and vmlinux.h give.
+var cRegs = map[string]string{
+	"ax":  "PT_REGS_RC(ctx)",
+	"bx":  "ctx->bx",
+	"cx":  "PT_REGS_PARM4(ctx)",
+	"di":  "PT_REGS_PARM1(ctx)",
+	"si":  "PT_REGS_PARM2(ctx)",
+	"r8":  "PT_REGS_PARM5(ctx)",
+	"r9":  "PT_REGS_PARM6(ctx)",
+	"r10": "ctx->r10",
+	"r11": "ctx->r11",
+	"sp":  "PT_REGS_SP(ctx)",
+}
+
+// register gives an expression reading the register reg, as bpftrace names
+// it, in the target's format
+func (t Target) register(reg string) (string, error) {
+	if _, ok := goArches[t.GoArch()]; ok && t.GoArch() != "amd64" {
+		return t.archRegister(reg)
+	}
+	switch t.Format {
+	case FormatBCC, FormatLibbpf:
+		c, ok := cRegs[reg]
+		if !ok {
+			return "", fmt.Errorf("no register %s on amd64", reg)
+		}
+		return c, nil
+	case FormatSystemTap:
+		// SystemTap uses the full names e.g. rax
+		if strings.HasPrefix(reg, "r") {
+			return fmt.Sprintf("register(\"%s\")", reg), nil
+		}
+		return fmt.Sprintf("register(\"r%s\")", reg), nil
+	case FormatUprobeEvents, FormatPerf, FormatJSON:
+		return "%" + reg, nil
+	default:
+		return fmt.Sprintf("reg(\"%s\")", reg), nil
+	}
+}
+
+// stackWord gives an expression reading the 8 byte word i words above the
+// stack pointer
+func (t Target) stackWord(i int) (string, error) {
+	sp, err := t.register(t.arch().sp)
+	if err != nil {
+		return "", err
+	}
+	switch t.Format {
+	case FormatBCC, FormatLibbpf:
+		// C has no expression reading user memory so this is a GNU
+		// statement expression
+		return fmt.Sprintf("({ u64 _v = 0; bpf_probe_read_user(&_v, sizeof(_v), (void *)(%s + %d)); _v; })", sp, 8*i), nil
+	case FormatSystemTap:
+		return fmt.Sprintf("user_uint64(%s + %d)", sp, 8*i), nil
+	case FormatUprobeEvents, FormatPerf, FormatJSON:
+		return fmt.Sprintf("+%d(%s):u64", 8*i, sp), nil
+	default:
+		return fmt.Sprintf("*(%s + %d)", sp, 8*i), nil
+	}
+}
+
+// stackBytes gives an expression reading the value of size bytes, 1, 2 or 4,
+// at offset bytes above the stack pointer, for parameters which share a
+// stack word
+func (t Target) stackBytes(offset, size int) (string, error) {
+	sp, err := t.register(t.arch().sp)
+	if err != nil {
+		return "", err
+	}
+	bits := 8 * size
+	switch t.Format {
+	case FormatBCC, FormatLibbpf:
+		return fmt.Sprintf("({ u%d _v = 0; bpf_probe_read_user(&_v, sizeof(_v), (void *)(%s + %d)); _v; })", bits, sp, offset), nil
+	case FormatSystemTap:
+		return fmt.Sprintf("user_uint%d(%s + %d)", bits, sp, offset), nil
+	case FormatUprobeEvents, FormatPerf, FormatJSON:
+		return fmt.Sprintf("+%d(%s):u%d", offset, sp, bits), nil
+	default:
+		return fmt.Sprintf("*(uint%d *)(%s + %d)", bits, sp, offset), nil
+	}
+}
+
+// Probe gives the probe point, or the statement attaching the function fn
+// to it, for the entry of symbol in the target's format. fn is the name of
+// the BPF function for formats which have one and is otherwise ignored.
+// For libbpf a program with a SEC annotation calling fn, which the template
+// defines as a static inline function, is given.
+func (t Target) Probe(symbol, fn string) (string, error) {
+	switch t.Format {
+	case FormatBCC:
+		if t.probedByAddress(symbol) {
+			address, err := t.SymbolAddress(symbol)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("b.attach_uprobe(name=%q, addr=0x%x, fn_name=%q)", t.ExePath, address, fn), nil
+		}
+		return fmt.Sprintf("b.attach_uprobe(name=%q, sym=%q, fn_name=%q)", t.ExePath, symbol, fn), nil
+	case FormatLibbpf:
+		address, err := t.SymbolAddress(symbol)
+		if err != nil {
+			return "", err
+		}
+		return t.libbpfProgram(fmt.Sprintf("%s_uprobe", fn), fn, symbol, address)
+	case FormatSystemTap:
+		if strings.ContainsAny(symbol, "*?[") || t.probedByAddress(symbol) {
+			// function() takes wildcards so the likes of (*T) are
+			// probed by address, as is code given by address and the
+			// functions of stripped targets
+			address, err := t.SymbolAddress(symbol)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("process(\"%s\").statement(0x%x).absolute", t.ExePath, address), nil
+		}
+		return fmt.Sprintf("process(\"%s\").function(\"%s\")", t.ExePath, symbol), nil
+	case FormatUprobeEvents:
+		address, err := t.SymbolAddress(symbol)
+		if err != nil {
+			return "", err
+		}
+		return t.uprobeEvent(fn, symbol, address)
+	case FormatPerf:
+		return t.perfProbe(fn, symbol, 0)
+	default:
+		return fmt.Sprintf("uprobe:%s:\"%s\"", t.ExePath, symbol), nil
+	}
+}
+
+// ReturnProbes is like Probe for the return offsets of symbol. bpftrace
+// and SystemTap probe points are joined with commas, BCC statements,
+// uprobe_events definitions and perf commands are one per line and there's
+// a libbpf program for each offset.
+func (t Target) ReturnProbes(symbol, fn string) (string, error) {
+	offsets, err := t.SymbolReturns(symbol)
+	if err != nil {
+		return "", err
+	}
+	probes := make([]string, len(offsets))
+	switch t.Format {
+	case FormatBCC, FormatLibbpf:
+		address, err := t.SymbolAddress(symbol)
+		if err != nil {
+			return "", err
+		}
+		for i, offset := range offsets {
+			if t.Format == FormatBCC {
+				probes[i] = fmt.Sprintf("b.attach_uprobe(name=%q, addr=0x%x, fn_name=%q)", t.ExePath, address+uint64(offset), fn)
+				continue
+			}
+			probes[i], err = t.libbpfProgram(fmt.Sprintf("%s_uprobe%d", fn, i), fn, fmt.Sprintf("%s+%d", symbol, offset), address+uint64(offset))
+			if err != nil {
+				return "", err
+			}
+		}
+		if t.Format == FormatLibbpf {
+			return strings.Join(probes, "\n\n"), nil
+		}
+		return strings.Join(probes, "\n"), nil
+	case FormatSystemTap:
+		address, err := t.SymbolAddress(symbol)
+		if err != nil {
+			return "", err
+		}
+		for i, offset := range offsets {
+			probes[i] = fmt.Sprintf("process(\"%s\").statement(0x%x).absolute", t.ExePath, address+uint64(offset))
+		}
+		return strings.Join(probes, ",\n"), nil
+	case FormatUprobeEvents:
+		address, err := t.SymbolAddress(symbol)
+		if err != nil {
+			return "", err
+		}
+		if fn == "" {
+			fn = t.ShortName(symbol)
+		}
+		for i, offset := range offsets {
+			probes[i], err = t.uprobeEvent(fmt.Sprintf("%s_return%d", fn, i), symbol, address+uint64(offset))
+			if err != nil {
+				return "", err
+			}
+		}
+		return strings.Join(probes, "\n"), nil
+	case FormatPerf:
+		if fn == "" {
+			fn = t.ShortName(symbol)
+		}
+		for i, offset := range offsets {
+			probes[i], err = t.perfProbe(fmt.Sprintf("%s_return%d", fn, i), symbol, offset)
+			if err != nil {
+				return "", err
+			}
+		}
+		return strings.Join(probes, "\n"), nil
+	default:
+		for i, offset := range offsets {
+			probes[i] = fmt.Sprintf("uprobe:%s:\"%s\" + %d", t.ExePath, symbol, offset)
+		}
+		return strings.Join(probes, ",\n"), nil
+	}
+}
+
+// libbpfProgram gives a program called name calling fn attached to the
+// code at address. libbpf takes the file offset of the code in the section
+// name which saves it looking up symbols.
+func (t Target) libbpfProgram(name, fn, comment string, address uint64) (string, error) {
+	offset, err := t.fileOffset(address)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("// %s\nSEC(\"uprobe/%s:0x%x\")\nint %s(struct pt_regs *ctx)\n{\n    return %s(ctx);\n}", comment, t.ExePath, offset, name, fn), nil
+}
+
+// uprobeEvent gives a uprobe_events definition of the event name in the
+// group given by group=<name> (default gobpf) for the code at address.
+// Without a name the event is named after symbol. Fetch arguments can be
+// appended to it.
+func (t Target) uprobeEvent(name, symbol string, address uint64) (string, error) {
+	offset, err := t.fileOffset(address)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		name = t.ShortName(symbol)
+	}
+	return fmt.Sprintf("p:%s/%s %s:0x%x", t.Param("group", "gobpf"), name, t.ExePath, offset), nil
+}
+
+// perfSymbol matches symbols perf probe can take as they are. Others such
+// as os.(*File).Write are probed by address.
+var perfSymbol = regexp.MustCompile(`^[A-Za-z0-9_./]+$`)
+
+// perfProbe gives a perf probe command adding the event name in the group
+// given by group=<name> (default gobpf) at offset bytes into symbol. The
+// offset is checked against the size of the symbol as perf would probe
+// whatever follows it. perf joins the words following the options into one
+// probe definition so fetch arguments can be appended e.g. 'arg0=%ax'.
+func (t Target) perfProbe(name, symbol string, offset int) (string, error) {
+	size, err := t.SymbolSize(symbol)
+	if err != nil {
+		return "", err
+	}
+	if offset < 0 || uint64(offset) >= size {
+		return "", fmt.Errorf("offset %d is outside %s which is %d bytes", offset, symbol, size)
+	}
+	if name == "" {
+		name = t.ShortName(symbol)
+	}
+	point := symbol
+	if !perfSymbol.MatchString(symbol) || t.probedByAddress(symbol) {
+		address, err := t.SymbolAddress(symbol)
+		if err != nil {
+			return "", err
+		}
+		point = fmt.Sprintf("0x%x", address+uint64(offset))
+	} else if offset > 0 {
+		point = fmt.Sprintf("%s+%d", symbol, offset)
+	}
+	return fmt.Sprintf("perf probe -x %s '%s:%s=%s'", t.ExePath, t.Param("group", "gobpf"), name, point), nil
+}
+
+// fileOffset converts a virtual address in the target to an offset in its
+// file using the loadable segments
+func (t Target) fileOffset(address uint64) (uint64, error) {
+	for _, p := range t.bin.exe.elf.Progs {
+		if p.Type == elf.PT_LOAD && address >= p.Vaddr && address < p.Vaddr+p.Filesz {
+			return address - p.Vaddr + p.Off, nil
+		}
+	}
+	return 0, fmt.Errorf("address 0x%x isn't in a loadable segment", address)
+}
+
+// cTypes gives the printf conversions for the types allowed in events
+var cTypes = map[string]string{
+	"u8":  "%u",
+	"u16": "%u",
+	"u32": "%u",
+	"u64": "%llu",
+	"s32": "%d",
+	"s64": "%lld",
+}
+
+type eventField struct {
+	typ, name string
+}
+
+// parseFields parses a comma separated list of C fields e.g.
+// "u32 pid,u64 latency_ns"
+func parseFields(fields string) ([]eventField, error) {
+	parsed := []eventField{}
+	for _, field := range strings.Split(fields, ",") {
+		f := strings.Fields(field)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("malformed field %q, must be of form \"type name\"", field)
+		}
+		if _, ok := cTypes[f[0]]; !ok {
+			return nil, fmt.Errorf("field %s has unsupported type %s", f[1], f[0])
+		}
+		parsed = append(parsed, eventField{typ: f[0], name: f[1]})
+	}
+	return parsed, nil
+}
+
+// EventStruct gives the C definition of a struct called name with fields,
+// a comma separated list of types and names e.g. "u32 pid,u64 latency_ns".
+// BPF programs sending events and the userspace reading them both use it
+// so they agree on the layout.
+func (t Target) EventStruct(name, fields string) (string, error) {
+	parsed, err := parseFields(fields)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "struct %s {\n", name)
+	for _, f := range parsed {
+		fmt.Fprintf(&b, "    %s %s;\n", f.typ, f.name)
+	}
+	b.WriteString("};")
+	return b.String(), nil
+}
+
+// EventPrintf gives a C printf call printing the fields, as given to
+// EventStruct, of the struct pointed to by the expression ptr
+func (t Target) EventPrintf(ptr, fields string) (string, error) {
+	parsed, err := parseFields(fields)
+	if err != nil {
+		return "", err
+	}
+	conversions := make([]string, len(parsed))
+	args := make([]string, len(parsed))
+	for i, f := range parsed {
+		conversions[i] = fmt.Sprintf("%s=%s", f.name, cTypes[f.typ])
+		args[i] = fmt.Sprintf("%s->%s", ptr, f.name)
+	}
+	return fmt.Sprintf("printf(\"%s\\n\", %s);", strings.Join(conversions, " "), strings.Join(args, ", ")), nil
+}
@@ -0,0 +1,346 @@
+package gen_test
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+	"github.com/stevenjohnstone/go-bpf-gen/testtarget"
+)
+
+// formatTargets are the targets the output formats are checked with: the
+// fixture and made up executables passing arguments in registers and on
+// the stack
+func formatTargets(t *testing.T, format string) map[string]*gen.Target {
+	t.Helper()
+	targets := map[string]*gen.Target{"fixture": newFixtureTarget(t, gen.WithFormat(format))}
+	for name, b := range map[string]testtarget.Binary{
+		"registers": {Functions: []testtarget.Function{{Name: "main.handle", Returns: []int{40, 96}}, {Name: "runtime.execute", Returns: []int{64}}}},
+		"stack":     {StackABI: true, Functions: []testtarget.Function{{Name: "main.handle", Returns: []int{40, 96}}, {Name: "runtime.execute", Returns: []int{64}}}},
+	} {
+		target, err := testtarget.New("/srv/server", b, gen.WithFormat(format))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { target.Close() })
+		targets[name] = target
+	}
+	return targets
+}
+
+// TestBCCSyntax checks the BCC programs are Python, when there's python3
+// to parse them with
+func TestBCCSyntax(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("no python3 to check the BCC programs with")
+	}
+	for name, target := range formatTargets(t, gen.FormatBCC) {
+		for _, template := range []string{"latency.py.tmpl", "skeleton.py.tmpl"} {
+			t.Run(name+"/"+template, func(t *testing.T) {
+				script, err := gen.GenerateString(template, target, map[string][]string{"symbol": {"main.handle"}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				path := filepath.Join(t.TempDir(), "script.py")
+				if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+					t.Fatal(err)
+				}
+				// ast.parse checks the syntax without importing bcc
+				cmd := exec.Command(python, "-c", "import ast, sys; ast.parse(open(sys.argv[1]).read(), sys.argv[1])", path)
+				if out, err := cmd.CombinedOutput(); err != nil {
+					t.Errorf("%s: %s\n%s", err, out, script)
+				}
+			})
+		}
+	}
+}
+
+// TestLibbpf compares the libbpf program and loader for a made up target
+// with their goldens and compiles the programs for each target, when
+// there's clang and libbpf's headers to compile them with. The kernel's
+// types are from testdata/libbpf/vmlinux.h.
+func TestLibbpf(t *testing.T) {
+	targets := formatTargets(t, gen.FormatLibbpf)
+	args := map[string][]string{"symbol": {"main.handle"}}
+	for _, test := range []struct{ template, golden string }{
+		{"latency.bpf.c.tmpl", "latency.bpf.c"},
+		{"latency.c.tmpl", "latency.c"},
+	} {
+		script, err := gen.GenerateString(test.template, targets["registers"], args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, filepath.Join("made-up", test.golden), script)
+	}
+
+	clang, err := exec.LookPath("clang")
+	if err != nil {
+		t.Skip("no clang to compile the libbpf programs with")
+	}
+	include, err := filepath.Abs(filepath.Join("testdata", "libbpf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range targets {
+		t.Run(name, func(t *testing.T) {
+			program, err := gen.GenerateString("latency.bpf.c.tmpl", target, args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir := t.TempDir()
+			source := filepath.Join(dir, "latency.bpf.c")
+			if err := os.WriteFile(source, []byte(program), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command(clang, "-O2", "-g", "-target", "bpf", "-D__TARGET_ARCH_x86", "-I", include, "-c", source, "-o", filepath.Join(dir, "latency.bpf.o"))
+			out, err := cmd.CombinedOutput()
+			if bytes.Contains(out, []byte("bpf/bpf_helpers.h' file not found")) {
+				t.Skip("no libbpf headers to compile the libbpf programs with")
+			}
+			if err != nil {
+				t.Errorf("%s: %s\n%s", err, out, program)
+			}
+		})
+	}
+}
+
+// elfFunction is a function as the ELF file has it
+type elfFunction struct {
+	offset, size uint64
+	data         []byte
+}
+
+// elfFunctions reads the functions of the executable at path from its
+// symbol table, or the dynamic symbol table of a stripped shared object,
+// with their file offsets found from its program headers
+func elfFunctions(t *testing.T, path string, names ...string) map[string]elfFunction {
+	t.Helper()
+	f, err := elf.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	symbols, err := f.Symbols()
+	if errors.Is(err, elf.ErrNoSymbols) && f.Type == elf.ET_DYN {
+		symbols, err = f.DynamicSymbols()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	functions := map[string]elfFunction{}
+	for _, s := range symbols {
+		for _, name := range names {
+			if s.Name != name {
+				continue
+			}
+			for _, p := range f.Progs {
+				if p.Type == elf.PT_LOAD && p.Flags&elf.PF_X != 0 && s.Value >= p.Vaddr && s.Value+s.Size <= p.Vaddr+p.Filesz {
+					data := make([]byte, s.Size)
+					if _, err := p.ReadAt(data, int64(s.Value-p.Vaddr)); err != nil {
+						t.Fatal(err)
+					}
+					functions[name] = elfFunction{offset: s.Value - p.Vaddr + p.Off, size: s.Size, data: data}
+				}
+			}
+		}
+	}
+	for _, name := range names {
+		if _, ok := functions[name]; !ok {
+			t.Fatalf("no function %s in %s", name, path)
+		}
+	}
+	return functions
+}
+
+var uprobeEvent = regexp.MustCompile(`^p:gobpf/([A-Za-z_0-9]+) (\S+):0x([0-9a-f]+)((?: arg[0-9]+=\S+)*)$`)
+
+// TestUprobeEvents parses the uprobe_events definitions for the fixture back
+// and checks their file offsets are those of the functions and return
+// instructions in the ELF file
+func TestUprobeEvents(t *testing.T) {
+	exe := fixture(t)
+	target := newFixtureTarget(t, gen.WithFormat(gen.FormatUprobeEvents))
+	symbols := []string{"main.handle", "runtime.mallocgc"}
+	script, err := gen.GenerateString("probes.events.tmpl", target, map[string][]string{"symbol": symbols, "args": {"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	functions := elfFunctions(t, exe, symbols...)
+	events := map[string]uint64{}
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(line, "p:") {
+			continue
+		}
+		m := uprobeEvent.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("malformed event %q", line)
+			continue
+		}
+		if m[2] != exe {
+			t.Errorf("%s: the path is %s, want %s", m[1], m[2], exe)
+		}
+		offset, err := strconv.ParseUint(m[3], 16, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events[m[1]] = offset
+		if !strings.Contains(m[1], "_return") && m[4] != " arg0=%ax arg1=%bx" {
+			t.Errorf("%s: the arguments are%s, want arg0=%%ax arg1=%%bx", m[1], m[4])
+		}
+	}
+	for i, symbol := range symbols {
+		f := functions[symbol]
+		name := fmt.Sprintf("%s_%d", strings.ReplaceAll(symbol, ".", "_"), i)
+		if offset, ok := events[name]; !ok || offset != f.offset {
+			t.Errorf("%s is at 0x%x, want 0x%x", name, offset, f.offset)
+		}
+		returns, err := target.SymbolReturns(symbol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(returns) == 0 {
+			t.Fatalf("no returns found in %s", symbol)
+		}
+		for j, r := range returns {
+			offset, ok := events[fmt.Sprintf("%s_return%d", name, j)]
+			if !ok {
+				t.Errorf("no event for return %d of %s", j, symbol)
+				continue
+			}
+			// C3 is amd64's RET
+			if offset < f.offset || offset-f.offset != uint64(r) || f.data[offset-f.offset] != 0xc3 {
+				t.Errorf("return %d of %s is at 0x%x, not a RET at 0x%x + %d", j, symbol, offset, f.offset, r)
+			}
+		}
+		delete(events, name)
+		for j := range returns {
+			delete(events, fmt.Sprintf("%s_return%d", name, j))
+		}
+	}
+	if len(events) > 0 {
+		t.Errorf("unexpected events %v", events)
+	}
+}
+
+// TestUprobeEventsLines compares the uprobe_events definitions for made up
+// executables with ones known to be good. The executables' functions are
+// 32 byte aligned from file offset 0x1000.
+func TestUprobeEventsLines(t *testing.T) {
+	functions := []testtarget.Function{{Name: "main.main", Returns: []int{32}}, {Name: "main.handle", Returns: []int{40, 96}}}
+	tests := []struct {
+		name string
+		b    testtarget.Binary
+		want []string
+	}{
+		{"amd64 registers", testtarget.Binary{Functions: functions}, []string{
+			"p:gobpf/main_handle_0 /srv/server:0x1040 arg0=%ax arg1=%bx arg2=%cx",
+			"p:gobpf/main_handle_0_return0 /srv/server:0x1068",
+			"p:gobpf/main_handle_0_return1 /srv/server:0x10a0",
+		}},
+		{"amd64 stack", testtarget.Binary{StackABI: true, Functions: functions}, []string{
+			"p:gobpf/main_handle_0 /srv/server:0x1040 arg0=+8(%sp):u64 arg1=+16(%sp):u64 arg2=+24(%sp):u64",
+			"p:gobpf/main_handle_0_return0 /srv/server:0x1068",
+			"p:gobpf/main_handle_0_return1 /srv/server:0x10a0",
+		}},
+		{"s390x stack", testtarget.Binary{Arch: "s390x", StackABI: true, Functions: functions}, []string{
+			"p:gobpf/main_handle_0 /srv/server:0x1040 arg0=+8(%r15):u64 arg1=+16(%r15):u64 arg2=+24(%r15):u64",
+			"p:gobpf/main_handle_0_return0 /srv/server:0x1068",
+			"p:gobpf/main_handle_0_return1 /srv/server:0x10a0",
+		}},
+		{"ppc64 registers", testtarget.Binary{Arch: "ppc64", GoVersion: "go1.21.0", Functions: functions}, []string{
+			"p:gobpf/main_handle_0 /srv/server:0x1040 arg0=%gpr3 arg1=%gpr4 arg2=%gpr5",
+			"p:gobpf/main_handle_0_return0 /srv/server:0x1068",
+			"p:gobpf/main_handle_0_return1 /srv/server:0x10a0",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, err := testtarget.New("/srv/server", test.b, gen.WithFormat(gen.FormatUprobeEvents))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+			script, err := gen.GenerateString("probes.events.tmpl", target, map[string][]string{"symbol": {"main.handle"}, "args": {"3"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, line := range strings.Split(script, "\n") {
+				if strings.HasPrefix(line, "p:") {
+					got = append(got, line)
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+var perfProbe = regexp.MustCompile(`^perf probe -x (\S+) 'gobpf:([a-z_0-9]+)=([^+']+)(?:\+([0-9]+))?'((?: 'arg[0-9]+=[^']+')*)$`)
+
+// TestPerfProbes parses the perf probe commands for the fixture back and
+// checks the return probes are at RET instructions within the functions
+func TestPerfProbes(t *testing.T) {
+	exe := fixture(t)
+	target := newFixtureTarget(t, gen.WithFormat(gen.FormatPerf))
+	symbols := []string{"main.handle", "runtime.mallocgc"}
+	script, err := gen.GenerateString("probes.perf.tmpl", target, map[string][]string{"symbol": symbols, "args": {"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	functions := elfFunctions(t, exe, symbols...)
+	got := map[string][]int{}
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(line, "perf probe -x") {
+			continue
+		}
+		m := perfProbe.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("malformed probe %q", line)
+			continue
+		}
+		if m[1] != exe {
+			t.Errorf("%s: the path is %s, want %s", m[2], m[1], exe)
+		}
+		f, ok := functions[m[3]]
+		if !ok {
+			t.Errorf("%s: probes %s, which wasn't asked for", m[2], m[3])
+			continue
+		}
+		if m[4] == "" {
+			if m[5] != " 'arg0=%ax' 'arg1=%bx'" {
+				t.Errorf("%s: the arguments are%s, want 'arg0=%%ax' 'arg1=%%bx'", m[2], m[5])
+			}
+			continue
+		}
+		offset, err := strconv.Atoi(m[4])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// C3 is amd64's RET
+		if uint64(offset) >= f.size || f.data[offset] != 0xc3 {
+			t.Errorf("%s: %s+%d isn't a RET in the function's %d bytes", m[2], m[3], offset, f.size)
+		}
+		got[m[3]] = append(got[m[3]], offset)
+	}
+	for _, symbol := range symbols {
+		want, err := target.SymbolReturns(symbol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got[symbol]) != fmt.Sprint(want) {
+			t.Errorf("%s has return probes at %v, want %v", symbol, got[symbol], want)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package gen
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"github.com/stevenjohnstone/go-bpf-gen/templates"
+)
+
+// Option configures a Target made by NewTarget
+type Option func(*options)
+
+type options struct {
+	arguments map[string][]string
+	format    string
+	// formatGiven is false when the format is to be picked from the
+	// template's name
+	formatGiven bool
+	offline     bool
+	jobs        int
+	cacheDir    string
+	verbose     bool
+	offsets     bool
+	wrapper     bool
+	templates   []fs.FS
+	mapPrefix   string
+	// strictArguments makes unread arguments an error
+	strictArguments bool
+}
+
+// WithArguments gives the key=value arguments of the command line which
+// templates read with Param and Arguments. Targets such as container:<name>
+// read process= and library= from them too.
+func WithArguments(args map[string][]string) Option {
+	return func(o *options) {
+		o.arguments = args
+	}
+}
+
+// WithFormat gives the output format, one of the Format constants, rather
+// than it being picked from the template's name as FormatFor does
+func WithFormat(format string) Option {
+	return func(o *options) {
+		o.format = format
+		o.formatGiven = true
+	}
+}
+
+// WithOffline only uses debug files for stripped targets which are already
+// in the debuginfod cache
+func WithOffline() Option {
+	return func(o *options) {
+		o.offline = true
+	}
+}
+
+// WithJobs sets how many symbols are resolved at once. It's GOMAXPROCS by
+// default.
+func WithJobs(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.jobs = n
+		}
+	}
+}
+
+// WithCacheDir keeps what's found in the target in dir between runs, as the
+// command does in DefaultCacheDir. Nothing is cached by default.
+func WithCacheDir(dir string) Option {
+	return func(o *options) {
+		o.cacheDir = dir
+	}
+}
+
+// WithVerbose logs the symbols resolved before rendering and the cache's
+// hits and misses
+func WithVerbose() Option {
+	return func(o *options) {
+		o.verbose = true
+	}
+}
+
+// WithAddressProbes has Generate probe the target by address rather than
+// symbol name as -offsets does
+func WithAddressProbes() Option {
+	return func(o *options) {
+		o.offsets = true
+	}
+}
+
+// WithWrapper has Generate give a shell script checking the host and
+// running the bpftrace script as -wrapper does
+func WithWrapper() Option {
+	return func(o *options) {
+		o.wrapper = true
+	}
+}
+
+// WithTemplates has Generate look for templates in each of fsys in turn
+// before the bundled ones
+func WithTemplates(fsys ...fs.FS) Option {
+	return func(o *options) {
+		o.templates = append(o.templates, fsys...)
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{format: FormatBpftrace, jobs: runtime.GOMAXPROCS(0)}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// setArguments replaces the target's arguments
+func (t *Target) setArguments(args map[string][]string) {
+	t.args = newArguments(args)
+	t.Arguments = t.args.get
+}
+
+// prepare applies the arguments which change how the target is read, abi=
+// and symbol= values giving addresses, before a template is rendered for it
+func (t *Target) prepare() error {
+	if err := t.resolveAddresses(); err != nil {
+		return err
+	}
+	return t.applyABI()
+}
+
+// reportArguments logs the arguments of targets which tmpl didn't read or,
+// if the first target was made WithStrictArguments, fails
+func reportArguments(tmpl *template.Template, targets []*Target) error {
+	err := checkArguments(tmpl, targets)
+	if err == nil {
+		return nil
+	}
+	if targets[0].opts.strictArguments {
+		return err
+	}
+	log.Print(err)
+	return nil
+}
+
+// LoadTemplate reads the template called name from the pack registered by
+// RegisterTemplates that it's named after, the first of fsys which has it
+// or else from the bundled templates, where it may be given with or without
+// a templates/ prefix.
+func LoadTemplate(name string, fsys ...fs.FS) (string, error) {
+	if pack, inPack, ok := packFor(name); ok {
+		data, err := fs.ReadFile(pack, inPack)
+		if err != nil {
+			return "", fmt.Errorf("failed to open %s: %w", name, err)
+		}
+		return string(data), nil
+	}
+	var errs []string
+	for _, f := range fsys {
+		data, err := fs.ReadFile(f, name)
+		if err == nil {
+			return string(data), nil
+		}
+		errs = append(errs, err.Error())
+	}
+	data, err := fs.ReadFile(templates.FS, strings.TrimPrefix(name, "templates/"))
+	if err == nil {
+		return string(data), nil
+	}
+	if len(errs) == 0 {
+		return "", fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	return "", fmt.Errorf("failed to open %s (%s), tried embedded files got %w", name, strings.Join(errs, ", "), err)
+}
+
+// funcs are the functions templates can call besides the Target helpers
+var funcs = template.FuncMap{
+	"panic": func(s string) string { panic(s) },
+	"add":   func(a, b int) int { return a + b },
+	"mul":   func(a, b int) int { return a * b },
+	"until": func(n int) []int {
+		s := make([]int, n)
+		for i := range s {
+			s[i] = i
+		}
+		return s
+	},
+	"split":      strings.Split,
+	"trimPrefix": strings.TrimPrefix,
+}
+
+// parsedTemplate is a template with its source for the excerpts in errors
+type parsedTemplate struct {
+	*template.Template
+	source string
+}
+
+// parseTemplate loads and parses the template called name for the target's
+// format, which is picked from the name unless it was given
+func (t *Target) parseTemplate(name string) (*parsedTemplate, error) {
+	if !t.opts.formatGiven {
+		t.Format = FormatFor(name)
+	}
+	if !validFormat(t.Format) {
+		return nil, fmt.Errorf("unknown format %s", t.Format)
+	}
+	if t.Format == FormatJSON {
+		return nil, nil
+	}
+	if t.opts.offsets && t.Format != FormatBpftrace {
+		return nil, errors.New("-offsets is only supported for bpftrace output")
+	}
+	if t.opts.wrapper && t.Format != FormatBpftrace {
+		return nil, errors.New("-wrapper is only supported for bpftrace output")
+	}
+	source, err := LoadTemplate(name, t.opts.templates...)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTemplate(t.Format, name, source); err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(name).Funcs(funcs).Parse(source)
+	if err != nil {
+		return nil, templateError(source, err)
+	}
+	return &parsedTemplate{Template: tmpl, source: source}, nil
+}
+
+// render executes tmpl for the target, prefixing its maps and probing by
+// address if asked to
+func (t *Target) render(tmpl *parsedTemplate) (string, error) {
+	t.prefetch(t.planSymbols(tmpl.Template))
+	t.maps = ""
+	if t.ServicePrefix == "" {
+		prefix, err := t.mapPrefix(tmpl.Name())
+		if err != nil {
+			return "", err
+		}
+		t.maps = prefix
+	}
+	var script strings.Builder
+	if err := tmpl.Execute(&script, t); err != nil {
+		return "", templateError(tmpl.source, err)
+	}
+	rendered := script.String()
+	if t.maps != "" && t.Format == FormatBpftrace {
+		rendered = prefixMaps(rendered, t.maps)
+	}
+	if !t.opts.offsets && (len(t.addresses) == 0 && len(t.pclntabSymbols()) == 0 || t.Format != FormatBpftrace) {
+		return rendered, nil
+	}
+	s, err := t.offsetProbes(rendered, t.opts.offsets)
+	if err != nil {
+		return "", fmt.Errorf("failed to probe by address: %w", err)
+	}
+	return s, nil
+}
+
+// Generate writes the script given by the template called tmpl for target.
+// Templates are looked for as LoadTemplate does in the file systems given
+// by WithTemplates. args, if not nil, replaces the arguments given by
+// WithArguments. With FormatJSON the target's probe plan is written and no
+// template is needed.
+func Generate(w io.Writer, tmpl string, target *Target, args map[string][]string) error {
+	if args != nil {
+		target.setArguments(args)
+	}
+	parsed, err := target.parseTemplate(tmpl)
+	if err != nil {
+		return err
+	}
+	if err := target.prepare(); err != nil {
+		return err
+	}
+	if target.Format == FormatJSON {
+		var plan strings.Builder
+		if err := target.writePlan(&plan); err != nil {
+			return fmt.Errorf("failed to make probe plan: %w", err)
+		}
+		if err := reportArguments(nil, []*Target{target}); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, plan.String())
+		return err
+	}
+	script, err := target.render(parsed)
+	if err != nil {
+		return err
+	}
+	if target.Format == FormatBpftrace {
+		if err := checkBudgets([]*Target{target}, script); err != nil {
+			return err
+		}
+	}
+	if err := reportArguments(parsed.Template, []*Target{target}); err != nil {
+		return err
+	}
+	script = target.abiHeader(script)
+	if target.opts.wrapper {
+		return wrap(w, script, []*Target{target})
+	}
+	_, err = io.WriteString(w, script)
+	return err
+}
+
+// GenerateString is Generate returning the script rather than writing it
+func GenerateString(tmpl string, target *Target, args map[string][]string) (string, error) {
+	var script strings.Builder
+	if err := Generate(&script, tmpl, target, args); err != nil {
+		return "", err
+	}
+	return script.String(), nil
+}
+
+// wrap writes script in a wrapper script for targets, only once the whole
+// wrapper has been made
+func wrap(w io.Writer, script string, targets []*Target) error {
+	var wrapper strings.Builder
+	if err := writeWrapper(&wrapper, script, targets); err != nil {
+		return fmt.Errorf("failed to write wrapper: %w", err)
+	}
+	_, err := io.WriteString(w, wrapper.String())
+	return err
+}
+
+// GenerateFleet writes one bpftrace script probing all of targets with the
+// template called tmpl as -fleet does. The targets' options decide how it's
+// generated as for Generate but the format must be bpftrace and the first
+// target's options to probe by address or give a wrapper script apply to
+// all, as do its budget arguments.
+func GenerateFleet(w io.Writer, tmpl string, targets []*Target, args map[string][]string) error {
+	if len(targets) == 0 {
+		return errors.New("a fleet needs at least one target")
+	}
+	var scripts []string
+	var parsed *parsedTemplate
+	for i, prefix := range servicePrefixes(targets) {
+		t := targets[i]
+		t.opts.offsets, t.opts.wrapper = targets[0].opts.offsets, targets[0].opts.wrapper
+		if args != nil {
+			t.setArguments(args)
+		}
+		t.ServicePrefix = prefix
+		var err error
+		if parsed, err = t.parseTemplate(tmpl); err != nil {
+			return err
+		}
+		if err := t.prepare(); err != nil {
+			return fmt.Errorf("%s: %w", prefix, err)
+		}
+		if t.Format != FormatBpftrace {
+			return errors.New("-fleet is only supported for bpftrace output")
+		}
+		script, err := t.render(parsed)
+		if err != nil {
+			return fmt.Errorf("%s: %w", prefix, err)
+		}
+		scripts = append(scripts, script)
+	}
+	merged, err := mergeFleet(targets, scripts)
+	if err != nil {
+		return fmt.Errorf("failed to merge fleet scripts: %w", err)
+	}
+	if err := checkBudgets(targets, merged); err != nil {
+		return err
+	}
+	if err := reportArguments(parsed.Template, targets); err != nil {
+		return err
+	}
+	merged = fleetABIHeader(targets) + merged
+	if targets[0].opts.wrapper {
+		return wrap(w, merged, targets)
+	}
+	_, err = io.WriteString(w, merged)
+	return err
+}
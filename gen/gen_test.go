@@ -0,0 +1,205 @@
+package gen_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+)
+
+// TestGenerate uses the package as a library would: NewTarget and Generate
+// with bundled templates and those of a file system of the caller's
+func TestGenerate(t *testing.T) {
+	exe := fixture(t)
+	mine := fstest.MapFS{
+		"mine.bt":       {Data: []byte(`uprobe:{{ .ExePath }}:"{{ .Param "fn" "main.main" }}" { @[{{ .Arg 0 }}] = count(); }` + "\n")},
+		"broken.bt":     {Data: []byte("{{ .SymbolReturns \"main.nothing\" }}\n")},
+		"unparsable.bt": {Data: []byte("{{ if }}\n")},
+	}
+	tests := []struct {
+		name   string
+		tmpl   string
+		format string
+		args   map[string][]string
+		// want are substrings of the script, with %s for the executable's path
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "bundled bpftrace",
+			tmpl: "skeleton.bt",
+			args: map[string][]string{"symbol": {"main.handle"}},
+			want: []string{"// arguments are read with the register ABI (detected)", `uprobe:%s:"main.handle"`},
+		},
+		{
+			name:   "bundled bcc",
+			tmpl:   "latency.py.tmpl",
+			format: gen.FormatBCC,
+			args:   map[string][]string{"symbol": {"main.handle"}},
+			want:   []string{`b.attach_uprobe(name="%s", sym="main.handle", fn_name="entry_0")`},
+		},
+		{
+			name:   "bundled uprobe_events",
+			tmpl:   "probes.events.tmpl",
+			format: gen.FormatUprobeEvents,
+			args:   map[string][]string{"symbol": {"main.handle"}},
+			want:   []string{"# arguments are read with the register ABI (detected)", " %s:0x"},
+		},
+		{
+			name:   "plan",
+			format: gen.FormatJSON,
+			args:   map[string][]string{"symbol": {"main.handle"}},
+			want:   []string{`"executable": "%s"`, `"symbol": "main.handle"`},
+		},
+		{
+			name: "the caller's template",
+			tmpl: "mine.bt",
+			args: map[string][]string{"fn": {"main.handle"}},
+			want: []string{`uprobe:%s:"main.handle" { @[reg("ax")] = count(); }`},
+		},
+		{
+			name: "the caller's templates come first",
+			tmpl: "latency.bt",
+			want: []string{"// mine, not the bundled one"},
+		},
+		{
+			name: "bundled with a prefix",
+			tmpl: "templates/latency.bt",
+			args: map[string][]string{"symbol": {"main.handle"}},
+			want: []string{`uprobe:%s:"main.handle"`},
+		},
+		{
+			name:    "no such template",
+			tmpl:    "nothing.bt",
+			wantErr: "nothing.bt",
+		},
+		{
+			name:    "helper failure",
+			tmpl:    "broken.bt",
+			wantErr: "broken.bt:1:3: SymbolReturns failed",
+		},
+		{
+			name:    "parse failure",
+			tmpl:    "unparsable.bt",
+			wantErr: "unparsable.bt:1",
+		},
+		{
+			name:    "template panicking",
+			tmpl:    "slowest.bt",
+			wantErr: "slowest.bt needs at least one symbol",
+		},
+		{
+			name:    "function not in the target",
+			tmpl:    "latency.bt",
+			args:    map[string][]string{"symbol": {"main.nothing"}},
+			wantErr: "main.nothing",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := []gen.Option{gen.WithTemplates(mine)}
+			if test.format != "" {
+				opts = append(opts, gen.WithFormat(test.format))
+			}
+			if test.name == "the caller's templates come first" {
+				opts = []gen.Option{gen.WithTemplates(fstest.MapFS{"latency.bt": {Data: []byte("// mine, not the bundled one\n")}})}
+			}
+			target, err := gen.NewTarget(exe, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+			args := test.args
+			if args == nil {
+				args = map[string][]string{}
+			}
+			var script strings.Builder
+			err = gen.Generate(&script, test.tmpl, target, args)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want one with %q", err, test.wantErr)
+				}
+				if script.Len() > 0 {
+					t.Errorf("%d bytes were written for a failure", script.Len())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range test.want {
+				if strings.Contains(want, "%s") {
+					want = fmt.Sprintf(want, exe)
+				}
+				if !strings.Contains(script.String(), want) {
+					t.Errorf("no %q in\n%s", want, script.String())
+				}
+			}
+		})
+	}
+}
+
+// TestGenerateString checks GenerateString gives what Generate writes
+func TestGenerateString(t *testing.T) {
+	target := newFixtureTarget(t)
+	args := map[string][]string{"symbol": {"main.handle"}}
+	var script strings.Builder
+	if err := gen.Generate(&script, "latency.bt", target, args); err != nil {
+		t.Fatal(err)
+	}
+	s, err := gen.GenerateString("latency.bt", target, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != script.String() {
+		t.Errorf("GenerateString gave\n%s\nGenerate wrote\n%s", s, script.String())
+	}
+}
+
+// TestNewTargetErrors checks targets which can't be opened are errors
+// rather than panics
+func TestNewTargetErrors(t *testing.T) {
+	dir := t.TempDir()
+	for _, path := range []string{dir + "/nothing", dir, "/dev/null"} {
+		target, err := gen.NewTarget(path)
+		if err == nil {
+			target.Close()
+			t.Errorf("%s: no error", path)
+		}
+	}
+}
+
+// TestTargetHelpers checks the helpers templates call give the target's
+// symbols and refuse bad arguments with errors
+func TestTargetHelpers(t *testing.T) {
+	target := newFixtureTarget(t)
+	if !target.HasSymbol("main.handle") {
+		t.Error("no main.handle")
+	}
+	returns, err := target.SymbolReturns("main.handle")
+	if err != nil || len(returns) == 0 {
+		t.Errorf("SymbolReturns(main.handle) = %v, %v", returns, err)
+	}
+	for i := 1; i < len(returns); i++ {
+		if returns[i] <= returns[i-1] {
+			t.Errorf("return offsets %v aren't sorted", returns)
+		}
+	}
+	if _, err := target.SymbolReturns("main.nothing"); err == nil {
+		t.Error("SymbolReturns(main.nothing) gave no error")
+	}
+	if _, err := target.Arg(-1); err == nil {
+		t.Error("Arg(-1) gave no error")
+	}
+	if _, err := target.Arg(target.ArgRegisters()); err == nil {
+		t.Error("Arg past the registers gave no error")
+	}
+	if _, err := target.GoVersionAtLeast("1.21"); err == nil {
+		t.Error(`GoVersionAtLeast("1.21") gave no error`)
+	}
+	if ok, err := target.GoVersionAtLeast("go1.18"); !ok || err != nil {
+		t.Errorf(`GoVersionAtLeast("go1.18") = %v, %v`, ok, err)
+	}
+}
@@ -0,0 +1,356 @@
+package gen_test
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+	"github.com/stevenjohnstone/go-bpf-gen/testtarget"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden scripts in testdata/golden")
+
+// checkGolden compares script with the golden file testdata/golden/name,
+// writing it instead with -update
+func checkGolden(t *testing.T, name, script string) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name)
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s; write it with go test -update", err)
+	}
+	if script != string(want) {
+		t.Errorf("the script differs from %s, rewrite it with go test -update if that's intended:\n%s", path, script)
+	}
+}
+
+// goldenBinary has the functions the templates with golden tests against
+// made up executables probe
+func goldenBinary(stackABI bool) testtarget.Binary {
+	b := testtarget.Runtime()
+	b.StackABI = stackABI
+	b.Functions = append(b.Functions,
+		testtarget.Function{Name: "runtime.makechan", Returns: []int{48}},
+		testtarget.Function{Name: "runtime.chansend", Returns: []int{60, 140}},
+		testtarget.Function{Name: "runtime.chanrecv", Returns: []int{72, 160, 188}},
+		testtarget.Function{Name: "net/http.(*Transport).roundTrip", Returns: []int{300, 420}},
+		testtarget.Function{Name: "net/http.(*Transport).dialConn", Returns: []int{256}},
+		testtarget.Function{Name: "net/http.(*Transport).queueForDial", Returns: []int{88}},
+		testtarget.Function{Name: "runtime.gcMarkTermination", Returns: []int{180}},
+		testtarget.Function{Name: "runtime.gcSweep", Returns: []int{64}},
+		testtarget.Function{Name: "runtime.stopTheWorldWithSema", Returns: []int{96}},
+		testtarget.Function{Name: "runtime.startTheWorldWithSema", Returns: []int{72, 144}},
+		// a table of strings rather than a function but only its address
+		// is read
+		testtarget.Function{Name: "runtime.stwReasonStrings", Size: 256},
+	)
+	return b
+}
+
+// TestGoldenScripts renders templates for made up executables, which don't
+// change with the toolchain, and compares them with testdata/golden
+func TestGoldenScripts(t *testing.T) {
+	tests := []struct {
+		golden   string
+		template string
+		args     map[string][]string
+		stackABI bool
+	}{
+		{"alloc.bt", "alloc.bt", nil, false},
+		{"alloc-sample.bt", "alloc.bt", map[string][]string{"sample": {"1"}}, false},
+		{"channels.bt", "channels.bt", nil, false},
+		{"channels-stack.bt", "channels.bt", nil, true},
+		{"channels-min-block.bt", "channels.bt", map[string][]string{"min_block": {"5"}}, false},
+		{"http-client.bt", "http/client.bt", nil, false},
+		{"http-client-stack.bt", "http/client.bt", nil, true},
+		{"http-client-filtered.bt", "http/client.bt", map[string][]string{"host": {"example.com"}, "slow": {"100"}}, false},
+		{"dumpargs.bt", "dumpargs.bt", map[string][]string{"symbol": {"main.main"}}, false},
+		{"dumpargs-stack.bt", "dumpargs.bt", map[string][]string{"symbol": {"main.main"}}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.golden, func(t *testing.T) {
+			target, err := testtarget.New("/srv/server", goldenBinary(test.stackABI), gen.WithStrictArguments())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+			script, err := gen.GenerateString(test.template, target, test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, filepath.Join("made-up", test.golden), script)
+		})
+	}
+}
+
+var examplePackOnce sync.Once
+
+// TestGoldenExamplePack renders the template of the example pack in
+// testdata/examplepack, registered as gen's users register their own, for
+// a made up executable
+func TestGoldenExamplePack(t *testing.T) {
+	var err error
+	examplePackOnce.Do(func() {
+		err = gen.RegisterTemplates("examplepack", os.DirFS(filepath.Join("..", "testdata", "examplepack")))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := testtarget.New("/srv/server", goldenBinary(false), gen.WithStrictArguments())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	script, err := gen.GenerateString("examplepack/calls.bt", target, map[string][]string{"symbol": {"main.main", "runtime.mallocgc"}, "interval": {"10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, filepath.Join("made-up", "examplepack-calls.bt"), script)
+
+	if err := gen.RegisterTemplates("examplepack", os.DirFS(t.TempDir())); err == nil {
+		t.Error("a second examplepack was registered")
+	}
+}
+
+// TestGoldenGC renders gc.bt for made up executables of a release whose
+// stop-the-world functions don't take the reason the world is stopped for
+// and one whose do
+func TestGoldenGC(t *testing.T) {
+	for _, version := range []string{"go1.20.14", "go1.22.12"} {
+		t.Run(version, func(t *testing.T) {
+			b := goldenBinary(false)
+			b.GoVersion = version
+			target, err := testtarget.New("/srv/server", b, gen.WithStrictArguments())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+			script, err := gen.GenerateString("gc.bt", target, map[string][]string{"heap": {"0"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, filepath.Join("made-up", "gc-heap0-"+goRelease(version)+".bt"), script)
+		})
+	}
+}
+
+// goldenToolchains are the toolchains the fixtures are built with for the
+// golden tests of templates needing DWARF data and the tests of the runtime
+// offsets: the one running the tests and an older release with other
+// runtime internals, when it's in the module cache. The goldens for each
+// are in testdata/golden/<Go release> e.g. go1.21 so that they're the same
+// for every patch release.
+var goldenToolchains = []string{"local", "go1.21.13"}
+
+// toolchainFixture is a fixture built with a toolchain
+type toolchainFixture struct {
+	exe string
+	// skip is why there's no fixture when the toolchain isn't there
+	skip string
+	err  error
+}
+
+var (
+	toolchainMu       sync.Mutex
+	toolchainFixtures = map[[2]string]toolchainFixture{}
+	toolchainDirs     []string
+)
+
+// buildWithToolchain builds the selftest's fixture with toolchain, once for
+// all the tests
+func buildWithToolchain(t *testing.T, toolchain string) string {
+	t.Helper()
+	return buildTestdata(t, toolchain, "selftest")
+}
+
+// buildTestdata builds the fixture in testdata/<name> with toolchain, once
+// for all the tests. It's built with -trimpath so the directory it's built
+// in doesn't change it. The test is skipped if the toolchain can't be had
+// without downloading it.
+func buildTestdata(t *testing.T, toolchain, name string) string {
+	t.Helper()
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command to build the fixture with")
+	}
+	toolchainMu.Lock()
+	defer toolchainMu.Unlock()
+	key := [2]string{toolchain, name}
+	f, ok := toolchainFixtures[key]
+	if !ok {
+		f = buildToolchainFixture(goCmd, toolchain, name)
+		toolchainFixtures[key] = f
+	}
+	if f.skip != "" {
+		t.Skip(f.skip)
+	}
+	if f.err != nil {
+		t.Fatal(f.err)
+	}
+	return f.exe
+}
+
+func buildToolchainFixture(goCmd, toolchain, name string) toolchainFixture {
+	dir, err := os.MkdirTemp("", "go-bpf-gen-"+toolchain)
+	if err != nil {
+		return toolchainFixture{err: err}
+	}
+	toolchainDirs = append(toolchainDirs, dir)
+	exe := filepath.Join(dir, name)
+	cmd := exec.Command(goCmd, "build", "-trimpath", "-o", exe, "./testdata/"+name)
+	cmd.Env = append(os.Environ(), "GOTOOLCHAIN="+toolchain, "GOPROXY=off", "GOWORK=off", "GOFLAGS=", "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if toolchain != "local" && bytes.Contains(out, []byte("GOPROXY=off")) {
+			return toolchainFixture{skip: fmt.Sprintf("no %s toolchain: %s", toolchain, bytes.TrimSpace(out))}
+		}
+		return toolchainFixture{err: fmt.Errorf("failed to build %s with the %s toolchain: %w: %s", name, toolchain, err, bytes.TrimSpace(out))}
+	}
+	return toolchainFixture{exe: exe}
+}
+
+// goRelease returns the release of a Go version e.g. go1.21 for go1.21.13
+// or go1.22rc1
+func goRelease(version string) string {
+	rest := strings.TrimPrefix(version, "go1.")
+	minor := strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+	if rest == version || minor < 0 {
+		return version
+	}
+	return version[:len(version)-len(rest)+minor]
+}
+
+// checkFixtureGolden compares the script rendered for the fixture exe with
+// the golden testdata/golden/<Go release>/name. The fixture's path is
+// replaced by /srv/fixture and its Go version by its release.
+func checkFixtureGolden(t *testing.T, target *gen.Target, exe, name, script string) {
+	t.Helper()
+	script = strings.ReplaceAll(script, exe, "/srv/fixture")
+	script = strings.ReplaceAll(script, target.GoVersion(), goRelease(target.GoVersion()))
+	checkGolden(t, filepath.Join(goRelease(target.GoVersion()), name), script)
+}
+
+// TestGoldenFixtureScripts renders the templates reading Go's types from
+// DWARF data for the fixture built with each of goldenToolchains and
+// compares them with the goldens for its Go release. A release without
+// goldens fails the test: write them with go test -update.
+func TestGoldenFixtureScripts(t *testing.T) {
+	tests := []struct {
+		golden   string
+		template string
+		args     map[string][]string
+		// fixture is the fixture in testdata the template is rendered
+		// for, the selftest's by default
+		fixture string
+	}{
+		{"http-server.bt", "http/server.bt", nil, "httpserver"},
+		{"http-server-pattern.bt", "http/server.bt", map[string][]string{"by": {"pattern"}}, "httpserver"},
+		{"http-client.bt", "http/client.bt", nil, ""},
+		{"http-client-stack.bt", "http/client.bt", map[string][]string{"abi": {"stack"}}, ""},
+		{"gc.bt", "gc.bt", nil, ""},
+		{"gc-heap0.bt", "gc.bt", map[string][]string{"heap": {"0"}}, ""},
+		{"channels.bt", "channels.bt", nil, ""},
+		{"alloc.bt", "alloc.bt", nil, ""},
+		{"dns.bt", "dns.bt", nil, ""},
+		{"dns-filtered.bt", "dns.bt", map[string][]string{"name": {".example.com"}}, ""},
+		{"dumpargs.bt", "dumpargs.bt", map[string][]string{"symbol": {"main.handle"}}, ""},
+		{"dumpargs-stack.bt", "dumpargs.bt", map[string][]string{"symbol": {"main.handle"}, "abi": {"stack"}}, ""},
+		{"exec.bt", "exec.bt", nil, ""},
+		{"exec-match.bt", "exec.bt", map[string][]string{"match": {"git"}}, ""},
+		{"select.bt", "select.bt", nil, ""},
+	}
+	for _, toolchain := range goldenToolchains {
+		t.Run(toolchain, func(t *testing.T) {
+			for _, test := range tests {
+				t.Run(test.golden, func(t *testing.T) {
+					fixture := test.fixture
+					if fixture == "" {
+						fixture = "selftest"
+					}
+					exe := buildTestdata(t, toolchain, fixture)
+					target, err := gen.NewTarget(exe, gen.WithStrictArguments())
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer target.Close()
+					script, err := gen.GenerateString(test.template, target, test.args)
+					var requirement *gen.RequirementError
+					if errors.As(err, &requirement) {
+						t.Skip(err)
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					checkFixtureGolden(t, target, exe, test.golden, script)
+				})
+			}
+		})
+	}
+}
+
+// TestSelectRequirements checks select.bt declares it can't be rendered
+// for a target without the DWARF data giving the parameters of
+// runtime.selectgo rather than failing
+func TestSelectRequirements(t *testing.T) {
+	target, err := testtarget.New("/srv/server", goldenBinary(false), gen.WithStrictArguments())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	_, err = gen.GenerateString("select.bt", target, nil)
+	var requirement *gen.RequirementError
+	if !errors.As(err, &requirement) || !strings.Contains(requirement.Reason, "needs DWARF data") {
+		t.Fatalf("got %v, want the requirement of DWARF data", err)
+	}
+}
+
+// TestStopTheWorld checks the stop-the-world functions gc.bt probes have the
+// names and signatures it takes them to have in each Go release it's built
+// with: the world is stopped for a reason, the one byte first argument,
+// from go1.21
+func TestStopTheWorld(t *testing.T) {
+	for _, toolchain := range goldenToolchains {
+		t.Run(toolchain, func(t *testing.T) {
+			target, err := gen.NewTarget(buildWithToolchain(t, toolchain))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+			for _, symbol := range []string{"runtime.stopTheWorldWithSema", "runtime.startTheWorldWithSema", "runtime.stwReasonStrings"} {
+				if !target.HasSymbol(symbol) {
+					t.Errorf("%s has no %s", target.GoVersion(), symbol)
+				}
+			}
+			params, err := target.Params("runtime.stopTheWorldWithSema")
+			if err != nil {
+				t.Fatal(err)
+			}
+			reasons, err := target.GoVersionAtLeast("go1.21")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reasons && (len(params) != 1 || params[0].Type != "runtime.stwReason" || params[0].Size != 1 || params[0].Word != 0) {
+				t.Errorf("%s: got parameters %+v, want a one byte runtime.stwReason", target.GoVersion(), params)
+			}
+			if !reasons && len(params) != 0 {
+				t.Errorf("%s: got parameters %+v, want none", target.GoVersion(), params)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package gen_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+)
+
+// grpcReleases are the gRPC releases the gRPC fixture is built with, by the
+// file of testdata/grpc giving its modules: the latest tested and v1.69.0,
+// whose transport.ServerStream embeds a pointer to the transport.Stream
+// rather than the Stream itself
+var grpcReleases = []struct {
+	version string
+	modfile string
+}{
+	{"v1.84.0", "go.mod"},
+	{"v1.69.0", "grpc-v1.69.mod"},
+}
+
+// buildGRPC builds the gRPC fixture, a module of its own, with the modules
+// in modfile, once for all the tests. The test is skipped if gRPC isn't in
+// the module cache or the go command is too old for it.
+func buildGRPC(t *testing.T, modfile string) string {
+	t.Helper()
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command to build the fixture with")
+	}
+	toolchainMu.Lock()
+	defer toolchainMu.Unlock()
+	key := [2]string{"local", "grpc/" + modfile}
+	f, ok := toolchainFixtures[key]
+	if !ok {
+		f = buildGRPCFixture(goCmd, modfile)
+		toolchainFixtures[key] = f
+	}
+	if f.skip != "" {
+		t.Skip(f.skip)
+	}
+	if f.err != nil {
+		t.Fatal(f.err)
+	}
+	return f.exe
+}
+
+func buildGRPCFixture(goCmd, modfile string) toolchainFixture {
+	dir, err := os.MkdirTemp("", "go-bpf-gen-grpc")
+	if err != nil {
+		return toolchainFixture{err: err}
+	}
+	toolchainDirs = append(toolchainDirs, dir)
+	exe := filepath.Join(dir, "grpc")
+	cmd := exec.Command(goCmd, "build", "-trimpath", "-modfile="+modfile, "-o", exe, ".")
+	cmd.Dir = filepath.Join("testdata", "grpc")
+	cmd.Env = append(os.Environ(), "GOTOOLCHAIN=local", "GOPROXY=off", "GOWORK=off", "GOFLAGS=", "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if bytes.Contains(out, []byte("GOPROXY=off")) || bytes.Contains(out, []byte("GOTOOLCHAIN=local")) {
+			return toolchainFixture{skip: fmt.Sprintf("can't build the gRPC fixture with %s without downloading modules or a newer go: %s", modfile, bytes.TrimSpace(out))}
+		}
+		return toolchainFixture{err: fmt.Errorf("failed to build the gRPC fixture with %s: %w: %s", modfile, err, bytes.TrimSpace(out))}
+	}
+	return toolchainFixture{exe: exe}
+}
+
+// TestGoldenGRPC renders grpc.bt for the gRPC fixture built with each of
+// grpcReleases and compares it with the goldens. The method is read through
+// the Stream a ServerStream embeds, by value in the latest release and by
+// pointer in v1.69.0.
+func TestGoldenGRPC(t *testing.T) {
+	methods := map[string]string{
+		"v1.84.0": "$method = str(*($stream + 16), *($stream + 16 + 8));",
+		"v1.69.0": "$method = str(*(*($stream) + 24), *(*($stream) + 24 + 8));",
+	}
+	for _, release := range grpcReleases {
+		t.Run(release.version, func(t *testing.T) {
+			exe := buildGRPC(t, release.modfile)
+			target, err := gen.NewTarget(exe, gen.WithStrictArguments())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+			script, err := gen.GenerateString("grpc.bt", target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(script, "// google.golang.org/grpc "+release.version+"\n") {
+				t.Fatalf("the fixture wasn't built with gRPC %s:\n%s", release.version, script)
+			}
+			if want := methods[release.version]; !strings.Contains(script, want) {
+				t.Errorf("no %s in\n%s", want, script)
+			}
+			checkFixtureGolden(t, target, exe, "grpc-"+release.version+".bt", script)
+		})
+	}
+}
+
+// TestGRPCTrace has the gRPC fixture check the health of a service it
+// serves and one it doesn't, traced by grpc.bt when bpftrace can be run
+func TestGRPCTrace(t *testing.T) {
+	for _, release := range grpcReleases {
+		t.Run(release.version, func(t *testing.T) {
+			exe := buildGRPC(t, release.modfile)
+			script := fixtureScript(t, exe, "grpc.bt", nil)
+			addr := startFixture(t, exec.Command(exe))
+			check := func(service, want string) {
+				t.Helper()
+				out, err := exec.Command(exe, "-check", addr, service).CombinedOutput()
+				if err != nil || strings.TrimSpace(string(out)) != want {
+					t.Fatalf("checking %s: got %s, %v, want %s", service, bytes.TrimSpace(out), err, want)
+				}
+			}
+			workload := func() {
+				for i := 0; i < 3; i++ {
+					check("ready", "SERVING")
+				}
+				check("missing", "NotFound")
+			}
+			// the fixture serves whether it's traced or not
+			workload()
+
+			output := trace(t, script, workload)
+			const method = "/grpc.health.v1.Health/Check"
+			checkTrace(t, output, "@latency_ms["+method+"]:", "@codes["+method+", 0]: 3", "@codes["+method+", 5]: 1")
+		})
+	}
+}
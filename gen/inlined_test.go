@@ -0,0 +1,59 @@
+package gen_test
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+	"github.com/stevenjohnstone/go-bpf-gen/ret"
+)
+
+// TestInlinedError checks probing a function every call of which was
+// inlined fails naming the functions it was inlined into, using the layout
+// package's fixture of inlined functions
+func TestInlinedError(t *testing.T) {
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command to build the fixture with")
+	}
+	exe := filepath.Join(t.TempDir(), "inlined")
+	cmd := exec.Command(goCmd, "build", "-o", exe, "../layout/testdata/inlined")
+	cmd.Env = append(cmd.Environ(), "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("building fixture: %v\n%s", err, out)
+	}
+	target, err := gen.NewTarget(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	_, err = target.SymbolAddress("main.square")
+	var inlined *gen.InlinedError
+	if !errors.As(err, &inlined) {
+		t.Fatalf("got %v, want an InlinedError", err)
+	}
+	if want := []string{"main.area", "main.volume"}; inlined.Function != "main.square" || !reflect.DeepEqual(inlined.Callers, want) {
+		t.Errorf("got %s inlined into %v, want main.square into %v", inlined.Function, inlined.Callers, want)
+	}
+	if !errors.Is(err, ret.ErrSymbolNotFound) {
+		t.Errorf("%v isn't ErrSymbolNotFound", err)
+	}
+	want := "main.square has no symbol as every call to it was inlined, into main.area, main.volume; " +
+		"probe those instead or rebuild the target with //go:noinline on main.square or with -gcflags=all=-l to stop inlining"
+	if err.Error() != want {
+		t.Errorf("got %q, want %q", err, want)
+	}
+
+	// double has an out of line copy as well as being inlined
+	if _, err := target.SymbolAddress("main.double"); err != nil {
+		t.Errorf("main.double: %s", err)
+	}
+	// a misspelling isn't taken for an inlined function
+	if _, err := target.SymbolAddress("main.sqaure"); err == nil || errors.As(err, &inlined) {
+		t.Errorf("main.sqaure gave %v", err)
+	}
+}
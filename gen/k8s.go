@@ -0,0 +1,185 @@
+package gen
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrPodNotOnNode is returned when a k8s: target's pod isn't running on
+	// the node go-bpf-gen is run on
+	ErrPodNotOnNode = errors.New("pod not on this node")
+	// ErrPodNotFound is returned when the API server says a k8s: target's
+	// pod doesn't exist
+	ErrPodNotFound = errors.New("pod not found")
+)
+
+// Pod is the Kubernetes container given by a k8s:<namespace>/<pod>[/<container>]
+// target
+type Pod struct {
+	Namespace string
+	Name      string
+	Container string
+}
+
+// criBundle is where a container runtime keeps the OCI bundles of running
+// containers and the annotations on them naming the pod and container
+type criBundle struct {
+	glob       string
+	pidFile    string
+	namespace  string
+	pod        string
+	container  string
+	typeKey    string
+	sandboxTyp string
+}
+
+var criBundles = []criBundle{
+	{
+		// containerd
+		glob:       "/run/containerd/io.containerd.runtime.v2.task/k8s.io/*/config.json",
+		pidFile:    "init.pid",
+		namespace:  "io.kubernetes.cri.sandbox-namespace",
+		pod:        "io.kubernetes.cri.sandbox-name",
+		container:  "io.kubernetes.cri.container-name",
+		typeKey:    "io.kubernetes.cri.container-type",
+		sandboxTyp: "sandbox",
+	},
+	{
+		// CRI-O
+		glob:       "/run/containers/storage/overlay-containers/*/userdata/config.json",
+		pidFile:    "pidfile",
+		namespace:  "io.kubernetes.pod.namespace",
+		pod:        "io.kubernetes.pod.name",
+		container:  "io.kubernetes.container.name",
+		typeKey:    "io.kubernetes.cri-o.ContainerType",
+		sandboxTyp: "sandbox",
+	},
+}
+
+// parsePod parses the <namespace>/<pod>[/<container>] of a k8s: target
+func parsePod(target string) (Pod, error) {
+	parts := strings.Split(target, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Pod{}, fmt.Errorf("malformed target k8s:%s, must be of form k8s:<namespace>/<pod>[/<container>]", target)
+	}
+	pod := Pod{Namespace: parts[0], Name: parts[1]}
+	if len(parts) == 3 {
+		pod.Container = parts[2]
+	}
+	return pod, nil
+}
+
+// podPid finds the pid of a pod's container from the OCI bundles containerd
+// and CRI-O keep for the containers running on the node so no access to
+// the API server is needed. Without a container name the pod must have only
+// one container. The pod is returned with its container name filled in.
+func podPid(target string) (int, Pod, error) {
+	pod, err := parsePod(target)
+	if err != nil {
+		return 0, pod, err
+	}
+	pids := map[string]int{}
+	for _, cri := range criBundles {
+		configs, _ := filepath.Glob(cri.glob)
+		for _, config := range configs {
+			data, err := os.ReadFile(config)
+			if err != nil {
+				continue
+			}
+			var spec struct {
+				Annotations map[string]string
+			}
+			if json.Unmarshal(data, &spec) != nil {
+				continue
+			}
+			a := spec.Annotations
+			if a[cri.namespace] != pod.Namespace || a[cri.pod] != pod.Name || a[cri.typeKey] == cri.sandboxTyp {
+				continue
+			}
+			pidData, err := os.ReadFile(filepath.Join(filepath.Dir(config), cri.pidFile))
+			if err != nil {
+				continue
+			}
+			if pid, err := strconv.Atoi(strings.TrimSpace(string(pidData))); err == nil {
+				pids[a[cri.container]] = pid
+			}
+		}
+	}
+	if len(pids) == 0 {
+		return 0, pod, podMissing(pod)
+	}
+	if pod.Container == "" {
+		if len(pids) > 1 {
+			var names []string
+			for name := range pids {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return 0, pod, fmt.Errorf("pod %s/%s has containers %s; give one with k8s:%s/%s/<container>",
+				pod.Namespace, pod.Name, strings.Join(names, ", "), pod.Namespace, pod.Name)
+		}
+		for name := range pids {
+			pod.Container = name
+		}
+	}
+	pid, ok := pids[pod.Container]
+	if !ok {
+		return 0, pod, fmt.Errorf("pod %s/%s has no running container %s", pod.Namespace, pod.Name, pod.Container)
+	}
+	return pid, pod, nil
+}
+
+// podMissing explains why a pod isn't running on this node. With a service
+// account token, as when go-bpf-gen runs in a pod, the API server is asked
+// whether the pod exists elsewhere.
+func podMissing(pod Pod) error {
+	const serviceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	token, err := os.ReadFile(filepath.Join(serviceAccount, "token"))
+	if host == "" || err != nil {
+		return fmt.Errorf("%w: %s/%s (without API server access it can't be told whether it's on another node)", ErrPodNotOnNode, pod.Namespace, pod.Name)
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccount, "ca.crt"))
+	if err != nil {
+		return fmt.Errorf("%w: %s/%s", ErrPodNotOnNode, pod.Namespace, pod.Name)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca)
+	client := http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s:%s/api/v1/namespaces/%s/pods/%s", host, port, pod.Namespace, pod.Name), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %s/%s", ErrPodNotOnNode, pod.Namespace, pod.Name)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s/%s", ErrPodNotFound, pod.Namespace, pod.Name)
+	}
+	var found struct {
+		Spec struct {
+			NodeName string
+		}
+	}
+	if resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&found) == nil && found.Spec.NodeName != "" {
+		return fmt.Errorf("%w: %s/%s is on node %s", ErrPodNotOnNode, pod.Namespace, pod.Name, found.Spec.NodeName)
+	}
+	return fmt.Errorf("%w: %s/%s", ErrPodNotOnNode, pod.Namespace, pod.Name)
+}
@@ -0,0 +1,108 @@
+package gen
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path"
+	"sort"
+	"strings"
+)
+
+// AutoMapPrefix given to WithMapPrefix has each rendering of a template
+// for a target prefix its maps with a short hash of the template's name
+// and the target's path
+const AutoMapPrefix = "auto"
+
+// WithMapPrefix has Generate prefix the maps of the script with prefix_ so
+// that scripts rendered from several templates, or for several targets,
+// can be run or combined without their maps colliding. With AutoMapPrefix
+// the prefix is made up. GenerateFleet prefixes maps with each target's
+// ServicePrefix instead.
+func WithMapPrefix(prefix string) Option {
+	return func(o *options) {
+		o.mapPrefix = prefix
+	}
+}
+
+// instancePrefix makes up a map prefix for rendering the template called
+// name for the target which stays the same between runs. The extensions
+// are left out of the name so that the BPF C of a libbpf template and its
+// loader, e.g. latency.bpf.c.tmpl and latency.c.tmpl, agree.
+func (t Target) instancePrefix(name string) string {
+	base, _, _ := strings.Cut(path.Base(name), ".")
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s\x00%s", base, t.ExePath)
+	return fmt.Sprintf("m%06x", h.Sum32()&0xffffff)
+}
+
+// mapPrefix gives the prefix to render the template called name with, if
+// WithMapPrefix was given
+func (t Target) mapPrefix(name string) (string, error) {
+	prefix := t.opts.mapPrefix
+	if prefix == AutoMapPrefix {
+		return t.instancePrefix(name), nil
+	}
+	for i := 0; i < len(prefix); i++ {
+		if !isIdentByte(prefix[i]) || i == 0 && prefix[i] >= '0' && prefix[i] <= '9' {
+			return "", fmt.Errorf("bad map prefix %q: it must be a letter or _ followed by letters, digits and _", prefix)
+		}
+	}
+	return prefix, nil
+}
+
+// Map gives the name of the map called name as it must be written in the
+// script: @name for bpftrace and name in the C and Python of the BCC and
+// libbpf formats, prefixed when maps are being prefixed. bpftrace scripts
+// have every @name prefixed once rendered so only the other formats,
+// whose map names can't be told from the rest of the code, need this.
+func (t Target) Map(name string) string {
+	if t.Format == FormatBpftrace {
+		return "@" + name
+	}
+	prefix := t.ServicePrefix
+	if prefix == "" {
+		prefix = t.maps
+	}
+	if prefix == "" {
+		return name
+	}
+	return prefix + "_" + name
+}
+
+// mapNames returns the names of the maps used by a bpftrace script, sorted
+func mapNames(script string) []string {
+	seen := map[string]bool{}
+	scanScript(script, func(i int) bool {
+		if script[i] != '@' {
+			return true
+		}
+		j := i + 1
+		for j < len(script) && isIdentByte(script[j]) {
+			j++
+		}
+		seen[script[i:j]] = true
+		return true
+	})
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkMapCollisions fails if any map is used by more than one of scripts,
+// which are named by names, as it could be if one's prefix is the start of
+// another's e.g. web and web_api
+func checkMapCollisions(names, scripts []string) error {
+	owners := map[string]int{}
+	for i, script := range scripts {
+		for _, m := range mapNames(script) {
+			if j, ok := owners[m]; ok && j != i {
+				return fmt.Errorf("map %s is used by both %s and %s", m, names[j], names[i])
+			}
+			owners[m] = i
+		}
+	}
+	return nil
+}
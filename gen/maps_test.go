@@ -0,0 +1,117 @@
+package gen_test
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+	"github.com/stevenjohnstone/go-bpf-gen/testtarget"
+)
+
+var autoPrefixed = regexp.MustCompile(`^@(m[0-9a-f]{6})_`)
+
+// TestMapCollisions renders every bundled bpftrace template for the fixture
+// with AutoMapPrefix and checks no two of the scripts share a map, so that
+// any of them can be run alongside any other, and that no map was left
+// unprefixed
+func TestMapCollisions(t *testing.T) {
+	exe := fixture(t)
+	results, err := gen.SelfTest(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type script struct {
+		template string
+		prefix   string
+		maps     []string
+	}
+	var scripts []script
+	seen := map[string]bool{}
+	for _, result := range results {
+		if result.Status != gen.SelfTestPass || gen.FormatFor(result.Template) != gen.FormatBpftrace || seen[result.Template] {
+			continue
+		}
+		seen[result.Template] = true
+		kv := map[string][]string{}
+		for _, arg := range result.Args {
+			k, v, _ := strings.Cut(arg, "=")
+			kv[k] = append(kv[k], v)
+		}
+		target := newFixtureTarget(t, gen.WithMapPrefix(gen.AutoMapPrefix))
+		rendered, err := gen.GenerateString(result.Template, target, kv)
+		if err != nil {
+			t.Fatalf("%s: %s", result.Template, err)
+		}
+		s := script{template: result.Template, maps: gen.MapNames(rendered)}
+		for _, m := range s.maps {
+			match := autoPrefixed.FindStringSubmatch(m)
+			switch {
+			case match == nil:
+				t.Errorf("%s: map %s isn't prefixed", s.template, m)
+			case s.prefix == "":
+				s.prefix = match[1]
+			case match[1] != s.prefix:
+				t.Errorf("%s: map %s has another prefix than %s", s.template, m, s.prefix)
+			}
+		}
+		scripts = append(scripts, s)
+	}
+	if len(scripts) < 2 {
+		t.Fatalf("only %d scripts rendered", len(scripts))
+	}
+	for i, a := range scripts {
+		maps := map[string]bool{}
+		for _, m := range a.maps {
+			maps[m] = true
+		}
+		for _, b := range scripts[i+1:] {
+			if a.prefix != "" && a.prefix == b.prefix {
+				t.Errorf("%s and %s both have the prefix %s", a.template, b.template, a.prefix)
+			}
+			for _, m := range b.maps {
+				if maps[m] {
+					t.Errorf("%s and %s both use %s", a.template, b.template, m)
+				}
+			}
+		}
+	}
+	t.Logf("%d scripts, no maps shared", len(scripts))
+}
+
+func TestMapPrefix(t *testing.T) {
+	args := map[string][]string{"symbol": {"main.main"}}
+	for prefix, want := range map[string]string{
+		"web":     "@web_",
+		"_web2":   "@_web2_",
+		"1web":    `bad map prefix "1web": it must be a letter or _ followed by letters, digits and _`,
+		"web-api": `bad map prefix "web-api": it must be a letter or _ followed by letters, digits and _`,
+	} {
+		t.Run(prefix, func(t *testing.T) {
+			target, err := testtarget.New("/srv/server", testtarget.Runtime(), gen.WithMapPrefix(prefix))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+			script, err := gen.GenerateString("latency.bt", target, args)
+			if !strings.HasPrefix(want, "@") {
+				if err == nil || err.Error() != want {
+					t.Errorf("got %v, want %s", err, want)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			maps := gen.MapNames(script)
+			if len(maps) == 0 {
+				t.Fatal("no maps")
+			}
+			for _, m := range maps {
+				if !strings.HasPrefix(m, want) {
+					t.Errorf("map %s doesn't start %s", m, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package gen
+
+import (
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// RequirementError is the error for a target which a template declared,
+// with Requires, it can't be rendered for
+type RequirementError struct {
+	Reason string
+}
+
+func (e *RequirementError) Error() string {
+	return e.Reason
+}
+
+// Requires fails with reason unless ok, for templates to declare a target
+// can't have a script made for it at all, e.g. one which doesn't depend on
+// the library the template probes, rather than panicking. The selftest
+// skips templates whose requirements the fixture doesn't meet.
+//
+//	{{ .Requires (.DepVersion "google.golang.org/grpc") "target doesn't depend on google.golang.org/grpc" }}
+//
+// ok is a bool or, like a string from DepVersion, anything text/template
+// takes as true or false in an if.
+func (t Target) Requires(ok interface{}, reason string) (string, error) {
+	if truth, _ := template.IsTrue(ok); !truth {
+		return "", &RequirementError{Reason: reason}
+	}
+	return "", nil
+}
+
+// Example gives an empty string. It declares the key=value arguments, as
+// they'd be given on the command line, of an example of the template's use
+// which the selftest renders it with against its fixture. A template can
+// declare several and one without any is rendered without arguments.
+//
+//	{{ .Example "symbol=main.handle" }}
+func (t Target) Example(args string) string {
+	return ""
+}
+
+// templateExamples returns the arguments of each Example in tmpl
+func templateExamples(tmpl *template.Template) [][]string {
+	var examples [][]string
+	walkCommands(tmpl, func(n *parse.CommandNode) {
+		if helperName(n.Args[0]) != "Example" || len(n.Args) < 2 {
+			return
+		}
+		if s, ok := n.Args[1].(*parse.StringNode); ok {
+			examples = append(examples, strings.Fields(s.Text))
+		}
+	})
+	return examples
+}
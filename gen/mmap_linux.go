@@ -0,0 +1,24 @@
+package gen
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// mmap maps all of f into memory read only
+func mmap(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size <= 0 || int64(int(size)) != size {
+		return nil, errors.New("can't map a file of this size")
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(b []byte) error {
+	return syscall.Munmap(b)
+}
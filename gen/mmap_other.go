@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// mmap isn't used off Linux; files are read instead
+func mmap(f *os.File) ([]byte, error) {
+	return nil, errors.New("mmap not supported")
+}
+
+func munmap(b []byte) error {
+	return nil
+}
@@ -0,0 +1,108 @@
+package gen
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// offsetProbes rewrites the bpftrace probes on the target executable in
+// script from symbol names to addresses e.g.
+//
+//	uprobe:/path:"os.(*File).Write" + 321
+//
+// becomes
+//
+//	uprobe:/path:0x4d92a1 /* os.(*File).Write + 321 */
+//
+// so bpftrace doesn't look the symbols up when attaching. The binary on the
+// host running the script can then be stripped and symbols bpftrace can't
+// parse are no problem. The addresses are virtual addresses, as in the
+// symbol table, rather than file offsets: bpftrace's probes take no file
+// offsets, and it converts an address to one with the binary's program
+// headers when attaching, as formats.go does for the formats which want
+// file offsets. Templates write probes themselves rather than
+// through a helper so the rendered script is rewritten. Unless all is true
+// only the probes bpftrace can't look up, on code given by address in
+// symbol= arguments and on the functions of stripped targets found in
+// their .gopclntab, are rewritten. A probe on the target which can't be
+// parsed is an error either way, not passed through.
+func (t Target) offsetProbes(script string, all bool) (string, error) {
+	prefix := regexp.MustCompile(`(u(?:ret)?probe):` + regexp.QuoteMeta(t.ExePath) + `:`)
+	var out strings.Builder
+	last := 0
+	for _, loc := range prefix.FindAllStringSubmatchIndex(script, -1) {
+		kind := script[loc[2]:loc[3]]
+		symbol, offset, n, err := parseProbe(script[loc[1]:])
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", probeLine(script[loc[0]:]), err)
+		}
+		end := loc[1] + n
+		out.WriteString(script[last:loc[0]])
+		last = end
+		probe := script[loc[0]:end]
+		if !t.probedByAddress(symbol) && (!all || strings.HasPrefix(symbol, "0x")) {
+			// already an address or to be left to bpftrace
+			out.WriteString(probe)
+			continue
+		}
+		// * is only a wildcard outside quotes: "os.(*File).Write" is literal
+		if !strings.HasPrefix(script[loc[1]:], `"`) && strings.ContainsAny(symbol, "*?") {
+			return "", fmt.Errorf("%s: wildcards can't be probed by address", probe)
+		}
+		address, err := t.SymbolAddress(symbol)
+		if err != nil {
+			return "", err
+		}
+		size, err := t.SymbolSize(symbol)
+		if err != nil {
+			return "", err
+		}
+		if offset >= size && size > 0 {
+			return "", fmt.Errorf("%s: offset is outside %s which is %d bytes", probe, symbol, size)
+		}
+		comment := symbol
+		if offset > 0 {
+			comment = fmt.Sprintf("%s + %d", symbol, offset)
+		}
+		fmt.Fprintf(&out, "%s:%s:0x%x /* %s */", kind, t.ExePath, address+offset, comment)
+	}
+	out.WriteString(script[last:])
+	return out.String(), nil
+}
+
+// probeSymbol matches the symbol of a probe, quoted or not, and an offset
+// into it in decimal or hex
+var probeSymbol = regexp.MustCompile(`^("[^"]+"|[A-Za-z0-9_./*?]+)(?: *\+ *(0x[0-9a-fA-F]+|[0-9]+))?`)
+
+// parseProbe parses the symbol and offset of a probe from the start of
+// rest, the text following its "uprobe:/path:", and returns how much of it
+// they took up. The probe must end there, as it does before a predicate,
+// action block or another attach point of the same probe, or the probe
+// can't be understood and is an error rather than being rewritten wrongly
+// or left to bpftrace to look up.
+func parseProbe(rest string) (symbol string, offset uint64, n int, err error) {
+	m := probeSymbol.FindStringSubmatch(rest)
+	if m == nil {
+		return "", 0, 0, errors.New("can't parse the symbol of the probe")
+	}
+	n = len(m[0])
+	if after := strings.TrimLeft(rest[n:], " \t"); after != "" && !strings.ContainsRune("\n,{/", rune(after[0])) {
+		return "", 0, 0, fmt.Errorf("can't parse the probe past %q", m[0])
+	}
+	if m[2] != "" {
+		if offset, err = strconv.ParseUint(m[2], 0, 64); err != nil {
+			return "", 0, 0, err
+		}
+	}
+	return strings.Trim(m[1], `"`), offset, n, nil
+}
+
+// probeLine returns the line of a script starting at a probe, to say which
+// probe couldn't be parsed
+func probeLine(script string) string {
+	line, _, _ := strings.Cut(script, "\n")
+	return strings.TrimSpace(line)
+}
@@ -0,0 +1,90 @@
+package gen_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+	"github.com/stevenjohnstone/go-bpf-gen/testtarget"
+)
+
+// TestOffsetProbes checks -offsets probes are given by virtual address,
+// which bpftrace converts to the file offsets the other formats are given
+func TestOffsetProbes(t *testing.T) {
+	const text = `uprobe:{{ .ExePath }}:main.main {}
+uprobe:{{ .ExePath }}:"runtime.execute" + 64 {}
+uprobe:{{ .ExePath }}:0x400000 {}
+uprobe:{{ .ExePath }}:main.main+0x10,uprobe:{{ .ExePath }}:"runtime.execute" /pid == 1/ {}
+`
+	target, err := testtarget.New("/bin/target", testtarget.Runtime(),
+		gen.WithAddressProbes(),
+		gen.WithTemplates(fstest.MapFS{"offsets.bt": {Data: []byte(text)}}),
+		gen.WithArguments(map[string][]string{"symbol": {"main.main", "runtime.execute"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	script, err := gen.GenerateString("offsets.bt", target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	main, err := target.SymbolAddress("main.main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	execute, err := target.SymbolAddress("runtime.execute")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		fmt.Sprintf("uprobe:/bin/target:0x%x /* main.main */ {}", main),
+		fmt.Sprintf("uprobe:/bin/target:0x%x /* runtime.execute + 64 */ {}", execute+64),
+		// addresses are left as they are
+		"uprobe:/bin/target:0x400000 {}",
+		// offsets can be hex and the probes of an attach point list or
+		// with a predicate are rewritten too
+		fmt.Sprintf("uprobe:/bin/target:0x%x /* main.main + 16 */,uprobe:/bin/target:0x%x /* runtime.execute */ /pid == 1/ {}", main+16, execute),
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("no %q in\n%s", want, script)
+		}
+	}
+
+	// the executable is loaded at 0x400000 from the start of the file
+	plan, err := target.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, probe := range plan.Probes {
+		if probe.FileOffset != probe.Address-0x400000 {
+			t.Errorf("%s at 0x%x has file offset 0x%x, want 0x%x", probe.Symbol, probe.Address, probe.FileOffset, probe.Address-0x400000)
+		}
+	}
+}
+
+func TestOffsetProbeErrors(t *testing.T) {
+	for _, test := range []struct{ probe, want string }{
+		{`uprobe:{{ .ExePath }}:main.* {}`, "wildcards can't be probed by address"},
+		{`uprobe:{{ .ExePath }}:main.main + 4096 {}`, "offset is outside main.main"},
+		{`uprobe:{{ .ExePath }}:main.nothing {}`, "main.nothing"},
+		// probes which can't be parsed fail rather than being passed
+		// through to bpftrace or rewritten wrongly
+		{`uprobe:{{ .ExePath }}:main.Map[int] {}`, `uprobe:/bin/target:main.Map[int] {}: can't parse the probe past "main.Map"`},
+		{`uprobe:{{ .ExePath }}:main.main + x {}`, `can't parse the probe past "main.main"`},
+		{`uprobe:{{ .ExePath }}:(main.main) {}`, "can't parse the symbol of the probe"},
+	} {
+		target, err := testtarget.New("/bin/target", testtarget.Runtime(),
+			gen.WithAddressProbes(),
+			gen.WithTemplates(fstest.MapFS{"offsets.bt": {Data: []byte(test.probe + "\n")}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = gen.GenerateString("offsets.bt", target, nil)
+		target.Close()
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want one with %q", test.probe, err, test.want)
+		}
+	}
+}
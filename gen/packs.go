@@ -0,0 +1,93 @@
+package gen
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/stevenjohnstone/go-bpf-gen/templates"
+)
+
+var (
+	packsMu sync.Mutex
+	// packs are the template packs registered by RegisterTemplates by name
+	packs = map[string]fs.FS{}
+)
+
+// RegisterTemplates makes the templates in fsys, such as a directory or a
+// file system embedded in another program, available to Generate as
+// name/<path in fsys> e.g. mypack/latency.bt. A name can only be registered
+// once and mustn't be that of a directory of bundled templates.
+func RegisterTemplates(name string, fsys fs.FS) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." || name == "templates" {
+		return fmt.Errorf("bad template pack name %q", name)
+	}
+	if _, err := fs.Stat(templates.FS, name); err == nil {
+		return fmt.Errorf("template pack %s would hide bundled templates of the same name", name)
+	}
+	packsMu.Lock()
+	defer packsMu.Unlock()
+	if _, ok := packs[name]; ok {
+		return fmt.Errorf("template pack %s is already registered", name)
+	}
+	packs[name] = fsys
+	return nil
+}
+
+// packFor returns the pack a template called name is in and its name in
+// the pack
+func packFor(name string) (fs.FS, string, bool) {
+	pack, rest, ok := strings.Cut(name, "/")
+	if !ok {
+		return nil, "", false
+	}
+	packsMu.Lock()
+	defer packsMu.Unlock()
+	fsys, ok := packs[pack]
+	return fsys, rest, ok
+}
+
+// isTemplate is true for the files which are templates rather than
+// the files they're kept with
+func isTemplate(name string) bool {
+	return FormatFor(name) != FormatBpftrace || strings.HasSuffix(name, ".bt")
+}
+
+// templateNames returns the names of the templates in fsys, prefixed by
+// prefix
+func templateNames(fsys fs.FS, prefix string) ([]string, error) {
+	var names []string
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && isTemplate(p) {
+			names = append(names, path.Join(prefix, p))
+		}
+		return nil
+	})
+	return names, err
+}
+
+// TemplateNames returns the names of the bundled templates and those of
+// the registered packs, sorted, as Generate takes them
+func TemplateNames() ([]string, error) {
+	names, err := templateNames(templates.FS, "")
+	if err != nil {
+		return nil, err
+	}
+	packsMu.Lock()
+	defer packsMu.Unlock()
+	for name, fsys := range packs {
+		pack, err := templateNames(fsys, name)
+		if err != nil {
+			return nil, fmt.Errorf("template pack %s: %w", name, err)
+		}
+		names = append(names, pack...)
+	}
+	sort.Strings(names)
+	return names, nil
+}
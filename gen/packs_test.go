@@ -0,0 +1,125 @@
+package gen
+
+import (
+	"io/fs"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// registerPack registers fsys as the pack name, unregistering it when the
+// test ends
+func registerPack(t *testing.T, name string, fsys fs.FS) {
+	t.Helper()
+	if err := RegisterTemplates(name, fsys); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		packsMu.Lock()
+		defer packsMu.Unlock()
+		delete(packs, name)
+	})
+}
+
+func TestRegisterTemplates(t *testing.T) {
+	registerPack(t, "mypack", fstest.MapFS{"latency.bt": {Data: []byte("BEGIN {}\n")}})
+	for _, test := range []struct {
+		name, want string
+	}{
+		{"mypack", "template pack mypack is already registered"},
+		// the bundled templates of http/ are http/<name> already
+		{"http", "template pack http would hide bundled templates of the same name"},
+		{"", `bad template pack name ""`},
+		{"my/pack", `bad template pack name "my/pack"`},
+		{`my\pack`, `bad template pack name "my\\pack"`},
+		{".", `bad template pack name "."`},
+		{"..", `bad template pack name ".."`},
+		{"templates", `bad template pack name "templates"`},
+	} {
+		err := RegisterTemplates(test.name, fstest.MapFS{})
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%q: got %v, want %s", test.name, err, test.want)
+		}
+	}
+	// the pack registered first is kept
+	if fsys, name, ok := packFor("mypack/latency.bt"); !ok || name != "latency.bt" || fsys.(fstest.MapFS)["latency.bt"] == nil {
+		t.Errorf("got %v, %q, %v for mypack/latency.bt", fsys, name, ok)
+	}
+}
+
+func TestPackFor(t *testing.T) {
+	pack := fstest.MapFS{"latency.bt": {}, "http/server.bt": {}}
+	registerPack(t, "mypack", pack)
+	for _, test := range []struct {
+		template string
+		inPack   string
+		ok       bool
+	}{
+		{"mypack/latency.bt", "latency.bt", true},
+		{"mypack/http/server.bt", "http/server.bt", true},
+		// a missing template is the pack's to report
+		{"mypack/nothing.bt", "nothing.bt", true},
+		{"latency.bt", "", false},
+		{"http/server.bt", "", false},
+		{"templates/latency.bt", "", false},
+		{"otherpack/latency.bt", "", false},
+		{"mypack", "", false},
+	} {
+		fsys, inPack, ok := packFor(test.template)
+		if ok != test.ok || ok && (inPack != test.inPack || fsys == nil) {
+			t.Errorf("%s: got %q, %v, want %q, %v", test.template, inPack, ok, test.inPack, test.ok)
+		}
+	}
+}
+
+func TestLoadPackTemplate(t *testing.T) {
+	registerPack(t, "mypack", fstest.MapFS{"latency.bt": {Data: []byte("BEGIN { printf(\"mine\\n\"); }\n")}})
+	source, err := LoadTemplate("mypack/latency.bt")
+	if err != nil || !strings.Contains(source, "mine") {
+		t.Errorf("got %q, %v, want the pack's latency.bt", source, err)
+	}
+	// the pack's name isn't looked for in the other file systems
+	if _, err := LoadTemplate("mypack/nothing.bt", fstest.MapFS{"mypack/nothing.bt": {}}); err == nil ||
+		!strings.HasPrefix(err.Error(), "failed to open mypack/nothing.bt") {
+		t.Errorf("got %v for a template the pack doesn't have", err)
+	}
+	// nor are bundled templates hidden by other packs
+	if source, err := LoadTemplate("latency.bt"); err != nil || strings.Contains(source, "mine") {
+		t.Errorf("got %v loading the bundled latency.bt", err)
+	}
+}
+
+func TestTemplateNames(t *testing.T) {
+	registerPack(t, "mypack", fstest.MapFS{
+		"latency.bt":     {},
+		"http/server.bt": {},
+		"probes.stp":     {},
+		"README.md":      {},
+		"helpers.txt":    {},
+	})
+	names, err := TemplateNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pack []string
+	bundled := map[string]bool{}
+	for _, name := range names {
+		if strings.HasPrefix(name, "mypack/") {
+			pack = append(pack, name)
+		}
+		bundled[name] = true
+	}
+	if want := []string{"mypack/http/server.bt", "mypack/latency.bt", "mypack/probes.stp"}; !reflect.DeepEqual(pack, want) {
+		t.Errorf("got pack templates %v, want %v", pack, want)
+	}
+	for _, name := range []string{"latency.bt", "http/server.bt", "latency.py.tmpl", "skeleton.stp"} {
+		if !bundled[name] {
+			t.Errorf("bundled template %s isn't listed", name)
+		}
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("names aren't sorted: %v", names)
+	}
+}
@@ -0,0 +1,161 @@
+package gen
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/stevenjohnstone/go-bpf-gen/layout"
+	"github.com/stevenjohnstone/go-bpf-gen/schema"
+)
+
+// PlanVersion is the version of the JSON probe plan's schema; see
+// schema.Version
+const PlanVersion = schema.Version
+
+// Plan is what -format=json gives instead of a script: the probes a
+// template would attach for the symbol=<function or glob> arguments.
+type Plan = schema.Plan
+
+// ProbePlan is the entry and return probes of one function
+type ProbePlan = schema.Probe
+
+// ValuePlan is where a parameter or result is found
+type ValuePlan = schema.Value
+
+// Plan resolves the symbol arguments the way the template helpers do.
+func (t Target) Plan() (*Plan, error) {
+	symbols, err := t.ExpandSymbols(t.Arguments("symbol"))
+	if err != nil {
+		return nil, err
+	}
+	if len(symbols) == 0 {
+		return nil, errors.New("a probe plan needs at least one symbol=<function or glob>")
+	}
+	plan := &Plan{
+		Version:    PlanVersion,
+		Executable: t.ExePath,
+		GoVersion:  t.GoVersion(),
+		Arch:       t.GoArch(),
+		RegsABI:    t.RegsABI,
+		ABISource:  t.abi.source,
+	}
+	// the IDs are left out when there are none
+	plan.BuildID, _ = elfBuildID(t.bin.exe.elf)
+	plan.GoBuildID, _ = goBuildID(t.bin.exe.elf)
+	dwarf := t.HasDWARF()
+	plan.Probes = make([]ProbePlan, len(symbols))
+	err = forEachSymbol(symbols, t.opts.jobs, func(i int, symbol string) error {
+		probe, err := t.probePlan(symbol, dwarf)
+		plan.Probes[i] = probe
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// probePlan resolves the probes of one function
+func (t Target) probePlan(symbol string, dwarf bool) (ProbePlan, error) {
+	var err error
+	probe := ProbePlan{Symbol: symbol}
+	if regs, ok := t.abi.symbols[symbol]; ok {
+		probe.RegsABI = &regs
+		t = t.ABIFor(symbol)
+	}
+	if probe.Address, err = t.SymbolAddress(symbol); err != nil {
+		return probe, err
+	}
+	if probe.FileOffset, err = t.fileOffset(probe.Address); err != nil {
+		return probe, err
+	}
+	if probe.Size, err = t.SymbolSize(symbol); err != nil {
+		return probe, err
+	}
+	if probe.ReturnOffsets, err = t.SymbolReturns(symbol); err != nil {
+		// functions such as runtime.throw never return
+		probe.ReturnOffsets = []int{}
+	}
+	if !dwarf {
+		return probe, nil
+	}
+	params, err := t.Params(symbol)
+	if err != nil && !errors.Is(err, layout.ErrFunctionNotFound) {
+		return probe, err
+	}
+	results, err := t.Results(symbol)
+	if err != nil && !errors.Is(err, layout.ErrFunctionNotFound) {
+		return probe, err
+	}
+	// with the register ABI the arguments and results it passes on the
+	// stack are found as the stack ABI finds all of them
+	stack := t
+	stack.RegsABI = false
+	argWords := stackWords(stackParams(params, t.RegsABI))
+	if probe.Args, err = t.valuePlans(params, t.Arg, stack.Arg); err != nil {
+		return probe, err
+	}
+	probe.Results, err = t.valuePlans(results,
+		func(i int) (string, error) { return t.Ret(argWords, i) },
+		func(i int) (string, error) { return stack.Ret(argWords, i) })
+	return probe, err
+}
+
+// stackParams gives those of params passed on the stack: all of them with
+// the stack ABI and those with Stack set with the register ABI
+func stackParams(params []layout.Param, regsABI bool) []layout.Param {
+	if !regsABI {
+		return params
+	}
+	var stack []layout.Param
+	for _, p := range params {
+		if p.Stack {
+			stack = append(stack, p)
+		}
+	}
+	return stack
+}
+
+// valuePlans gives the locations of values using location, which is Arg
+// or Ret, and stackLocation for those the register ABI passes on the
+// stack, which is Arg or Ret for the stack ABI.
+func (t Target) valuePlans(values []layout.Param, location, stackLocation func(int) (string, error)) ([]ValuePlan, error) {
+	plans := make([]ValuePlan, len(values))
+	for i, v := range values {
+		plans[i] = ValuePlan{
+			Name:      v.Name,
+			Type:      v.Type,
+			Kind:      v.Kind,
+			Word:      v.Word,
+			Words:     v.Words,
+			Locations: []string{},
+		}
+		word, at := v.Word, location
+		if t.RegsABI && v.Stack {
+			word, at = v.Offset/8, stackLocation
+		}
+		if word < 0 {
+			continue
+		}
+		for w := word; w < word+v.Words; w++ {
+			l, err := at(w)
+			if err != nil {
+				return nil, err
+			}
+			plans[i].Locations = append(plans[i].Locations, l)
+		}
+	}
+	return plans, nil
+}
+
+// writePlan writes the plan as indented JSON.
+func (t Target) writePlan(w io.Writer) error {
+	plan, err := t.Plan()
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(plan)
+}
@@ -0,0 +1,175 @@
+//go:build linux && cgo && amd64
+
+package gen_test
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+)
+
+// serve is the function the plugin fixture exports
+const serve = "github.com/stevenjohnstone/go-bpf-gen/gen/testdata/plugin/handlers.Serve"
+
+// buildPlugin builds the plugin fixture, with ldflags, and its host into
+// dir. Tests are skipped if there's no go command or C compiler to build
+// them with.
+func buildPlugin(t *testing.T, dir, ldflags string) (so, host string) {
+	t.Helper()
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command to build the fixture with")
+	}
+	cc, err := exec.Command(goCmd, "env", "CC").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// CC may have flags after the compiler
+	if fields := strings.Fields(string(cc)); len(fields) == 0 || !hasCommand(fields[0]) {
+		t.Skip("no C compiler to build plugins with")
+	}
+	so = filepath.Join(dir, "handlers.so")
+	host = filepath.Join(dir, "host")
+	for _, build := range [][]string{
+		{"-buildmode=plugin", "-ldflags=" + ldflags, "-o", so, "./testdata/plugin/handlers"},
+		{"-o", host, "./testdata/plugin/host"},
+	} {
+		cmd := exec.Command(goCmd, append([]string{"build"}, build...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("building fixture: %v\n%s", err, out)
+		}
+	}
+	return so, host
+}
+
+func hasCommand(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// TestPlugin checks the uprobe_events definitions for a Go plugin, with its
+// symbol table and stripped, have the file offsets in the .so of Serve and
+// its return instructions and read arguments with the register ABI. Its
+// symbols' addresses are relative to where it's loaded.
+func TestPlugin(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		ldflags string
+	}{
+		{"symbols", ""},
+		{"stripped", "-s"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			so, _ := buildPlugin(t, t.TempDir(), test.ldflags)
+			file, err := elf.Open(so)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file.Close()
+			if file.Type != elf.ET_DYN {
+				t.Fatalf("%s is %s, not a shared object", so, file.Type)
+			}
+			target, err := gen.NewTarget(so, gen.WithFormat(gen.FormatUprobeEvents))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+			if !target.RegsABI {
+				t.Error("arguments aren't read with the register ABI")
+			}
+			script, err := gen.GenerateString("probes.events.tmpl", target, map[string][]string{"symbol": {serve}, "args": {"1"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := elfFunctions(t, so, serve)[serve]
+			returns, err := target.SymbolReturns(serve)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(returns) < 2 {
+				t.Fatalf("got returns %v, want one for each of Serve's", returns)
+			}
+			events := 0
+			for _, line := range strings.Split(script, "\n") {
+				if !strings.HasPrefix(line, "p:") {
+					continue
+				}
+				events++
+				m := uprobeEvent.FindStringSubmatch(line)
+				if m == nil {
+					t.Fatalf("malformed event %q", line)
+				}
+				if m[2] != so {
+					t.Errorf("%s: the path is %s, want %s", m[1], m[2], so)
+				}
+				offset, err := strconv.ParseUint(m[3], 16, 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.Contains(m[1], "_return") {
+					if offset != f.offset || m[4] != " arg0=%ax" {
+						t.Errorf("%s is at 0x%x reading%s, want 0x%x reading arg0=%%ax", m[1], offset, m[4], f.offset)
+					}
+					continue
+				}
+				// C3 is amd64's RET
+				if offset < f.offset || offset-f.offset >= f.size || f.data[offset-f.offset] != 0xc3 {
+					t.Errorf("%s is at 0x%x, not a RET in Serve at 0x%x", m[1], offset, f.offset)
+				}
+			}
+			if events != 1+len(returns) {
+				t.Errorf("got %d events, want %d:\n%s", events, 1+len(returns), script)
+			}
+		})
+	}
+}
+
+// TestPluginLibrary checks the plugin loaded by its host process is probed
+// through the process's root with the host process's pid
+func TestPluginLibrary(t *testing.T) {
+	so, host := buildPlugin(t, t.TempDir(), "")
+	cmd := exec.Command(host, so)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		stdin.Close()
+		cmd.Wait()
+	}()
+	if _, err := bufio.NewReader(stdout).ReadString('\n'); err != nil {
+		t.Fatalf("host never got ready: %v", err)
+	}
+
+	pid := cmd.Process.Pid
+	target, err := gen.NewTarget(fmt.Sprintf("pid:%d", pid), gen.WithArguments(map[string][]string{"library": {"handlers"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	if want := fmt.Sprintf("/proc/%d/root%s", pid, so); target.ExePath != want || target.Pid != pid {
+		t.Errorf("got %s for process %d, want %s for process %d", target.ExePath, target.Pid, want, pid)
+	}
+	if _, err := target.SymbolAddress(serve); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := gen.NewTarget(fmt.Sprintf("pid:%d", pid), gen.WithArguments(map[string][]string{"library": {"missing.so"}})); err == nil ||
+		!strings.Contains(err.Error(), "hasn't mapped a file called missing.so") {
+		t.Errorf("got %v for a library the process hasn't loaded", err)
+	}
+}
@@ -0,0 +1,80 @@
+package gen
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// forEachSymbol calls resolve for each symbol using up to jobs goroutines.
+// Symbols are resolved independently so one failing doesn't stop the
+// others; the errors are collected into one listing each symbol which
+// failed in the order given.
+func forEachSymbol(symbols []string, jobs int, resolve func(i int, symbol string) error) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	if jobs > len(symbols) {
+		jobs = len(symbols)
+	}
+	errs := make([]error, len(symbols))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for j := 0; j < jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = resolve(i, symbols[i])
+			}
+		}()
+	}
+	for i := range symbols {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return symbolErrors(symbols, errs)
+}
+
+// symbolErrors combines the errors from resolving symbols
+func symbolErrors(symbols []string, errs []error) error {
+	var failed []string
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		// errors looking the symbol up already name it
+		if strings.HasPrefix(err.Error(), symbols[i]+": ") {
+			failed = append(failed, err.Error())
+		} else {
+			failed = append(failed, fmt.Sprintf("%s: %s", symbols[i], err))
+		}
+	}
+	switch len(failed) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%s", failed[0])
+	}
+	return fmt.Errorf("%d of %d symbols failed:\n  %s", len(failed), len(symbols), strings.Join(failed, "\n  "))
+}
+
+// prefetch resolves the addresses, return offsets and, with DWARF data,
+// parameters and results of symbols concurrently so that templates probing
+// many functions find them cached. Errors are left for the template's own
+// calls to report.
+func (t Target) prefetch(symbols []string) {
+	dwarf := t.HasDWARF()
+	forEachSymbol(symbols, t.opts.jobs, func(_ int, symbol string) error {
+		if _, err := t.SymbolAddress(symbol); err != nil {
+			return err
+		}
+		t.SymbolReturns(symbol)
+		if function, err := t.paramsFunction(symbol); err == nil && dwarf {
+			t.bin.params(function, false)
+			t.bin.params(function, true)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,72 @@
+package gen_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+)
+
+// resolved is what's found for a symbol
+func resolved(target *gen.Target, symbol string) string {
+	address, err := target.SymbolAddress(symbol)
+	returns, retErr := target.SymbolReturns(symbol)
+	function, fnErr := target.FunctionAt(address)
+	params, paramsErr := target.Params(symbol)
+	return fmt.Sprint(address, err, returns, retErr, function, fnErr, params, paramsErr)
+}
+
+// TestConcurrentResolution resolves 500 functions of the fixture at once,
+// through the worker pool making a probe plan and each in its own
+// goroutine, and checks what's found is what's found one at a time. Run it
+// with -race to check the target's caches are safe to share.
+func TestConcurrentResolution(t *testing.T) {
+	candidates, _, _ := scatteredFunctions(t, 800)
+	serial := newFixtureTarget(t)
+	var symbols []string
+	want := map[string]string{}
+	for _, symbol := range candidates {
+		// probe plans need the return offsets, which aren't found for
+		// assembly functions which can't be decoded
+		if _, err := serial.SymbolReturns(symbol); err != nil || len(symbols) == 500 {
+			continue
+		}
+		symbols = append(symbols, symbol)
+		want[symbol] = resolved(serial, symbol)
+	}
+	if len(symbols) < 500 {
+		t.Fatalf("only %d functions to resolve", len(symbols))
+	}
+
+	args := map[string][]string{"symbol": symbols}
+	plans := map[int]string{}
+	for _, jobs := range []int{1, 32} {
+		target := newFixtureTarget(t, gen.WithFormat(gen.FormatJSON), gen.WithJobs(jobs))
+		plan, err := gen.GenerateString("", target, args)
+		if err != nil {
+			t.Fatalf("%d jobs: %s", jobs, err)
+		}
+		plans[jobs] = plan
+	}
+	if plans[1] != plans[32] {
+		t.Error("the probe plan made with 32 jobs differs from that made with 1")
+	}
+
+	target := newFixtureTarget(t)
+	got := make([]string, len(symbols))
+	var wg sync.WaitGroup
+	for i, symbol := range symbols {
+		wg.Add(1)
+		go func(i int, symbol string) {
+			defer wg.Done()
+			got[i] = resolved(target, symbol)
+		}(i, symbol)
+	}
+	wg.Wait()
+	for i, symbol := range symbols {
+		if got[i] != want[symbol] {
+			t.Errorf("%s: got %s concurrently, want %s", symbol, got[i], want[symbol])
+		}
+	}
+}
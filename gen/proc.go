@@ -0,0 +1,168 @@
+package gen
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// resolveTarget resolves a target given as pid:<pid>, unit:<systemd unit> or
+// container:<name or id> to the pid of the process and its executable
+// through its root directory, /proc/<pid>/root/<path>. For a process in a
+// container <path> is the path inside the container so the result is a path
+// the host can both read and attach probes to. A process chrooted to a
+// directory the host can see has its executable named by its path on the
+// host, which is used as it is. The path only stays valid while the process
+// is running: once it exits the probes have to be generated again for the
+// next process. The process in a container is its main process unless
+// process=<command name> is given. With library=<name> the target is the
+// shared object, such as a Go plugin, the process has mapped whose file name
+// is or starts with <name> e.g. library=handlers.so. Other targets are
+// returned as they are with a pid of 0.
+func resolveTarget(target string, arguments func(string) []string) (string, int, error) {
+	var pid int
+	switch {
+	case strings.HasPrefix(target, "pid:"):
+		var err error
+		pid, err = strconv.Atoi(strings.TrimPrefix(target, "pid:"))
+		if err != nil || pid <= 0 {
+			return "", 0, fmt.Errorf("malformed target %s, must be of form pid:<pid>", target)
+		}
+	case strings.HasPrefix(target, "unit:"):
+		var err error
+		if pid, err = unitPid(strings.TrimPrefix(target, "unit:")); err != nil {
+			return "", 0, err
+		}
+	case strings.HasPrefix(target, "container:"):
+		var err error
+		pid, err = containerPid(strings.TrimPrefix(target, "container:"))
+		if err != nil {
+			return "", 0, err
+		}
+		if process := arguments("process"); len(process) > 0 {
+			if pid, err = containerProcess(pid, process[0]); err != nil {
+				return "", 0, err
+			}
+		}
+	default:
+		return target, 0, nil
+	}
+	proc := fmt.Sprintf("/proc/%d", pid)
+	var exe string
+	var err error
+	if library := arguments("library"); len(library) > 0 {
+		exe, err = mappedLibrary(pid, library[0])
+	} else {
+		exe, err = os.Readlink(filepath.Join(proc, "exe"))
+	}
+	if err != nil {
+		return "", 0, procError(pid, err)
+	}
+	// the path is in the process's mount namespace
+	exe = strings.TrimSuffix(exe, " (deleted)")
+	path := filepath.Join(proc, "root", exe)
+	if _, err := os.Stat(path); err != nil {
+		// unless the process is chrooted to a directory this one can see,
+		// when the path is already this one's
+		if _, hostErr := os.Stat(exe); !errors.Is(err, os.ErrNotExist) || !filepath.IsAbs(exe) || hostErr != nil {
+			return "", 0, procError(pid, err)
+		}
+		path = exe
+	}
+	return path, pid, nil
+}
+
+// maxLinks is how many symbolic links executablePath follows, as many as
+// Linux does
+const maxLinks = 40
+
+// executablePath returns the real path of an executable given on the command
+// line. A name without a slash which isn't a file in the working directory
+// is looked up in PATH like a command and symbolic links are followed so
+// that the probes name the file the symbols are read from rather than e.g.
+// a link in /usr/local/bin to a versioned directory.
+func executablePath(target string) (string, error) {
+	path := target
+	if !strings.ContainsRune(target, filepath.Separator) {
+		if _, err := os.Stat(target); err != nil {
+			if found, lookErr := exec.LookPath(target); lookErr == nil {
+				path = found
+			}
+		}
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	for links := 0; ; links++ {
+		info, err := os.Lstat(path)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			// a missing file is reported when it's opened
+			return path, nil
+		}
+		if links == maxLinks {
+			return "", fmt.Errorf("too many symbolic links following %s", target)
+		}
+		link, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(path), link)
+		}
+		path = filepath.Clean(link)
+	}
+}
+
+// scriptError explains that a target which isn't an ELF file but a script,
+// such as a wrapper installed in the binary's place, isn't what's probed.
+// It's nil for other files.
+func scriptError(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if !strings.HasPrefix(line, "#!") || (err != nil && err != io.EOF) {
+		return nil
+	}
+	return fmt.Errorf("%s is a script run by %s; the target must be the ELF binary it runs", path, strings.TrimSpace(strings.TrimPrefix(line, "#!")))
+}
+
+// mappedLibrary returns the path of the first file mapped by process pid
+// whose name is or starts with library
+func mappedLibrary(pid int, library string) (string, error) {
+	maps, err := os.ReadFile(fmt.Sprintf("/proc/%d/maps", pid))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(maps), "\n") {
+		// address perms offset dev inode path
+		fields := strings.Fields(line)
+		if len(fields) < 6 || !strings.HasPrefix(fields[5], "/") {
+			continue
+		}
+		path := strings.Join(fields[5:], " ")
+		if strings.HasPrefix(filepath.Base(path), library) {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("process %d hasn't mapped a file called %s", pid, library)
+}
+
+func procError(pid int, err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("%w: reading the executable of process %d needs root or CAP_SYS_PTRACE", err, pid)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: is process %d running?", err, pid)
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package gen_test
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+)
+
+// TestProcessRoot runs the chroot fixture in a root directory of its own,
+// where it's /app/server, and checks a pid:<pid> target reads it and names it
+// in probes by a path the host has: /proc/<pid>/root/app/server when, as in a
+// container, the host can't see the path the process has and the host's path
+// when the process is only chrooted. Non-root users run the fixture in a user
+// namespace and the test is skipped where that isn't allowed.
+func TestProcessRoot(t *testing.T) {
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command to build the fixture with")
+	}
+	root := t.TempDir()
+	server := filepath.Join(root, "app", "server")
+	build := exec.Command(goCmd, "build", "-o", server, "./testdata/chroot")
+	build.Env = append(build.Environ(), "CGO_ENABLED=0")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building fixture: %v\n%s", err, out)
+	}
+
+	for _, test := range []struct {
+		name string
+		// command runs the fixture as the test needs
+		command func() *exec.Cmd
+		// path is the fixture's path in the probes for process pid
+		path func(pid int) string
+	}{
+		{
+			name: "pivot_root",
+			command: func() *exec.Cmd {
+				cmd := exec.Command(server)
+				cmd.Env = append(os.Environ(), "FIXTURE_ROOT="+root)
+				cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS}
+				return cmd
+			},
+			path: func(pid int) string { return fmt.Sprintf("/proc/%d/root/app/server", pid) },
+		},
+		{
+			name: "chroot",
+			command: func() *exec.Cmd {
+				cmd := exec.Command("/app/server")
+				cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: root}
+				return cmd
+			},
+			path: func(int) string { return server },
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cmd := test.command()
+			if os.Getuid() != 0 {
+				cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+				cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{HostID: os.Getuid(), Size: 1}}
+				cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{HostID: os.Getgid(), Size: 1}}
+			}
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cmd.Start(); err != nil {
+				t.Skipf("can't run the fixture in a root directory of its own: %v", err)
+			}
+			defer func() {
+				stdin.Close()
+				cmd.Wait()
+			}()
+			// a fixture made to pivot_root runs from the host's root until
+			// it's ready
+			if _, err := bufio.NewReader(stdout).ReadString('\n'); err != nil {
+				t.Fatalf("fixture never got ready: %v", err)
+			}
+			pid := cmd.Process.Pid
+			target, err := gen.NewTarget(fmt.Sprintf("pid:%d", pid))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+			want := test.path(pid)
+			if target.ExePath != want || target.Pid != pid {
+				t.Errorf("got %s for process %d, want %s for process %d", target.ExePath, target.Pid, want, pid)
+			}
+			if _, err := target.SymbolAddress("main.serve"); err != nil {
+				t.Fatal(err)
+			}
+			script, err := gen.GenerateString("latency.bt", target, map[string][]string{"symbol": {"main.serve"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if probe := fmt.Sprintf(`uprobe:%s:"main.serve"`, want); !strings.Contains(script, probe) {
+				t.Errorf("script doesn't probe %s:\n%s", probe, script)
+			}
+		})
+	}
+}
+
+// TestProcessRootErrors checks a pid:<pid> target which can't be read says
+// why
+func TestProcessRootErrors(t *testing.T) {
+	for _, test := range []struct {
+		target, want string
+	}{
+		{"pid:0", "malformed target pid:0, must be of form pid:<pid>"},
+		{"pid:server", "malformed target pid:server, must be of form pid:<pid>"},
+		// above the largest pid Linux allows
+		{"pid:4194305", "is process 4194305 running?"},
+	} {
+		_, err := gen.NewTarget(test.target)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error containing %q", test.target, err, test.want)
+		}
+	}
+	if _, err := gen.NewTarget("pid:4194305"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got %v, want an ErrNotExist", err)
+	}
+}
@@ -0,0 +1,45 @@
+package gen_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+)
+
+// TestReproducible renders every bundled template with each of its examples
+// twice against new targets, resolving the symbols prefetched one at a time
+// and then with a pool of workers, and checks the scripts are byte for byte
+// the same
+func TestReproducible(t *testing.T) {
+	exe := fixture(t)
+	results, err := gen.SelfTest(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if result.Status != gen.SelfTestPass {
+			continue
+		}
+		result := result
+		t.Run(strings.Join(append([]string{result.Template}, result.Args...), " "), func(t *testing.T) {
+			kv := map[string][]string{}
+			for _, arg := range result.Args {
+				k, v, _ := strings.Cut(arg, "=")
+				kv[k] = append(kv[k], v)
+			}
+			var scripts []string
+			for _, jobs := range []int{1, 8} {
+				target := newFixtureTarget(t, gen.WithFormat(gen.FormatFor(result.Template)), gen.WithJobs(jobs))
+				script, err := gen.GenerateString(result.Template, target, kv)
+				if err != nil {
+					t.Fatalf("%d jobs: %s", jobs, err)
+				}
+				scripts = append(scripts, script)
+			}
+			if scripts[0] != scripts[1] {
+				t.Errorf("with 8 jobs\n%s\nwith 1\n%s", scripts[1], scripts[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package gen
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// runtimeOffsets are the offsets of fields of runtime structs on 64 bit
+// architectures by Go release, for targets without DWARF data. They were
+// read from the DWARF data of binaries built by each release; patch
+// releases don't change the runtime's structs.
+var runtimeOffsets = map[string]map[string]int{
+	"go1.21": {
+		"g.stack":                             0,
+		"g.m":                                 48,
+		"g.sched":                             56,
+		"g.atomicstatus":                      144,
+		"g.goid":                              152,
+		"g.gopc":                              280,
+		"g.startpc":                           296,
+		"stack.lo":                            0,
+		"stack.hi":                            8,
+		"m.g0":                                0,
+		"m.procid":                            72,
+		"m.curg":                              192,
+		"m.p":                                 208,
+		"m.id":                                232,
+		"p.id":                                0,
+		"p.status":                            4,
+		"p.m":                                 56,
+		"gcControllerState.gcPercentHeapGoal": 72,
+		"gcControllerState.heapLive":          104,
+		"gcControllerState.heapMarked":        152,
+		"hmap.count":                          0,
+		"hmap.B":                              9,
+		"pollDesc.fd":                         8,
+	},
+	"go1.27": {
+		"g.stack":                             0,
+		"g.m":                                 48,
+		"g.sched":                             56,
+		"g.atomicstatus":                      144,
+		"g.goid":                              152,
+		"g.gopc":                              288,
+		"g.startpc":                           304,
+		"stack.lo":                            0,
+		"stack.hi":                            8,
+		"m.g0":                                0,
+		"m.procid":                            64,
+		"m.curg":                              184,
+		"m.p":                                 208,
+		"m.id":                                232,
+		"p.id":                                0,
+		"p.status":                            4,
+		"p.m":                                 48,
+		"gcControllerState.gcPercentHeapGoal": 72,
+		"gcControllerState.heapLive":          104,
+		"gcControllerState.heapMarked":        152,
+		"pollDesc.fd":                         8,
+	},
+}
+
+// goRelease returns the release of a Go version e.g. go1.21 for go1.21.13
+func goRelease(version string) string {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// RuntimeOffset returns the offset of field in the runtime struct typ e.g.
+// "g" "goid" for templates reading the runtime's internals. The target's
+// DWARF data is used when it has it and otherwise a table of the offsets in
+// the Go releases listed by RuntimeOffsetReleases. A target built by a
+// release which isn't in the table fails, with an error naming the
+// releases which are, rather than being given another release's offset.
+func (t Target) RuntimeOffset(typ, field string) (int, error) {
+	if t.HasDWARF() {
+		return t.StructOffset("runtime."+typ, field)
+	}
+	version := t.GoVersion()
+	if version == "" {
+		return 0, fmt.Errorf("runtime.%s.%s: the target has neither DWARF data nor build info giving its Go version", typ, field)
+	}
+	switch t.GoArch() {
+	case "amd64", "arm64", "ppc64", "ppc64le", "s390x":
+	default:
+		return 0, fmt.Errorf("runtime.%s.%s: no offsets for %s without DWARF data", typ, field, t.GoArch())
+	}
+	release := goRelease(version)
+	offsets, ok := runtimeOffsets[release]
+	if !ok {
+		return 0, fmt.Errorf("runtime.%s.%s: a %s target needs DWARF data, from the target or a debug file, for the runtime's offsets: without it only %s targets are supported", typ, field, version, releaseList(RuntimeOffsetReleases()))
+	}
+	offset, ok := offsets[typ+"."+field]
+	if !ok {
+		return 0, fmt.Errorf("runtime.%s.%s: no offset for %s without DWARF data", typ, field, release)
+	}
+	return offset, nil
+}
+
+// HasRuntimeOffset is true if RuntimeOffset has the offset of field in the
+// runtime struct typ for the target, for templates which can do without
+// it e.g. netpoll.bt leaving out the file descriptor waited on
+func (t Target) HasRuntimeOffset(typ, field string) bool {
+	_, err := t.RuntimeOffset(typ, field)
+	return err == nil
+}
+
+// releaseList lists releases as "go1.21 and go1.27"
+func releaseList(releases []string) string {
+	if len(releases) < 2 {
+		return strings.Join(releases, "")
+	}
+	return strings.Join(releases[:len(releases)-1], ", ") + " and " + releases[len(releases)-1]
+}
+
+// RuntimeOffsetReleases returns the Go releases RuntimeOffset has offsets
+// for without DWARF data
+func RuntimeOffsetReleases() []string {
+	releases := make([]string, 0, len(runtimeOffsets))
+	for release := range runtimeOffsets {
+		releases = append(releases, release)
+	}
+	sort.Strings(releases)
+	return releases
+}
+
+// GoID returns a bpftrace expression reading the goroutine ID of the
+// runtime.g at the address given by the expression g
+func (t Target) GoID(g string) (string, error) {
+	offset, err := t.RuntimeOffset("g", "goid")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("*(uint64 *)(%s + %d)", g, offset), nil
+}
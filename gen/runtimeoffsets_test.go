@@ -0,0 +1,118 @@
+package gen_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+	"github.com/stevenjohnstone/go-bpf-gen/testtarget"
+)
+
+// TestRuntimeOffsets checks the offsets RuntimeOffset has for targets
+// without DWARF data are those in the DWARF data of the fixture built with
+// each of goldenToolchains
+func TestRuntimeOffsets(t *testing.T) {
+	for _, toolchain := range goldenToolchains {
+		t.Run(toolchain, func(t *testing.T) {
+			target, err := gen.NewTarget(buildWithToolchain(t, toolchain))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+			version := target.GoVersion()
+			release := strings.Join(strings.SplitN(version, ".", 3)[:2], ".")
+			fields := gen.RuntimeOffsetFields(release)
+			if len(fields) == 0 {
+				t.Skipf("no offsets for %s, only for %s", release, strings.Join(gen.RuntimeOffsetReleases(), ", "))
+			}
+			stripped, err := testtarget.New("/srv/server", testtarget.Binary{GoVersion: version})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stripped.Close()
+			for _, field := range fields {
+				typ, name, _ := strings.Cut(field, ".")
+				want, err := target.StructOffset("runtime."+typ, name)
+				if err != nil {
+					t.Errorf("%s: %s", field, err)
+					continue
+				}
+				got, err := stripped.RuntimeOffset(typ, name)
+				if err != nil {
+					t.Errorf("%s: %s", field, err)
+				} else if got != want {
+					t.Errorf("%s is at %d in %s, not %d", field, want, version, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRuntimeOffsetErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		b    testtarget.Binary
+		typ  string
+		want string
+	}{
+		{"unknown release", testtarget.Binary{GoVersion: "go1.12.17"}, "g",
+			"runtime.g.goid: a go1.12.17 target needs DWARF data, from the target or a debug file, for the runtime's offsets: without it only go1.21 and go1.27 targets are supported"},
+		{"unknown field", testtarget.Binary{GoVersion: "go1.21.0"}, "sudog",
+			"runtime.sudog.goid: no offset for go1.21 without DWARF data"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, err := testtarget.New("/srv/server", test.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+			offset, err := target.RuntimeOffset(test.typ, "goid")
+			if err == nil || err.Error() != test.want {
+				t.Errorf("got %d, %v, want the error %s", offset, err, test.want)
+			}
+		})
+	}
+}
+
+// TestRuntimeOffsetTemplates checks the templates reading the runtime's
+// structs for targets without DWARF data: gc.bt fails for releases without
+// offsets unless told not to read the heap sizes with heap=0, and
+// netpoll.bt leaves out the file descriptors waited on
+func TestRuntimeOffsetTemplates(t *testing.T) {
+	b := goldenBinary(false)
+	b.Functions = append(b.Functions,
+		testtarget.Function{Name: "internal/poll.runtime_pollWait", Returns: []int{40}},
+		testtarget.Function{Name: "runtime.netpollready", Returns: []int{90}},
+		testtarget.Function{Name: "runtime.gcController", Size: 1024},
+		testtarget.Function{Name: "runtime.memstats", Size: 1024},
+	)
+	render := func(version, template string, args map[string][]string) (string, error) {
+		b.GoVersion = version
+		target, err := testtarget.New("/srv/server", b, gen.WithStrictArguments())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer target.Close()
+		return gen.GenerateString(template, target, args)
+	}
+	for _, version := range []string{"go1.17.13", "go1.18.10", "go1.20.14"} {
+		_, err := render(version, "gc.bt", nil)
+		if err == nil || !strings.Contains(err.Error(), "a "+version+" target needs DWARF data") || !strings.Contains(err.Error(), "only go1.21 and go1.27 targets are supported") {
+			t.Errorf("gc.bt for %s: got %v, want the error naming the releases supported", version, err)
+		}
+		if _, err := render(version, "gc.bt", map[string][]string{"heap": {"0"}}); err != nil {
+			t.Errorf("gc.bt heap=0 for %s: %v", version, err)
+		}
+	}
+	for version, fd := range map[string]bool{"go1.20.14": false, "go1.21.13": true, "go1.27.1": true} {
+		script, err := render(version, "netpoll.bt", nil)
+		if err != nil {
+			t.Errorf("netpoll.bt for %s: %v", version, err)
+			continue
+		}
+		if got := strings.Contains(script, "@fd[$gid, pid] = "); got != fd {
+			t.Errorf("netpoll.bt for %s reads file descriptors: %v, want %v:\n%s", version, got, fd, script)
+		}
+	}
+}
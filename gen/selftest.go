@@ -0,0 +1,205 @@
+package gen
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/stevenjohnstone/go-bpf-gen/templates"
+)
+
+// selfTestFixture is the source of the program the bundled templates are
+// rendered against by SelfTest
+//
+//go:embed testdata/selftest/main.go
+var selfTestFixture []byte
+
+// BuildSelfTestFixture builds the selftest's fixture program in dir with
+// the go command on the PATH and returns the path of the executable
+func BuildSelfTestFixture(dir string) (string, error) {
+	files := map[string][]byte{
+		"main.go": selfTestFixture,
+		"go.mod":  []byte("module selftest\n\ngo 1.18\n"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			return "", err
+		}
+	}
+	cmd := exec.Command("go", "build", "-o", "fixture", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOWORK=off", "GOFLAGS=")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to build the selftest fixture: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return filepath.Join(dir, "fixture"), nil
+}
+
+// The results of rendering a template in the selftest
+const (
+	SelfTestPass = "pass"
+	SelfTestFail = "fail"
+	// SelfTestSkip is for templates which declared with Requires that they
+	// can't be rendered for the fixture
+	SelfTestSkip = "skip"
+)
+
+// SelfTestResult is the result of rendering a bundled template with one of
+// its examples
+type SelfTestResult struct {
+	Template string
+	// Args are the example's key=value arguments
+	Args   []string
+	Status string
+	// Err is why the template failed or was skipped
+	Err error
+	// DryRun is true if bpftrace --dry-run checked the script too
+	DryRun bool
+}
+
+// SelfTest renders every bundled template against the executable exe with
+// each of the examples it declares with Example, or once without arguments
+// if it declares none, and checks the scripts are well formed. Scripts for
+// bpftrace are checked with bpftrace --dry-run too when it's on the PATH
+// and it's run as root. Arguments the template doesn't read fail it.
+func SelfTest(exe string, opts ...Option) ([]SelfTestResult, error) {
+	names, err := templateNames(templates.FS, "")
+	if err != nil {
+		return nil, err
+	}
+	target, err := NewTarget(exe, append(opts, WithStrictArguments())...)
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+	var results []SelfTestResult
+	for _, name := range names {
+		examples := [][]string{nil}
+		parsed, err := target.parseTemplate(name)
+		if err != nil {
+			results = append(results, SelfTestResult{Template: name, Status: SelfTestFail, Err: err})
+			continue
+		}
+		if found := templateExamples(parsed.Template); len(found) > 0 {
+			examples = found
+		}
+		for _, args := range examples {
+			results = append(results, target.selfTest(name, args))
+		}
+	}
+	return results, nil
+}
+
+// selfTest renders the template called name with the key=value arguments
+// args and checks the script
+func (t *Target) selfTest(name string, args []string) SelfTestResult {
+	result := SelfTestResult{Template: name, Args: args, Status: SelfTestFail}
+	kv := map[string][]string{}
+	for _, arg := range args {
+		k, v, ok := strings.Cut(arg, "=")
+		if !ok {
+			result.Err = fmt.Errorf("bad example argument %s, must be of form key=value", arg)
+			return result
+		}
+		kv[k] = append(kv[k], v)
+	}
+	var script strings.Builder
+	if err := Generate(&script, name, t, kv); err != nil {
+		result.Err = err
+		var requirement *RequirementError
+		if errors.As(err, &requirement) {
+			result.Status = SelfTestSkip
+		}
+		return result
+	}
+	if err := lintScript(t.Format, script.String()); err != nil {
+		result.Err = err
+		return result
+	}
+	if t.Format == FormatBpftrace && os.Geteuid() == 0 {
+		if bpftrace, err := exec.LookPath("bpftrace"); err == nil {
+			result.DryRun = true
+			if err := dryRun(bpftrace, script.String()); err != nil {
+				result.Err = err
+				return result
+			}
+		}
+	}
+	result.Status = SelfTestPass
+	return result
+}
+
+// lintScript checks the structure of a script rendered in format: that no
+// template value was missing and that its blocks are balanced
+func lintScript(format, script string) error {
+	if i := strings.Index(script, "<no value>"); i >= 0 {
+		return fmt.Errorf("line %d has <no value> for a missing template value", strings.Count(script[:i], "\n")+1)
+	}
+	switch format {
+	case FormatBpftrace:
+		blocks, rest, err := splitBlocks(script)
+		if err != nil {
+			return err
+		}
+		if len(blocks) == 0 {
+			return errors.New("script has no probes")
+		}
+		for _, b := range blocks {
+			if strings.TrimSpace(b.header) == "" {
+				return errors.New("block without a probe")
+			}
+		}
+		if _, trailing := splitHeader(rest); strings.TrimSpace(trailing) != "" {
+			return fmt.Errorf("text after the last block: %s", strings.TrimSpace(trailing))
+		}
+	case FormatLibbpf, FormatSystemTap:
+		depth := 0
+		scanScript(script, func(i int) bool {
+			switch script[i] {
+			case '{':
+				depth++
+			case '}':
+				depth--
+			}
+			return depth >= 0
+		})
+		if depth != 0 {
+			return errors.New("unbalanced braces in script")
+		}
+	case FormatJSON:
+		if !json.Valid([]byte(script)) {
+			return errors.New("probe plan isn't valid JSON")
+		}
+	}
+	if strings.TrimSpace(script) == "" {
+		return errors.New("script is empty")
+	}
+	return nil
+}
+
+// dryRun has bpftrace parse and check script without running it
+func dryRun(bpftrace, script string) error {
+	f, err := os.CreateTemp("", "selftest.*.bt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(script); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	out, err := exec.Command(bpftrace, "--dry-run", f.Name()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("bpftrace --dry-run: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
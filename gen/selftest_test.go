@@ -0,0 +1,33 @@
+package gen_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+)
+
+// TestSelfTest renders every bundled template with each of its examples
+// against the fixture as the selftest command does
+func TestSelfTest(t *testing.T) {
+	exe := fixture(t)
+	results, err := gen.SelfTest(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 {
+		t.Fatal("no templates were rendered")
+	}
+	for _, result := range results {
+		name := strings.Join(append([]string{result.Template}, result.Args...), " ")
+		t.Run(name, func(t *testing.T) {
+			switch result.Status {
+			case gen.SelfTestPass:
+			case gen.SelfTestSkip:
+				t.Skip(result.Err)
+			default:
+				t.Error(result.Err)
+			}
+		})
+	}
+}
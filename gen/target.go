@@ -0,0 +1,1179 @@
+package gen
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stevenjohnstone/go-bpf-gen/layout"
+	"github.com/stevenjohnstone/go-bpf-gen/ret"
+)
+
+type Target struct {
+	ExePath   string
+	Arguments func(string) []string
+	RegsABI   bool
+	// Pid is the process given by a pid:<pid> or container:<name> target
+	// for templates to filter on, or 0
+	Pid int
+	// Unit is the systemd unit given by a unit:<name> target for templates
+	// to label output with, or empty
+	Unit string
+	// Pod is the Kubernetes container given by a k8s:<namespace>/<pod>
+	// target for templates to label output with
+	Pod Pod
+	// ServicePrefix names the target in a -fleet script, where maps are
+	// prefixed with it. It's empty otherwise.
+	ServicePrefix string
+	// Format is the output format the template is written in; see
+	// formats.go
+	Format string
+	// meta is what the template declares for -wrapper; see wrapper.go
+	meta *templateMeta
+	// debugFile has the target's symbols and DWARF data when they've
+	// been fetched from debuginfod; see debuginfod.go
+	debugFile string
+	bin       *targetFiles
+	// opts are the options given to NewTarget
+	opts options
+	// maps is the prefix of the maps of the script being rendered; see
+	// maps.go
+	maps string
+	// args are the key=value arguments behind Arguments, recording which
+	// were read; see arguments.go
+	args *arguments
+	// abi is how RegsABI was decided; see abimode.go
+	abi abiState
+	// addresses are the code given by address in symbol= arguments by
+	// name; see address.go
+	addresses map[string]addressSymbol
+}
+
+func (t Target) SymbolReturns(symbol string) ([]int, error) {
+	if a, ok := t.addresses[symbol]; ok {
+		return t.addressReturns(a)
+	}
+	if v, ok := t.bin.returns(symbol); ok {
+		return v, nil
+	}
+	s, err := t.symbol(symbol)
+	if err != nil {
+		return nil, err
+	}
+	// the code is read from the target as a separate debug file has
+	// none
+	code, err := t.bin.exe.code(s)
+	if err != nil {
+		return nil, err
+	}
+	f := t.bin.exe.elf
+	offsets, err := ret.DecodeMachine(code, f.Machine, f.ByteOrder)
+	if err != nil {
+		return nil, err
+	}
+	t.bin.setReturns(symbol, offsets)
+	return offsets, nil
+}
+
+func (t Target) SymbolReturnsNoFail(symbol string) []int {
+	v, err := t.SymbolReturns(symbol)
+	if err != nil {
+		return []int{1}
+	}
+	return v
+}
+
+// HasReturns is true if SymbolReturns finds return offsets for symbol.
+// Functions such as runtime.throw never return so templates probing
+// symbols matched by globs skip them.
+func (t Target) HasReturns(symbol string) bool {
+	offsets, err := t.SymbolReturns(symbol)
+	return err == nil && len(offsets) > 0
+}
+
+// elfSymbols returns the symbol table of f followed by the symbols it
+// defines which are only in its dynamic symbol table. Shared objects such as
+// Go plugins export symbols in the dynamic symbol table which is kept when
+// they're stripped.
+func elfSymbols(f *elf.File) ([]elf.Symbol, error) {
+	symbols, err := f.Symbols()
+	dynamic, dynErr := f.DynamicSymbols()
+	if dynErr != nil {
+		return symbols, err
+	}
+	seen := map[string]bool{}
+	for _, s := range symbols {
+		seen[s.Name] = true
+	}
+	for _, s := range dynamic {
+		if s.Section != elf.SHN_UNDEF && !seen[s.Name] {
+			symbols = append(symbols, s)
+		}
+	}
+	if len(symbols) == 0 {
+		return nil, err
+	}
+	return symbols, nil
+}
+
+func (t Target) symbol(name string) (elf.Symbol, error) {
+	if a, ok := t.addresses[name]; ok {
+		return a.Symbol, nil
+	}
+	s, err := t.bin.symbol(name)
+	if err == nil {
+		return s, nil
+	}
+	if errors.Is(err, ret.ErrSymbolNotFound) {
+		if callers, inlineErr := t.bin.inlinedCallers(name); inlineErr == nil && len(callers) > 0 {
+			return s, &InlinedError{Function: name, Callers: callers}
+		}
+	}
+	return s, fmt.Errorf("%s: %w", name, err)
+}
+
+// InlinedError is the error for a function which has no symbol because
+// every call to it was inlined
+type InlinedError struct {
+	Function string
+	// Callers are the functions it was inlined into
+	Callers []string
+}
+
+// maxCallers is how many of the functions an inlined function was inlined
+// into are given in its error
+const maxCallers = 5
+
+func (e *InlinedError) Error() string {
+	callers := e.Callers
+	more := ""
+	if len(callers) > maxCallers {
+		callers, more = callers[:maxCallers], fmt.Sprintf(" and %d more", len(callers)-maxCallers)
+	}
+	return fmt.Sprintf("%s has no symbol as every call to it was inlined, into %s%s; "+
+		"probe those instead or rebuild the target with //go:noinline on %s or with -gcflags=all=-l to stop inlining",
+		e.Function, strings.Join(callers, ", "), more, e.Function)
+}
+
+// Unwrap gives ret.ErrSymbolNotFound so that the error is still one of a
+// missing symbol
+func (e *InlinedError) Unwrap() error {
+	return ret.ErrSymbolNotFound
+}
+
+// HasSymbol returns true if the target's symbol table contains symbol
+func (t Target) HasSymbol(symbol string) bool {
+	if t.isAddressSymbol(symbol) {
+		return true
+	}
+	_, err := t.bin.symbol(symbol)
+	return err == nil
+}
+
+// SymbolAddress returns the virtual address of symbol
+func (t Target) SymbolAddress(symbol string) (uint64, error) {
+	s, err := t.symbol(symbol)
+	if err != nil {
+		return 0, err
+	}
+	return s.Value, nil
+}
+
+// FunctionAt returns the name of the function whose code includes address,
+// such as a code pointer read from a funcval. Templates which can't look up
+// every code pointer at run time with FuncNames name the few they need this
+// way.
+func (t Target) FunctionAt(address uint64) (string, error) {
+	s, err := t.bin.symbolData().function(address)
+	if err != nil {
+		return "", fmt.Errorf("no function at 0x%x", address)
+	}
+	return s.Name, nil
+}
+
+// SymbolSize returns the size of symbol in bytes. For functions, code
+// addresses from SymbolAddress up to but not including SymbolAddress plus
+// SymbolSize belong to the function.
+func (t Target) SymbolSize(symbol string) (uint64, error) {
+	s, err := t.symbol(symbol)
+	if err != nil {
+		return 0, err
+	}
+	return s.Size, nil
+}
+
+// Function is a function symbol in the target
+type Function struct {
+	Name    string
+	Address uint64
+}
+
+// Functions returns the function symbols whose names start with prefix
+// sorted by name and then address. Templates use these to build maps from
+// code pointers to names.
+func (t Target) Functions(prefix string) ([]Function, error) {
+	symbols, err := t.bin.symbolData().symbolTable()
+	if err != nil {
+		return nil, err
+	}
+	functions := []Function{}
+	for _, s := range symbols {
+		if elf.ST_TYPE(s.Info) == elf.STT_FUNC && strings.HasPrefix(s.Name, prefix) {
+			functions = append(functions, Function{Name: s.Name, Address: s.Value})
+		}
+	}
+	sort.Slice(functions, func(i, j int) bool {
+		if functions[i].Name != functions[j].Name {
+			return functions[i].Name < functions[j].Name
+		}
+		return functions[i].Address < functions[j].Address
+	})
+	return functions, nil
+}
+
+// FuncNames gives bpftrace statements for BEGIN filling @fnname with the
+// names of functions starting with prefix keyed by their code pointers.
+// Templates look up code pointers read from funcvals (see FuncvalPC), g
+// structs and the like in @fnname.
+func (t Target) FuncNames(prefix string) (string, error) {
+	functions, err := t.Functions(prefix)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n  // code pointers of functions starting with %q", prefix)
+	for _, f := range functions {
+		fmt.Fprintf(&b, "\n  @fnname[0x%x] = %q;", f.Address, f.Name)
+	}
+	return b.String(), nil
+}
+
+// FuncvalPC gives the code pointer of the *funcval (i.e. func value)
+// expression fn. The code pointer is the first word of a funcval with any
+// closure variables following it.
+func (t Target) FuncvalPC(fn string) string {
+	return fmt.Sprintf("*(%s)", fn)
+}
+
+// SymbolsMatching returns the names of the function symbols matching glob
+// where * matches any run of characters, including /, and ? matches any one
+// character. Templates use this to probe families of functions such as
+// "runtime.mapassign*".
+func (t Target) SymbolsMatching(glob string) ([]string, error) {
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+	pattern = strings.ReplaceAll(pattern, `\?`, ".")
+	re, err := regexp.Compile("^" + pattern + "$")
+	if err != nil {
+		return nil, err
+	}
+	functions, err := t.Functions("")
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, f := range functions {
+		if re.MatchString(f.Name) {
+			names = append(names, f.Name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ExpandSymbols returns the function symbols named by patterns in the order
+// given without duplicates. Patterns containing * or ? are globs as for
+// SymbolsMatching and must match at least one function; other patterns must
+// name a function in the target.
+func (t Target) ExpandSymbols(patterns []string) ([]string, error) {
+	seen := map[string]bool{}
+	symbols := []string{}
+	for _, pattern := range patterns {
+		var matches []string
+		if strings.ContainsAny(pattern, "*?") {
+			var err error
+			matches, err = t.SymbolsMatching(pattern)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no functions match %s", pattern)
+			}
+		} else {
+			if !t.HasSymbol(pattern) {
+				return nil, fmt.Errorf("symbol %s not found", pattern)
+			}
+			matches = []string{pattern}
+		}
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				symbols = append(symbols, m)
+			}
+		}
+	}
+	return symbols, nil
+}
+
+// ShortName turns symbol into a bpftrace identifier for use in map names by
+// dropping the package path before the last / and replacing runs of other
+// characters with _ e.g. "net/http.(*Server).Serve" gives
+// "http_Server_Serve". Different symbols can give the same name so templates
+// probing many symbols should add something unique such as an index.
+func (t Target) ShortName(symbol string) string {
+	if i := strings.LastIndex(symbol, "/"); i >= 0 {
+		symbol = symbol[i+1:]
+	}
+	var b strings.Builder
+	underscore := false
+	for _, r := range symbol {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			b.WriteRune(r)
+			underscore = false
+		} else if !underscore && b.Len() > 0 {
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	name := strings.TrimSuffix(b.String(), "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// Itab is an itab symbol in the target for a concrete type and interface
+type Itab struct {
+	// Type is the concrete type e.g. "*errors.errorString"
+	Type    string
+	Address uint64
+}
+
+// Itabs returns the itab symbols for the interface iface e.g. "error"
+// sorted by type. Only itabs made at compile time have symbols; those made
+// at run time by type assertions don't.
+func (t Target) Itabs(iface string) ([]Itab, error) {
+	symbols, err := t.bin.symbolData().symbolTable()
+	if err != nil {
+		return nil, err
+	}
+	found := itabs(symbols, iface)
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Type != found[j].Type {
+			return found[i].Type < found[j].Type
+		}
+		return found[i].Address < found[j].Address
+	})
+	return found, nil
+}
+
+func itabs(symbols []elf.Symbol, iface string) []Itab {
+	found := []Itab{}
+	for _, s := range symbols {
+		// go:itab.*os.File,io.WriterTo or go.itab. before go1.20
+		name := strings.TrimPrefix(strings.TrimPrefix(s.Name, "go:itab."), "go.itab.")
+		if name == s.Name || !strings.HasSuffix(name, ","+iface) {
+			continue
+		}
+		found = append(found, Itab{Type: strings.TrimSuffix(name, ","+iface), Address: s.Value})
+	}
+	return found
+}
+
+// Implementations returns the function symbols of method on the types which
+// implement the interface iface e.g. "io.WriterTo". Types converted to iface
+// at compile time have itab symbols naming them but io.Copy and the like
+// find implementations with type assertions which create itabs at run time.
+// With DWARF data methods whose one parameter has the type param (e.g.
+// "io.Writer") are included too. Where a method has both a value and a
+// pointer receiver symbol only the pointer one is given as that's what
+// calls through interfaces use.
+func (t Target) Implementations(iface, method, param string) ([]string, error) {
+	symbols, err := t.bin.symbolData().symbolTable()
+	if err != nil {
+		return nil, err
+	}
+	functions := map[string]bool{}
+	found := map[string]bool{}
+	for _, s := range symbols {
+		if elf.ST_TYPE(s.Info) == elf.STT_FUNC {
+			functions[s.Name] = true
+		}
+	}
+	for _, itab := range itabs(symbols, iface) {
+		typ := itab.Type
+		pointer := strings.HasPrefix(typ, "*")
+		typ = strings.TrimPrefix(typ, "*")
+		dot := strings.LastIndex(typ, ".")
+		if dot < strings.LastIndex(typ, "/") || dot < 0 {
+			continue
+		}
+		candidates := []string{fmt.Sprintf("%s.(*%s).%s", typ[:dot], typ[dot+1:], method)}
+		if !pointer {
+			candidates = append(candidates, fmt.Sprintf("%s.%s", typ, method))
+		}
+		for _, c := range candidates {
+			if functions[c] {
+				found[c] = true
+				break
+			}
+		}
+	}
+	if t.HasDWARF() {
+		for name := range functions {
+			if !strings.HasSuffix(name, "."+method) || strings.HasPrefix(name, "go:") {
+				continue
+			}
+			params, err := t.Params(name)
+			if err != nil {
+				continue
+			}
+			// the receiver and the method's one parameter
+			if len(params) == 2 && params[1].Type == param {
+				found[name] = true
+			}
+		}
+	}
+	names := []string{}
+	for name := range found {
+		// pkg.T.method has the pointer receiver wrapper pkg.(*T).method
+		dot := strings.LastIndex(strings.TrimSuffix(name, "."+method), ".")
+		if dot >= 0 && !strings.Contains(name, ".(*") {
+			typ := strings.TrimSuffix(name, "."+method)
+			if found[fmt.Sprintf("%s.(*%s).%s", typ[:dot], typ[dot+1:], method)] {
+				continue
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// RuntimeTypes returns up to max of the target's runtime type descriptors
+// with their names so templates can map type pointers to names. Without
+// DWARF data the type symbols in the symbol table are used.
+func (t Target) RuntimeTypes(max int) ([]layout.Type, error) {
+	var types []layout.Type
+	var err error
+	if t.HasDWARF() {
+		types, err = t.runtimeTypes()
+	} else {
+		var symbols []elf.Symbol
+		symbols, err = t.bin.symbolData().symbolTable()
+		types = layout.SymbolTypes(symbols)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(types) > max {
+		types = types[:max]
+	}
+	return types, nil
+}
+
+// TypeAddress returns the address of the runtime type descriptor for the
+// type with the given name e.g. "*net.DNSError". Comparing it with the type
+// word of an interface (or the type in an itab) tells templates which
+// concrete type the interface holds.
+func (t Target) TypeAddress(name string) (uint64, error) {
+	types, err := t.runtimeTypes()
+	if err != nil {
+		return 0, err
+	}
+	for _, typ := range types {
+		if typ.Name == name {
+			return typ.Address, nil
+		}
+	}
+	return 0, fmt.Errorf("type %s not found", name)
+}
+
+// runtimeTypes returns the types with runtime type descriptors described by
+// the target's DWARF data
+func (t Target) runtimeTypes() ([]layout.Type, error) {
+	data, err := t.bin.symbolData().dwarfData()
+	if err != nil {
+		return nil, err
+	}
+	return data.RuntimeTypes()
+}
+
+// StructOffset returns the offset of field in the struct typ using the
+// target's DWARF data
+func (t Target) StructOffset(typ, field string) (int, error) {
+	data, err := t.bin.symbolData().dwarfData()
+	if err != nil {
+		return 0, err
+	}
+	offset, err := data.FieldOffset(typ, field)
+	return int(offset), err
+}
+
+// FieldAddress gives a bpftrace expression for the address of a field of
+// the struct typ at the address addr, following a path of fields through
+// the structs and pointers to structs they hold e.g. "Stream.method" of a
+// transport.ServerStream embedding a Stream, which isn't always a pointer.
+// Pointers are read and the offsets of structs added using the target's
+// DWARF data.
+func (t Target) FieldAddress(addr, typ, path string) (string, error) {
+	data, err := t.bin.symbolData().dwarfData()
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Split(path, ".")
+	for i, field := range fields {
+		offset, fieldType, err := data.Field(typ, field)
+		if err != nil {
+			return "", fmt.Errorf("%s.%s: %w", typ, field, err)
+		}
+		if offset != 0 {
+			addr = fmt.Sprintf("%s + %d", addr, offset)
+		}
+		if i == len(fields)-1 {
+			break
+		}
+		switch st := structType(fieldType).(type) {
+		case *dwarf.StructType:
+			typ = st.StructName
+			continue
+		case *dwarf.PtrType:
+			if st, ok := structType(st.Type).(*dwarf.StructType); ok {
+				addr = fmt.Sprintf("*(%s)", addr)
+				typ = st.StructName
+				continue
+			}
+		}
+		return "", fmt.Errorf("%s.%s: %s has no fields to follow %s with", typ, field, fieldType, strings.Join(fields[i+1:], "."))
+	}
+	return addr, nil
+}
+
+// structType returns the type a named type such as a struct is given by
+// Go's DWARF data is defined as
+func structType(typ dwarf.Type) dwarf.Type {
+	for {
+		typedef, ok := typ.(*dwarf.TypedefType)
+		if !ok {
+			return typ
+		}
+		typ = typedef.Type
+	}
+}
+
+// Params returns the parameters of function using the target's DWARF data.
+// With the register calling convention Word is the first integer register
+// a parameter is passed in and Words the number of them. Floats are passed
+// in their own registers which Arg can't read so they're given a Word of -1
+// and don't count towards the words of later parameters, as are those
+// passed on the stack, which have Stack set. The ABI is that ABIFor gives
+// for function, as it is for the helpers using Params.
+func (t Target) Params(function string) ([]layout.Param, error) {
+	t = t.ABIFor(function)
+	function, err := t.paramsFunction(function)
+	if err != nil {
+		return nil, err
+	}
+	params, err := t.bin.params(function, false)
+	if err != nil || !t.RegsABI {
+		return params, err
+	}
+	return t.arch().assignRegisters(params), nil
+}
+
+// Results returns the results of function using the target's DWARF data
+// with Word giving the index to pass to Ret. Floats and results passed on
+// the stack get a Word of -1 with the register calling convention as for
+// Params.
+func (t Target) Results(function string) ([]layout.Param, error) {
+	t = t.ABIFor(function)
+	function, err := t.paramsFunction(function)
+	if err != nil {
+		return nil, err
+	}
+	results, err := t.bin.params(function, true)
+	if err != nil || !t.RegsABI {
+		return results, err
+	}
+	return t.arch().assignRegisters(results), nil
+}
+
+// ErrorResult returns the index to pass to Ret for the last result of
+// function with the type error, or -1 if it has none or isn't described by
+// the DWARF data as with assembly functions. The index is that of the itab
+// word which is zero when the error is nil. It's also -1 for an error the
+// register calling convention returns on the stack, which Ret can't read.
+func (t Target) ErrorResult(function string) (int, error) {
+	results, err := t.Results(function)
+	if errors.Is(err, layout.ErrFunctionNotFound) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	for i := len(results) - 1; i >= 0; i-- {
+		if results[i].Type == "error" {
+			return results[i].Word, nil
+		}
+	}
+	return -1, nil
+}
+
+// assignRegisters assigns params, or results, to the registers the
+// register calling convention passes them in, as the Go internal ABI
+// specifies: in order, each taking as many integer and floating point
+// registers as it's made of if there are enough left and otherwise going
+// on the stack, laid out as the stack ABI lays out all of them, while later
+// ones may still get registers. params is left as it was.
+func (a goArch) assignRegisters(params []layout.Param) []layout.Param {
+	assigned := make([]layout.Param, len(params))
+	copy(assigned, params)
+	ints, floats, offset := 0, 0, 0
+	for i := range assigned {
+		p := &assigned[i]
+		if !p.StackOnly && ints+p.IntRegs <= len(a.args) && floats+p.FloatRegs <= a.floats {
+			p.Word = -1
+			if p.IntRegs > 0 {
+				p.Word, p.Words = ints, p.IntRegs
+			}
+			p.Offset = 0
+			ints += p.IntRegs
+			floats += p.FloatRegs
+			continue
+		}
+		offset = layout.AlignUp(offset, p.Align)
+		p.Stack = true
+		p.Offset = offset
+		p.Word = -1
+		offset += p.Size
+	}
+	return assigned
+}
+
+// HasDWARF returns true if the target has DWARF data. Templates check this
+// before using helpers such as Params which need it.
+func (t Target) HasDWARF() bool {
+	_, err := t.bin.symbolData().dwarfData()
+	return err == nil
+}
+
+// ArgIndex returns the index to pass to Arg for the parameter of function
+// called name. Templates use this for functions whose signatures changed
+// between Go versions rather than hard coding argument positions.
+// Parameters sharing a stack word with others, which Arg can't read on its
+// own, are errors; ArgNamed reads them. Like Params it uses the ABI ABIFor
+// gives for function, so the index is for the Arg of the target ABIFor
+// gives.
+func (t Target) ArgIndex(function, name string) (int, error) {
+	t = t.ABIFor(function)
+	params, err := t.Params(function)
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range params {
+		if p.Name == name {
+			if p.Stack {
+				return 0, fmt.Errorf("%s parameter %s is passed on the stack as it doesn't fit in the argument registers; read it with ArgNamed", function, name)
+			}
+			if p.Word < 0 {
+				return 0, fmt.Errorf("%s parameter %s isn't passed in integer registers which Arg can read", function, name)
+			}
+			if !t.RegsABI && p.Offset%8 != 0 {
+				return 0, fmt.Errorf("%s parameter %s shares a stack word with parameters before it; read it with ArgNamed", function, name)
+			}
+			return p.Word, nil
+		}
+	}
+	return 0, fmt.Errorf("%s has no parameter %s", function, name)
+}
+
+// ArgNamed gives an expression reading the parameter of function called
+// name, on entry to it, found with DWARF data rather than by position and
+// with the ABI ABIFor gives for function. Integers, bools and pointers are
+// read at their size as ArgValue does and strings, which take two words,
+// as ArgString does. Slices give their data pointer with the length at
+// .ArgSliceLen (.ArgIndex function name). Other parameters taking more
+// than one word and floats are errors. Parameters the register ABI puts on
+// the stack are read from there.
+//
+//	{{ .ArgNamed "net/http.(*conn).serve" "ctx" }}
+func (t Target) ArgNamed(function, name string) (string, error) {
+	t = t.ABIFor(function)
+	params, err := t.Params(function)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range params {
+		if p.Name != name {
+			continue
+		}
+		if p.Kind != "string" && !isSlice(p) && p.Words > 1 {
+			return "", fmt.Errorf("%s parameter %s of type %s takes %d words; read them with .Arg from .ArgIndex", function, name, p.Type, p.Words)
+		}
+		v, err := t.ParamValue(p)
+		if err != nil {
+			return "", fmt.Errorf("%s %w", function, err)
+		}
+		return v, nil
+	}
+	return "", fmt.Errorf("%s has no parameter %s", function, name)
+}
+
+// ParamValue gives an expression reading the parameter p, one of those
+// Params gives, on entry to its function: integers, bools and pointers at
+// their size as ArgValue does, strings as ArgString does, the data pointer
+// of slices and the first word of anything else. Unlike Arg it reads
+// parameters which share a stack word with others and those the register
+// ABI passes on the stack. Floats are errors, as are other parameters the
+// register ABI passes in no integer registers; ParamReadable is false for
+// them.
+//
+//	{{ range $p := .Params $symbol }}{{ $.ParamValue $p }}{{ end }}
+func (t Target) ParamValue(p layout.Param) (string, error) {
+	size := p.Size
+	if p.Kind != "string" && (isSlice(p) || size > 8) {
+		size = 8
+	}
+	switch {
+	case p.Kind == "float":
+		return "", fmt.Errorf("parameter %s is a float which can't be read", p.Name)
+	case t.RegsABI && p.Stack:
+		// the parameters passed on the stack are laid out as the stack
+		// ABI lays out all of them
+		t.RegsABI = false
+		p.Word = p.Offset / 8
+		return t.ParamValue(p)
+	case t.RegsABI && p.Word < 0:
+		return "", fmt.Errorf("parameter %s isn't passed in integer registers which can be read", p.Name)
+	case !t.RegsABI && p.Offset%8 != 0 && size < 8:
+		return t.stackBytes(8*t.arch().frame+p.Offset, size)
+	case p.Kind == "string":
+		return t.ArgString(p.Word)
+	}
+	return t.ArgValue(p.Word, size)
+}
+
+// ParamReadable is true if ParamValue can read p: it isn't a float or,
+// with the register ABI, passed only in floating point registers or none
+func (t Target) ParamReadable(p layout.Param) bool {
+	return p.Kind != "float" && (!t.RegsABI || p.Stack || p.Word >= 0)
+}
+
+// isSlice is true if p is a slice, which DWARF describes as a struct
+// named for the slice type
+func isSlice(p layout.Param) bool {
+	return strings.HasPrefix(strings.TrimPrefix(p.Type, "struct "), "[]")
+}
+
+// ArgWords returns the number of 8 byte words taken by the parameters of
+// function passed on the stack, after which Ret finds the results with the
+// stack calling convention. With the register calling convention Ret
+// doesn't need it. The ABI is that ABIFor gives for function.
+func (t Target) ArgWords(function string) (int, error) {
+	t = t.ABIFor(function)
+	params, err := t.Params(function)
+	if err != nil {
+		return 0, err
+	}
+	return stackWords(stackParams(params, t.RegsABI)), nil
+}
+
+// stackWords gives the number of 8 byte words the parameters laid out as
+// the stack calling convention does take up
+func stackWords(params []layout.Param) int {
+	end := 0
+	for _, p := range params {
+		if e := p.Offset + p.Size; e > end {
+			end = e
+		}
+	}
+	return layout.AlignUp(end, 8) / 8
+}
+
+// GoVersion returns the version of the toolchain used to build the target
+// as recorded in its build info e.g. "go1.19.3". An empty string is returned
+// when the build info can't be read.
+func (t Target) GoVersion() string {
+	info, err := t.bin.buildInfo()
+	if err != nil {
+		return ""
+	}
+	return info.GoVersion
+}
+
+// GoVersionAtLeast returns true if the target was built with Go version v
+// (e.g. "go1.21") or later. Development builds are assumed to be newer than
+// any release.
+func (t Target) GoVersionAtLeast(v string) (bool, error) {
+	have := t.GoVersion()
+	if strings.HasPrefix(have, "devel") {
+		_, err := versionAtLeast(have, v)
+		return err == nil, err
+	}
+	return versionAtLeast(have, v)
+}
+
+// DepVersion returns the version of the module with the given path which
+// the target was built with e.g. "v1.58.3". An empty string is returned if
+// the target doesn't depend on the module.
+func (t Target) DepVersion(path string) string {
+	info, err := t.bin.buildInfo()
+	if err != nil {
+		return ""
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == path {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return ""
+}
+
+// DepVersionAtLeast returns true if the target depends on version v (e.g.
+// "v1.57.0") or later of the module with the given path
+func (t Target) DepVersionAtLeast(path, v string) (bool, error) {
+	return versionAtLeast(t.DepVersion(path), v)
+}
+
+// versionAtLeast returns true if the version have is want or later. Versions
+// have which can't be parsed, such as an empty one, are never later.
+func versionAtLeast(have, want string) (bool, error) {
+	w, ok := parseVersion(want)
+	if !ok {
+		return false, fmt.Errorf("bad version %q, must be like go1.21 or v1.2.3", want)
+	}
+	h, ok := parseVersion(have)
+	if !ok {
+		return false, nil
+	}
+	for i := range w {
+		if h[i] != w[i] {
+			return h[i] > w[i], nil
+		}
+	}
+	return true, nil
+}
+
+// parseVersion splits versions like go1.21.3, go1.22rc1 or v1.58.3 into
+// major, minor and patch numbers
+func parseVersion(v string) ([3]int, bool) {
+	var version [3]int
+	switch {
+	case strings.HasPrefix(v, "go"):
+		v = v[2:]
+	case strings.HasPrefix(v, "v"):
+		v = v[1:]
+	default:
+		return version, false
+	}
+	for i, part := range strings.SplitN(v, ".", 3) {
+		n := 0
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				break
+			}
+			n = n*10 + int(c-'0')
+		}
+		version[i] = n
+	}
+	return version, true
+}
+
+// Param returns the first value given for key on the command line or def
+// if key wasn't given
+func (t Target) Param(key, def string) string {
+	v := t.Arguments(key)
+	if len(v) == 0 {
+		return def
+	}
+	return v[0]
+}
+
+// ParamInt is like Param for integer values
+func (t Target) ParamInt(key string, def int) (int, error) {
+	v := t.Param(key, "")
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer: %w", key, err)
+	}
+	return i, nil
+}
+
+// ParamDuration is like Param for durations such as "10ms" or "1.5s",
+// giving nanoseconds. Plain integers are taken as nanoseconds.
+func (t Target) ParamDuration(key, def string) (int64, error) {
+	v := t.Param(key, def)
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return n, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration: %w", key, err)
+	}
+	return int64(d), nil
+}
+
+// SampleEvery gives a bpftrace predicate which is true for roughly one in n
+// events. Templates for high frequency probes use this to limit overhead.
+func (t Target) SampleEvery(n int) string {
+	if n <= 1 {
+		return "1"
+	}
+	return fmt.Sprintf("rand %% %d == 0", n)
+}
+
+// Comm gives the task name the kernel reports for the target's processes:
+// the executable's base name truncated to 15 bytes
+func (t Target) Comm() string {
+	comm := filepath.Base(t.ExePath)
+	if len(comm) > 15 {
+		comm = comm[:15]
+	}
+	return comm
+}
+
+// Filter gives a bpftrace predicate matching the target's processes. System
+// wide probes such as tracepoints use this. The processes are matched by
+// pid when pid=<n> is given and by Comm otherwise.
+func (t Target) Filter() (string, error) {
+	pid, err := t.ParamInt("pid", 0)
+	if err != nil {
+		return "", err
+	}
+	if pid != 0 {
+		return fmt.Sprintf("pid == %d", pid), nil
+	}
+	return fmt.Sprintf("comm == %q", t.Comm()), nil
+}
+
+// GoArch gives the GOARCH the target was built for e.g. "amd64". Templates
+// which depend on register names or runtime internals that vary by
+// architecture check this.
+func (t Target) GoArch() string {
+	f := t.bin.exe.elf
+	switch f.Machine {
+	case elf.EM_X86_64:
+		return "amd64"
+	case elf.EM_386:
+		return "386"
+	case elf.EM_AARCH64:
+		return "arm64"
+	case elf.EM_ARM:
+		return "arm"
+	case elf.EM_PPC64:
+		if f.ByteOrder == binary.LittleEndian {
+			return "ppc64le"
+		}
+		return "ppc64"
+	case elf.EM_S390:
+		return "s390x"
+	case elf.EM_RISCV:
+		return "riscv64"
+	case elf.EM_MIPS:
+		arch := "mips"
+		if f.Class == elf.ELFCLASS64 {
+			arch = "mips64"
+		}
+		if f.ByteOrder == binary.LittleEndian {
+			arch += "le"
+		}
+		return arch
+	}
+	return ""
+}
+
+// Stripped returns true if the target has no symbol table
+func (t Target) Stripped() bool {
+	return t.bin.exe.elf.Section(".symtab") == nil
+}
+
+var regs = [...]string{"ax", "bx", "cx", "di", "si", "r8", "r9", "r10", "r11"}
+
+// Arg maps argument indices to bpftrace built-ins taking into account which ABI
+// is in use
+func (t Target) Arg(i int) (string, error) {
+	a := t.arch()
+	if i < 0 {
+		return "", fmt.Errorf("argument %d is negative", i)
+	}
+	if t.RegsABI {
+		// rax, rbx, rcx, rdi, rsi, r8, r9, r10, r11 should do on amd64
+		if i >= len(a.args) {
+			return "", fmt.Errorf("argument %d out of bounds, only %d are passed in registers. roll your own", i, len(a.args))
+		}
+		return t.register(a.args[i])
+	}
+	if t.Format == FormatBpftrace && a.sargs {
+		return fmt.Sprintf("sarg%d", i), nil
+	}
+	// the return address, or space for the link register, is at the top
+	// of the stack
+	return t.stackWord(i + a.frame)
+}
+
+// Ret maps return value indices to bpftrace expressions for use in uprobes
+// on the offsets given by SymbolReturns. With the stack calling convention
+// results are stored after the arguments so argWords, the number of 8 byte
+// words taken up by the arguments, is needed to find them.
+func (t Target) Ret(argWords, i int) (string, error) {
+	if t.RegsABI {
+		return t.Arg(i)
+	}
+	if i < 0 {
+		return "", fmt.Errorf("result %d is negative", i)
+	}
+	return t.stackWord(argWords + i + t.arch().frame)
+}
+
+// GoString returns a bpftrace str() call reading a Go string made up of
+// the pointer and length expressions given. If strlen is given on the command
+// line, no more than strlen bytes are read.
+func (t Target) GoString(ptr, length string) string {
+	if max := t.Param("strlen", ""); max != "" {
+		// bpftrace won't read strings longer than BPFTRACE_STRLEN
+		if n, err := strconv.Atoi(max); err == nil && n > 64 {
+			t.Env("BPFTRACE_STRLEN", max)
+		}
+		return fmt.Sprintf("str(%s, %s > %s ? %s : %s)", ptr, length, max, max, length)
+	}
+	return fmt.Sprintf("str(%s, %s)", ptr, length)
+}
+
+// ArgString reads a Go string argument. Strings are passed as a pointer
+// followed by a length so this takes up arguments i and i+1
+func (t Target) ArgString(i int) (string, error) {
+	ptr, err := t.Arg(i)
+	if err != nil {
+		return "", err
+	}
+	length, err := t.Arg(i + 1)
+	if err != nil {
+		return "", err
+	}
+	return t.GoString(ptr, length), nil
+}
+
+// ArgSliceLen gives the length of the slice passed as argument i. Slices are
+// passed as a pointer, length and capacity so this is argument i+1
+func (t Target) ArgSliceLen(i int) (string, error) {
+	return t.Arg(i + 1)
+}
+
+// ArgBuf reads n bytes from the slice or pointer passed as argument i
+func (t Target) ArgBuf(i, n int) (string, error) {
+	ptr, err := t.Arg(i)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("buf(%s, %d)", ptr, n), nil
+}
+
+// NewTarget opens the target given by path, which is an executable or
+// shared object or one of pid:<pid>, unit:<name>, container:<name or id>
+// and k8s:<namespace>/<pod>[/<container>] as the command takes. The
+// target's files are kept open until Close is called.
+func NewTarget(path string, opts ...Option) (*Target, error) {
+	o := newOptions(opts)
+	args := newArguments(o.arguments)
+	exe := path
+	unit := ""
+	if strings.HasPrefix(exe, "unit:") {
+		unit = strings.TrimPrefix(exe, "unit:")
+	}
+	var pod Pod
+	if strings.HasPrefix(exe, "k8s:") {
+		var pid int
+		var err error
+		if pid, pod, err = podPid(strings.TrimPrefix(exe, "k8s:")); err != nil {
+			return nil, err
+		}
+		exe = fmt.Sprintf("pid:%d", pid)
+	}
+	exe, pid, err := resolveTarget(exe, args.get)
+	if err != nil {
+		return nil, err
+	}
+	if pid == 0 {
+		exe, err = executablePath(exe)
+	} else {
+		exe, err = filepath.Abs(exe)
+	}
+	if err != nil {
+		return nil, err
+	}
+	bin, err := openTargetFiles(exe, o)
+	if err != nil {
+		if scriptErr := scriptError(exe); scriptErr != nil {
+			return nil, scriptErr
+		}
+		return nil, err
+	}
+	return newTarget(&Target{
+		ExePath:   exe,
+		Arguments: args.get,
+		args:      args,
+		Pid:       pid,
+		Unit:      unit,
+		Pod:       pod,
+	}, bin, o), nil
+}
+
+// NewTargetReader makes a Target for the executable or shared object read
+// from r, such as one fetched over the network or made by the testtarget
+// package, rather than opened from the filesystem. path is only used to
+// name the target in probes. r is read until Close is called and isn't
+// closed by it.
+func NewTargetReader(r io.ReaderAt, path string, opts ...Option) (*Target, error) {
+	o := newOptions(opts)
+	exe, err := readELF(r)
+	if err != nil {
+		return nil, err
+	}
+	args := newArguments(o.arguments)
+	return newTarget(&Target{
+		ExePath:   path,
+		Arguments: args.get,
+		args:      args,
+	}, newTargetFiles(exe, path, o), o), nil
+}
+
+// newTarget finishes t once its files are open
+func newTarget(t *Target, bin *targetFiles, o options) *Target {
+	t.Format = o.format
+	t.meta = &templateMeta{env: map[string]string{}}
+	t.bin = bin
+	t.opts = o
+	var err error
+	t.RegsABI, err = bin.regsABI()
+	t.abi.detectedSource = abiDetected
+	if err != nil {
+		// c-shared libraries and plugins may not have runtime.memequal0
+		// in their symbol table but still have build info, and it's only
+		// decoded for amd64
+		var ok bool
+		t.abi.detectedSource = abiVersion
+		if t.RegsABI, ok = t.regsABIByVersion(); !ok {
+			t.abi.detectedSource = abiAssumed
+			log.Printf("couldn't get regs abi (%s). falling back to stack calling convention", err)
+		}
+	}
+	t.abi.detected, t.abi.source = t.RegsABI, t.abi.detectedSource
+	t.findDebugInfo(o.offline)
+	return t
+}
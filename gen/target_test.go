@@ -0,0 +1,182 @@
+package gen_test
+
+import (
+	"bytes"
+	"debug/elf"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+)
+
+// scatteredFunctions returns up to n functions spread evenly through the
+// fixture's text with unique names, the total size of their code and the
+// size of the text
+func scatteredFunctions(t testing.TB, n int) (names []string, size, text uint64) {
+	t.Helper()
+	f, err := elf.Open(fixture(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	symbols, err := f.Symbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]int{}
+	var functions []elf.Symbol
+	for _, s := range symbols {
+		seen[s.Name]++
+		if elf.ST_TYPE(s.Info) == elf.STT_FUNC && s.Size > 0 {
+			functions = append(functions, s)
+		}
+	}
+	for i := 0; i < n; i++ {
+		s := functions[i*len(functions)/n]
+		if seen[s.Name] == 1 {
+			names = append(names, s.Name)
+			size += s.Size
+		}
+	}
+	return names, size, f.Section(".text").Size
+}
+
+// BenchmarkResolve finds the addresses and return offsets of 300 functions
+// of the fixture with one Target, which opens and parses the file once, and
+// with a Target for each function, as helpers opening the file themselves
+// did
+func BenchmarkResolve(b *testing.B) {
+	symbols, _, _ := scatteredFunctions(b, 300)
+	resolve := func(b *testing.B, target *gen.Target, symbol string) {
+		if _, err := target.SymbolAddress(symbol); err != nil {
+			b.Fatal(err)
+		}
+		// assembly functions which can't be decoded fail
+		target.SymbolReturns(symbol)
+	}
+	b.Run("once", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			target, err := gen.NewTarget(fixture(b))
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, symbol := range symbols {
+				resolve(b, target, symbol)
+			}
+			target.Close()
+		}
+	})
+	b.Run("per function", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, symbol := range symbols {
+				target, err := gen.NewTarget(fixture(b))
+				if err != nil {
+					b.Fatal(err)
+				}
+				resolve(b, target, symbol)
+				target.Close()
+			}
+		}
+	})
+}
+
+// resolveAllocated returns the bytes allocated finding the return offsets
+// of symbols in target
+func resolveAllocated(target *gen.Target, symbols []string) uint64 {
+	// the symbol table and its index are made on the first lookup, which
+	// isn't what's measured
+	target.SymbolAddress(symbols[0])
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	for _, symbol := range symbols {
+		// assembly functions which can't be decoded fail
+		target.SymbolReturns(symbol)
+	}
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// TestResolveAllocations checks the code of functions scattered through
+// the fixture is decoded where the file is mapped rather than the text
+// being read into memory or each function being copied, as it is when the
+// target is read with NewTargetReader
+func TestResolveAllocations(t *testing.T) {
+	symbols, size, text := scatteredFunctions(t, 400)
+	mapped := resolveAllocated(newFixtureTarget(t), symbols)
+
+	f, err := os.Open(fixture(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	target, err := gen.NewTargetReader(f, fixture(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	read := resolveAllocated(target, symbols)
+
+	t.Logf("%d functions of %d bytes: %d bytes allocated with the file mapped and %d read", len(symbols), size, mapped, read)
+	if mapped > text/4 {
+		t.Errorf("%d bytes were allocated for %d functions, more than a quarter of the %d bytes of text", mapped, len(symbols), text)
+	}
+	// the file is only mapped on Linux
+	if runtime.GOOS == "linux" && mapped+size > read {
+		t.Errorf("%d bytes were allocated with the file mapped, not %d bytes of code fewer than the %d read", mapped, size, read)
+	}
+}
+
+// TestNewTargetReader checks a Target read from memory resolves the
+// fixture as one opened from its file does, naming it in probes by the
+// path given which doesn't have to exist
+func TestNewTargetReader(t *testing.T) {
+	exe, err := os.ReadFile(fixture(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "server")
+	args := gen.WithArguments(map[string][]string{"symbol": {"main.handle"}})
+	read, err := gen.NewTargetReader(bytes.NewReader(exe), path, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer read.Close()
+	opened := newFixtureTarget(t, args)
+
+	if read.ExePath != path || read.GoVersion() != opened.GoVersion() || read.RegsABI != opened.RegsABI {
+		t.Errorf("got %s built with %s, register ABI %v, want %s built with %s, register ABI %v",
+			read.ExePath, read.GoVersion(), read.RegsABI, path, opened.GoVersion(), opened.RegsABI)
+	}
+	for _, symbol := range []string{"main.handle", "runtime.mallocgc"} {
+		address, err := read.SymbolAddress(symbol)
+		want, wantErr := opened.SymbolAddress(symbol)
+		if err != nil || wantErr != nil || address != want {
+			t.Errorf("%s is at %#x, %v, want %#x, %v", symbol, address, err, want, wantErr)
+		}
+		returns, err := read.SymbolReturns(symbol)
+		wantReturns, wantErr := opened.SymbolReturns(symbol)
+		if err != nil || wantErr != nil || !reflect.DeepEqual(returns, wantReturns) {
+			t.Errorf("%s returns at %v, %v, want %v, %v", symbol, returns, err, wantReturns, wantErr)
+		}
+	}
+	script, err := gen.GenerateString("latency.bt", read, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := gen.GenerateString("latency.bt", opened, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want = strings.ReplaceAll(want, fixture(t), path); script != want {
+		t.Errorf("got script\n%s\nwant\n%s", script, want)
+	}
+
+	if _, err := gen.NewTargetReader(strings.NewReader("#!/bin/sh\n"), path); err == nil {
+		t.Error("a script was read as a target")
+	}
+}
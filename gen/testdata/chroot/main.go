@@ -0,0 +1,47 @@
+// The chroot fixture: a process which says it's ready on its standard
+// output then runs until its standard input is closed, so a test can start
+// it in a root directory of its own and resolve it by pid. Started in a mount namespace of its own with FIXTURE_ROOT set,
+// it makes that directory its root with pivot_root as a container runtime
+// does, so that the host can't see its executable's path, and runs again as
+// /app/server.
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"syscall"
+)
+
+//go:noinline
+func serve() {
+	io.Copy(io.Discard, os.Stdin)
+}
+
+func pivot(root string) error {
+	// keep the mounts from the host's mount namespace
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return err
+	}
+	if err := syscall.Mount(root, root, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	if err := syscall.Chdir(root); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(".", "."); err != nil {
+		return err
+	}
+	if err := syscall.Unmount(".", syscall.MNT_DETACH); err != nil {
+		return err
+	}
+	return syscall.Exec("/app/server", os.Args, nil)
+}
+
+func main() {
+	if root := os.Getenv("FIXTURE_ROOT"); root != "" {
+		log.Fatal(pivot(root))
+	}
+	os.Stdout.WriteString("ready\n")
+	serve()
+}
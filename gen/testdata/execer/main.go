@@ -0,0 +1,47 @@
+// The execer fixture: it runs commands through os/exec and prints how each
+// ended. The commands are the fixture itself, run with -exit to exit with a
+// code or -kill to be killed by SIGKILL, and a command which doesn't exist
+// so it fails to start.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// missing is the command which fails to start
+const missing = "/nonexistent/command"
+
+func main() {
+	exit := flag.Int("exit", -1, "exit with this code")
+	kill := flag.Bool("kill", false, "be killed by SIGKILL")
+	flag.Parse()
+	switch {
+	case *exit >= 0:
+		os.Exit(*exit)
+	case *kill:
+		syscall.Kill(os.Getpid(), syscall.SIGKILL)
+		select {}
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, cmd := range []*exec.Cmd{
+		exec.Command(self, "-exit", "0", "hello", "world"),
+		exec.Command(self, "-exit", "3"),
+		exec.Command(self, "-kill"),
+		exec.Command(missing),
+	} {
+		if err := cmd.Run(); err != nil {
+			fmt.Println(cmd.Args, err)
+			continue
+		}
+		fmt.Println(cmd.Args, "ok")
+	}
+}
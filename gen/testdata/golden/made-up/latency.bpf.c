@@ -0,0 +1,151 @@
+// arguments are read with the register ABI (detected)
+// libbpf port of latency.bt: the latency of each call of each
+// symbol=<function> is sent to userspace through a ring buffer. Build with
+//   clang -O2 -g -target bpf -D__TARGET_ARCH_x86 -c latency.bpf.c -o latency.bpf.o
+// with vmlinux.h from bpftool btf dump file /sys/kernel/btf/vmlinux format c
+// and load it with the loader from templates/latency.c.tmpl.
+// target built with go1.21.0
+#include "vmlinux.h"
+#include <bpf/bpf_helpers.h>
+#include <bpf/bpf_tracing.h>
+
+char LICENSE[] SEC("license") = "GPL";
+
+struct event {
+    u32 pid;
+    u32 tid;
+    u64 gid;
+    u32 symbol;
+    u64 latency_ns;
+};
+
+// goroutines move between threads so calls are keyed by goroutine
+struct call_key {
+    u64 gid;
+    u32 pid;
+    u32 symbol;
+};
+
+// map thread id to goroutine id
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 10240);
+    __type(key, u32);
+    __type(value, u64);
+} gids SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __uint(max_entries, 10240);
+    __type(key, struct call_key);
+    __type(value, u64);
+} starts SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, 256 * 1024);
+} events SEC(".maps");
+
+static __always_inline int execute(struct pt_regs *ctx)
+{
+    u32 tid = bpf_get_current_pid_tgid();
+    u64 gid = PT_REGS_RC(ctx);
+    bpf_map_update_elem(&gids, &tid, &gid, BPF_ANY);
+    return 0;
+}
+
+// runtime.execute
+SEC("uprobe//srv/server:0x1080")
+int execute_uprobe(struct pt_regs *ctx)
+{
+    return execute(ctx);
+}
+
+SEC("tracepoint/sched/sched_process_exit")
+int sched_process_exit(void *ctx)
+{
+    u32 tid = bpf_get_current_pid_tgid();
+    bpf_map_delete_elem(&gids, &tid);
+    return 0;
+}
+
+static __always_inline int call_key(struct call_key *key, u32 symbol)
+{
+    u64 pid_tgid = bpf_get_current_pid_tgid();
+    u32 tid = pid_tgid;
+    u64 *gid = bpf_map_lookup_elem(&gids, &tid);
+    if (!gid) {
+        return -1;
+    }
+    key->gid = *gid;
+    key->pid = pid_tgid >> 32;
+    key->symbol = symbol;
+    return 0;
+}
+
+static __always_inline int entry(u32 symbol)
+{
+    struct call_key key = {};
+    if (call_key(&key, symbol)) {
+        return 0;
+    }
+    u64 ts = bpf_ktime_get_ns();
+    bpf_map_update_elem(&starts, &key, &ts, BPF_ANY);
+    return 0;
+}
+
+static __always_inline int record_return(u32 symbol)
+{
+    struct call_key key = {};
+    if (call_key(&key, symbol)) {
+        return 0;
+    }
+    u64 *ts = bpf_map_lookup_elem(&starts, &key);
+    if (!ts) {
+        return 0;
+    }
+    u64 latency = bpf_ktime_get_ns() - *ts;
+    bpf_map_delete_elem(&starts, &key);
+    struct event *e = bpf_ringbuf_reserve(&events, sizeof(*e), 0);
+    if (!e) {
+        return 0;
+    }
+    e->pid = key.pid;
+    e->tid = bpf_get_current_pid_tgid();
+    e->gid = key.gid;
+    e->symbol = symbol;
+    e->latency_ns = latency;
+    bpf_ringbuf_submit(e, 0);
+    return 0;
+}
+
+static __always_inline int entry_0(struct pt_regs *ctx)
+{
+    return entry(0);
+}
+
+// main.handle
+SEC("uprobe//srv/server:0x1010")
+int entry_0_uprobe(struct pt_regs *ctx)
+{
+    return entry_0(ctx);
+}
+
+static __always_inline int return_0(struct pt_regs *ctx)
+{
+    return record_return(0);
+}
+
+// main.handle+40
+SEC("uprobe//srv/server:0x1038")
+int return_0_uprobe0(struct pt_regs *ctx)
+{
+    return return_0(ctx);
+}
+
+// main.handle+96
+SEC("uprobe//srv/server:0x1070")
+int return_0_uprobe1(struct pt_regs *ctx)
+{
+    return return_0(ctx);
+}
@@ -0,0 +1,77 @@
+// arguments are read with the register ABI (detected)
+// loader for the BPF program from templates/latency.bpf.c.tmpl, rendered
+// with the same target and arguments. Build with
+//   cc -o latency latency.c -lbpf
+// and run it as root with the path to latency.bpf.o
+// target built with go1.21.0
+#include <signal.h>
+#include <stdio.h>
+
+#include <bpf/libbpf.h>
+#include <linux/types.h>
+
+typedef __u32 u32;
+typedef __u64 u64;
+
+struct event {
+    u32 pid;
+    u32 tid;
+    u64 gid;
+    u32 symbol;
+    u64 latency_ns;
+};
+
+static const char *symbols[] = {
+    "main.handle",
+};
+
+static volatile sig_atomic_t stop;
+
+static void interrupt(int sig)
+{
+    stop = 1;
+}
+
+static int handle_event(void *ctx, void *data, size_t size)
+{
+    const struct event *e = data;
+    printf("%s ", symbols[e->symbol]);
+    printf("pid=%u tid=%u gid=%llu symbol=%u latency_ns=%llu\n", e->pid, e->tid, e->gid, e->symbol, e->latency_ns);
+    return 0;
+}
+
+int main(int argc, char **argv)
+{
+    const char *path = argc > 1 ? argv[1] : "latency.bpf.o";
+    struct bpf_object *obj = bpf_object__open_file(path, NULL);
+    if (libbpf_get_error(obj)) {
+        fprintf(stderr, "failed to open %s\n", path);
+        return 1;
+    }
+    if (bpf_object__load(obj)) {
+        fprintf(stderr, "failed to load %s\n", path);
+        return 1;
+    }
+    struct bpf_program *prog;
+    bpf_object__for_each_program(prog, obj) {
+        struct bpf_link *link = bpf_program__attach(prog);
+        if (libbpf_get_error(link)) {
+            fprintf(stderr, "failed to attach %s\n", bpf_program__name(prog));
+            return 1;
+        }
+    }
+    struct ring_buffer *rb = ring_buffer__new(bpf_object__find_map_fd_by_name(obj, "events"), handle_event, NULL, NULL);
+    if (!rb) {
+        fprintf(stderr, "failed to create ring buffer\n");
+        return 1;
+    }
+    signal(SIGINT, interrupt);
+    signal(SIGTERM, interrupt);
+    printf("Hit CTRL+C to end profiling\n");
+    while (!stop) {
+        ring_buffer__poll(rb, 100);
+    }
+    ring_buffer__free(rb);
+    bpf_object__close(obj);
+    return 0;
+}
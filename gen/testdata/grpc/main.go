@@ -0,0 +1,61 @@
+// The gRPC fixture: a server of the health checking service on a port of
+// the loopback interface, whose address it prints once it's listening,
+// which serves until its standard input is closed. The "ready" service is
+// serving and others aren't found. With -check addr service it's instead a
+// client checking the health of service at addr and printing its status.
+//
+// It's a module of its own so go-bpf-gen doesn't depend on gRPC. go.mod
+// has the latest release tested and grpc-v1.69.mod the first with the
+// transport.ServerStream which embeds a pointer to transport.Stream.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func check(addr, service string) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	resp, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		fmt.Println(status.Code(err))
+		return
+	}
+	fmt.Println(resp.Status)
+}
+
+func main() {
+	checkAddr := flag.String("check", "", "check the health of the service named by the argument at this address")
+	flag.Parse()
+	if *checkAddr != "" {
+		check(*checkAddr, flag.Arg(0))
+		return
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("ready", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(l)
+	fmt.Println(l.Addr())
+	io.Copy(io.Discard, os.Stdin)
+}
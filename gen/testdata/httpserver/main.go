@@ -0,0 +1,37 @@
+// The HTTP server fixture: a server on a port of the loopback interface,
+// whose address it prints once it's listening, which serves until its
+// standard input is closed. /hello says hello, /slow does after 20ms and
+// other paths aren't found.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+func hello(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "hello")
+}
+
+func slow(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(20 * time.Millisecond)
+	hello(w, r)
+}
+
+func main() {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello", hello)
+	mux.HandleFunc("/slow", slow)
+	go http.Serve(l, mux)
+	fmt.Println(l.Addr())
+	io.Copy(io.Discard, os.Stdin)
+}
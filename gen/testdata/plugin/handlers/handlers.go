@@ -0,0 +1,11 @@
+// The plugin fixture: a Go plugin, built with -buildmode=plugin, exporting
+// a function with more than one return for the host fixture to call.
+package main
+
+//go:noinline
+func Serve(n int) int {
+	if n < 0 {
+		return 0
+	}
+	return n * 2
+}
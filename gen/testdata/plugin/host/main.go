@@ -0,0 +1,25 @@
+// The plugin host fixture: a process which loads the plugin named by its
+// argument, calls its Serve, says it's ready on its standard output then
+// runs until its standard input is closed.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"plugin"
+)
+
+func main() {
+	p, err := plugin.Open(os.Args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	serve, err := p.Lookup("Serve")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("ready", serve.(func(int) int)(len(os.Args)))
+	io.Copy(io.Discard, os.Stdin)
+}
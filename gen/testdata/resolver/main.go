@@ -0,0 +1,111 @@
+// The resolver fixture: it looks up the host names given as its arguments
+// with the pure Go resolver, which asks a DNS server of its own on a port
+// of the loopback interface rather than the system's, and prints what each
+// resolved to. Names starting with "ok." have the address 127.0.0.2 and
+// other names don't exist.
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	typeA     = 1
+	classINET = 1
+	// rcodeNameError is the response code for a name which doesn't exist
+	rcodeNameError = 3
+)
+
+// answer makes the response to the query, giving 127.0.0.2 for A queries
+// of names starting with "ok.", no addresses for other queries of them and
+// a name error for everything else
+func answer(query []byte) ([]byte, bool) {
+	if len(query) < 12 {
+		return nil, false
+	}
+	// the question follows the header, its name as labels prefixed by
+	// their lengths and ended by an empty label, then its type and class
+	end := 12
+	var labels []string
+	for end < len(query) && query[end] != 0 {
+		n := int(query[end])
+		if end+1+n > len(query) {
+			return nil, false
+		}
+		labels = append(labels, string(query[end+1:end+1+n]))
+		end += 1 + n
+	}
+	end += 5
+	if end > len(query) {
+		return nil, false
+	}
+	question := query[12:end]
+	qtype := binary.BigEndian.Uint16(question[len(question)-4:])
+
+	resp := make([]byte, 12, 64)
+	copy(resp, query[:2])
+	// a response to a query asking for recursion, which is available
+	flags := uint16(0x8180)
+	var answers uint16
+	switch {
+	case len(labels) == 0 || !strings.EqualFold(labels[0], "ok"):
+		flags |= rcodeNameError
+	case qtype == typeA:
+		answers = 1
+	}
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], answers)
+	resp = append(resp, question...)
+	if answers > 0 {
+		// the name is a pointer to the question's, then the type, class,
+		// TTL, length and address
+		resp = append(resp, 0xc0, 12, 0, typeA, 0, classINET, 0, 0, 0, 60, 0, 4, 127, 0, 0, 2)
+	}
+	return resp, true
+}
+
+// serve answers queries sent to conn
+func serve(conn net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp, ok := answer(buf[:n]); ok {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func main() {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	go serve(conn)
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+	for _, host := range os.Args[1:] {
+		addrs, err := resolver.LookupIPAddr(context.Background(), host)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Println(host, addrs)
+	}
+}
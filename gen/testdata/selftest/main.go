@@ -0,0 +1,126 @@
+// The selftest's fixture: a program using the packages the bundled
+// templates probe, and handle for the examples of templates probing the
+// functions given by symbol=. It's built, not run.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// handle takes arguments, defers and returns an error, and isn't inlined
+// so that it has a symbol
+//
+//go:noinline
+func handle(n int, name string) (err error) {
+	defer func() {
+		if n < 0 {
+			err = errors.New("negative")
+		}
+	}()
+	if name == "" {
+		return fmt.Errorf("no name for %d", n)
+	}
+	return nil
+}
+
+func main() {
+	if err := handle(len(os.Args), os.Args[0]); err != nil {
+		log.Print(err)
+	}
+
+	var mu sync.Mutex
+	var rw sync.RWMutex
+	var wg sync.WaitGroup
+	var pool sync.Pool
+	mu.Lock()
+	mu.Unlock()
+	rw.RLock()
+	rw.RUnlock()
+	rw.Lock()
+	rw.Unlock()
+	wg.Add(1)
+	go func() { defer wg.Done() }()
+	wg.Wait()
+	pool.Put(1)
+	pool.Get()
+
+	ch := make(chan int, 1)
+	ch <- 1
+	select {
+	case <-ch:
+	default:
+	}
+	m := map[int]int{}
+	for i := 0; i < 100; i++ {
+		m[i] = i
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	json.Marshal(b)
+	var x interface{}
+	json.Unmarshal([]byte("1"), &x)
+	json.NewEncoder(os.Stdout).Encode(1)
+	json.NewDecoder(os.Stdin).Decode(&x)
+	regexp.MustCompile("a+").MatchString("aa")
+	reflect.ValueOf(fmt.Sprint).Call([]reflect.Value{reflect.ValueOf(1)})
+
+	exec.Command("true").Run()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	cancel()
+	ctx, cancel = context.WithCancel(ctx)
+	cancel()
+	t := time.NewTicker(time.Second)
+	t.Stop()
+	time.NewTimer(time.Second)
+	time.Sleep(1)
+
+	db, _ := sql.Open("x", "y")
+	if db != nil {
+		db.QueryContext(ctx, "")
+		db.ExecContext(ctx, "")
+	}
+	var st *sql.Stmt
+	if st != nil {
+		st.QueryContext(ctx)
+		st.ExecContext(ctx)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	w.Write(b)
+	w.Flush()
+	bufio.NewReader(os.Stdin).ReadByte()
+	io.Copy(io.Discard, os.Stdin)
+	io.CopyBuffer(io.Discard, os.Stdin, b)
+
+	net.DefaultResolver.LookupIPAddr(ctx, "localhost")
+	d := net.Dialer{}
+	d.DialContext(ctx, "tcp", "127.0.0.1:1")
+	tls.Dial("tcp", "127.0.0.1:1", nil)
+	http.Get("http://127.0.0.1:1/")
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	if l, err := net.Listen("tcp", "127.0.0.1:0"); err == nil {
+		go http.Serve(l, nil)
+	}
+}
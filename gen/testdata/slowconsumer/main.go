@@ -0,0 +1,31 @@
+// The slow consumer fixture: a producer sending on an unbuffered channel to
+// a consumer which takes 5ms over each value, so that every send blocks,
+// which prints how long the sends took once they're done.
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const values = 20
+
+func consume(c <-chan int, done chan<- struct{}) {
+	for range c {
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(done)
+}
+
+func main() {
+	c := make(chan int)
+	done := make(chan struct{})
+	go consume(c, done)
+	start := time.Now()
+	for i := 0; i < values; i++ {
+		c <- i
+	}
+	close(c)
+	<-done
+	fmt.Printf("sent %d values in %s\n", values, time.Since(start).Round(time.Millisecond))
+}
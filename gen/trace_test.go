@@ -0,0 +1,114 @@
+package gen_test
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// traceEnv is the environment variable which, set to 1, has the end to end
+// tests run the scripts they generate under bpftrace. They need root and
+// their probes fire for every process running the fixtures.
+const traceEnv = "GO_BPF_GEN_TRACE"
+
+// traceOutput collects what bpftrace prints, noting when it has attached
+// its probes
+type traceOutput struct {
+	mu       sync.Mutex
+	out      bytes.Buffer
+	attached chan struct{}
+	once     sync.Once
+}
+
+func (o *traceOutput) read(r *os.File) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		o.mu.Lock()
+		o.out.WriteString(line + "\n")
+		o.mu.Unlock()
+		// the bundled templates print from BEGIN, which runs once the
+		// probes are attached
+		if strings.HasPrefix(line, "Hit CTRL+C") {
+			o.once.Do(func() { close(o.attached) })
+		}
+	}
+}
+
+func (o *traceOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.out.String()
+}
+
+// trace runs script under bpftrace while workload runs and returns what
+// bpftrace printed once it's interrupted after the workload, as its maps
+// are printed then. The test is skipped unless GO_BPF_GEN_TRACE=1, bpftrace
+// is on the PATH and the test is run as root.
+func trace(t *testing.T, script string, workload func()) string {
+	t.Helper()
+	if os.Getenv(traceEnv) != "1" {
+		t.Skipf("set %s=1 to run the script under bpftrace", traceEnv)
+	}
+	bpftrace, err := exec.LookPath("bpftrace")
+	if err != nil {
+		t.Skip("no bpftrace to run the script with")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("bpftrace needs root")
+	}
+	path := filepath.Join(t.TempDir(), "script.bt")
+	if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	cmd := exec.Command(bpftrace, path)
+	cmd.Stdout, cmd.Stderr = w, w
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		t.Fatal(err)
+	}
+	w.Close()
+	output := &traceOutput{attached: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		output.read(r)
+		close(done)
+	}()
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	select {
+	case <-output.attached:
+	case err := <-exited:
+		t.Fatalf("bpftrace exited before attaching its probes: %v\n%s", err, output)
+	case <-time.After(time.Minute):
+		cmd.Process.Kill()
+		t.Fatalf("bpftrace didn't attach its probes in a minute:\n%s", output)
+	}
+	workload()
+
+	cmd.Process.Signal(os.Interrupt)
+	select {
+	case err := <-exited:
+		<-done
+		if err != nil {
+			t.Fatalf("bpftrace: %v\n%s", err, output)
+		}
+	case <-time.After(time.Minute):
+		cmd.Process.Kill()
+		t.Fatalf("bpftrace didn't exit a minute after being interrupted:\n%s", output)
+	}
+	return output.String()
+}
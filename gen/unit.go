@@ -0,0 +1,70 @@
+package gen
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unitState returns the main pid, ActiveState and LoadState of a systemd
+// unit as given by systemctl show
+func unitState(unit string) (pid int, active, load string, err error) {
+	out, err := exec.Command("systemctl", "show", "-p", "MainPID", "-p", "ActiveState", "-p", "LoadState", unit).Output()
+	if err != nil {
+		return 0, "", "", fmt.Errorf("systemctl show %s: %w", unit, err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		k, v, _ := strings.Cut(line, "=")
+		switch k {
+		case "MainPID":
+			if pid, err = strconv.Atoi(v); err != nil {
+				return 0, "", "", fmt.Errorf("systemctl show %s: bad MainPID %s", unit, v)
+			}
+		case "ActiveState":
+			active = v
+		case "LoadState":
+			load = v
+		}
+	}
+	return pid, active, load, nil
+}
+
+// unitPid returns the pid of the main process of a systemd unit given by a
+// unit:<name> target
+func unitPid(unit string) (int, error) {
+	pid, active, load, err := unitState(unit)
+	if err != nil {
+		return 0, err
+	}
+	if load == "not-found" {
+		return 0, fmt.Errorf("no such unit %s", unit)
+	}
+	if pid == 0 {
+		return 0, fmt.Errorf("unit %s has no main process, its ActiveState is %s", unit, active)
+	}
+	return pid, nil
+}
+
+// WaitForUnit blocks until a systemd unit has a main process so probes can
+// be generated for a unit which is about to start
+func WaitForUnit(unit string) error {
+	for logged := false; ; logged = true {
+		pid, _, load, err := unitState(unit)
+		if err != nil {
+			return err
+		}
+		if load == "not-found" {
+			return fmt.Errorf("no such unit %s", unit)
+		}
+		if pid != 0 {
+			return nil
+		}
+		if !logged {
+			log.Printf("waiting for %s to start", unit)
+		}
+		time.Sleep(time.Second)
+	}
+}
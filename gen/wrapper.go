@@ -0,0 +1,175 @@
+package gen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// templateMeta is what a template has declared about running its script,
+// kept behind a pointer so it's shared by the copies of a Target passed to
+// helpers
+type templateMeta struct {
+	env map[string]string
+	// bpftrace is the oldest bpftrace version the script runs on
+	bpftrace string
+}
+
+// Env records an environment variable the script has to be run with such
+// as BPFTRACE_MAP_KEYS_MAX for the script -wrapper gives. When a variable
+// is given a number more than once the largest is kept. It gives an empty
+// string so can be used anywhere in a template.
+func (t Target) Env(name, value string) string {
+	if t.meta != nil {
+		setEnv(t.meta.env, name, value)
+	}
+	return ""
+}
+
+// setEnv sets env[name] to value unless both are numbers and the value
+// already set is larger
+func setEnv(env map[string]string, name, value string) {
+	if old, ok := env[name]; ok {
+		o, err1 := strconv.Atoi(old)
+		v, err2 := strconv.Atoi(value)
+		if err1 == nil && err2 == nil && o > v {
+			return
+		}
+	}
+	env[name] = value
+}
+
+// laterVersion returns the later of two bpftrace versions such as 0.16.0,
+// either of which may be empty. RequireBpftrace only records versions
+// which parse.
+func laterVersion(a, b string) string {
+	if a == "" {
+		return b
+	}
+	if later, _ := versionAtLeast("v"+b, "v"+a); b != "" && later {
+		return b
+	}
+	return a
+}
+
+// RequireBpftrace records the oldest version of bpftrace, such as "0.16.0",
+// the script runs on for -wrapper to check. It gives an empty string.
+func (t Target) RequireBpftrace(version string) (string, error) {
+	version = strings.TrimPrefix(version, "v")
+	if version == "" || version[0] < '0' || version[0] > '9' {
+		return "", fmt.Errorf("bad bpftrace version %q, must be like 0.16.0", version)
+	}
+	if t.meta == nil {
+		return "", nil
+	}
+	t.meta.bpftrace = laterVersion(t.meta.bpftrace, version)
+	return "", nil
+}
+
+// fingerprint identifies the build of a target: its GNU build ID or the
+// SHA-256 of the file when it hasn't one. The wrapper script checks it with
+// readelf or sha256sum.
+func fingerprint(exe *elfData) (kind, id string, err error) {
+	if id, err := elfBuildID(exe.elf); err == nil {
+		return "build-id", id, nil
+	}
+	h := sha256.New()
+	// the section ends where reading the file does
+	if _, err := io.Copy(h, io.NewSectionReader(exe.reader(), 0, math.MaxInt64)); err != nil {
+		return "", "", err
+	}
+	return "sha256", hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeWrapper writes a shell script which checks bpftrace is installed
+// and new enough, the kernel supports uprobes and that the targets are the
+// builds the script was generated for then runs the script with the
+// environment the templates asked for. Arguments to the wrapper are passed
+// on to bpftrace but --force first skips the build checks.
+func writeWrapper(w io.Writer, script string, targets []*Target) error {
+	env := map[string]string{}
+	bpftrace := ""
+	for _, t := range targets {
+		for k, v := range t.meta.env {
+			setEnv(env, k, v)
+		}
+		bpftrace = laterVersion(bpftrace, t.meta.bpftrace)
+	}
+
+	fmt.Fprintf(w, `#!/bin/sh
+# bpftrace script generated by go-bpf-gen with pre-flight checks. Run as
+# root with bpftrace options e.g. -o <file>, or --force first to run
+# against builds other than the ones the script was generated for.
+set -e
+force=
+if [ "$1" = --force ]; then
+  force=1
+  shift
+fi
+fail() {
+  echo "$0: $*" >&2
+  exit 1
+}
+[ "$(id -u)" = 0 ] || fail "bpftrace needs to be run as root"
+command -v bpftrace >/dev/null 2>&1 || fail "bpftrace isn't installed"
+`)
+	if bpftrace != "" {
+		fmt.Fprintf(w, `need=%s
+have=$(bpftrace --version | sed -n 's/^bpftrace v\{0,1\}\([0-9][0-9.]*\).*/\1/p')
+if [ "$(printf '%%s\n%%s\n' "$need" "$have" | sort -V | head -n 1)" != "$need" ]; then
+  fail "bpftrace $have is older than $need"
+fi
+`, bpftrace)
+	}
+	fmt.Fprintf(w, `config=/boot/config-$(uname -r)
+if [ -r "$config" ]; then
+  for c in CONFIG_BPF_SYSCALL CONFIG_UPROBE_EVENTS; do
+    grep -q "^$c=y" "$config" || fail "the kernel isn't built with $c"
+  done
+fi
+check() {
+  [ -e "$1" ] || fail "$1 doesn't exist"
+  [ -n "$force" ] && return
+  case $2 in
+  build-id) id=$(readelf -n "$1" | sed -n 's/.*Build ID: *//p') ;;
+  sha256) id=$(sha256sum "$1" | cut -d ' ' -f 1) ;;
+  esac
+  [ "$id" = "$3" ] || fail "$1 isn't the build the script was generated for ($2 $id not $3); use --force to run anyway"
+}
+`)
+	for _, t := range targets {
+		kind, id, err := fingerprint(t.bin.exe)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "check %s %s %s\n", shellQuote(t.ExePath), kind, id)
+	}
+	if strings.Contains(script, "\nGO_BPF_GEN_EOF\n") {
+		return fmt.Errorf("the script contains the wrapper's heredoc delimiter")
+	}
+	fmt.Fprintf(w, "program=$(cat <<'GO_BPF_GEN_EOF'\n%s\nGO_BPF_GEN_EOF\n)\n", strings.TrimRight(script, "\n"))
+	names := make([]string, 0, len(env))
+	for k := range env {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	exec := "exec"
+	if len(names) > 0 {
+		exec += " env"
+		for _, k := range names {
+			exec += " " + k + "=" + shellQuote(env[k])
+		}
+	}
+	_, err := fmt.Fprintf(w, "%s bpftrace \"$@\" -e \"$program\"\n", exec)
+	return err
+}
+
+// shellQuote quotes s for sh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
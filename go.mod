@@ -1,5 +1,5 @@
 module github.com/stevenjohnstone/go-bpf-gen
 
-go 1.17
+go 1.18
 
 require golang.org/x/arch v0.0.0-20210901143047-ebb09ed340f1
@@ -0,0 +1,273 @@
+package layout
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"sort"
+	"sync"
+)
+
+// Data is the DWARF data of an ELF file for looking up many functions and
+// structs. The functions and structs are indexed by name on first use
+// rather than the data being scanned for each lookup as FieldOffset,
+// Params and Results do.
+type Data struct {
+	data    *dwarf.Data
+	symbols []elf.Symbol
+
+	indexOnce   sync.Once
+	subprograms map[string]dwarf.Offset
+	structs     map[string]dwarf.Offset
+	indexErr    error
+
+	typesOnce sync.Once
+	types     []Type
+	typesErr  error
+
+	inlinedOnce sync.Once
+	// inlined maps the names of inlined functions to the functions they
+	// were inlined into
+	inlined    map[string][]string
+	inlinedErr error
+
+	// typeMu guards the cache of types kept by data which isn't safe for
+	// concurrent use
+	typeMu sync.Mutex
+}
+
+// NewData returns Data for DWARF data read from an ELF file with the
+// file's symbols, which RuntimeTypes needs. Data is safe for concurrent use.
+func NewData(data *dwarf.Data, symbols []elf.Symbol) *Data {
+	return &Data{data: data, symbols: symbols}
+}
+
+// index records the offsets of the first definitions of each subprogram and
+// struct in the compile units
+func (d *Data) index() error {
+	d.indexOnce.Do(func() {
+		d.subprograms = map[string]dwarf.Offset{}
+		d.structs = map[string]dwarf.Offset{}
+		reader := d.data.Reader()
+		for {
+			entry, err := reader.Next()
+			if err != nil {
+				d.indexErr = err
+				return
+			}
+			if entry == nil {
+				return
+			}
+			if entry.Tag == dwarf.TagCompileUnit {
+				continue
+			}
+			name, _ := entry.Val(dwarf.AttrName).(string)
+			// entries without children are declarations
+			if name != "" && entry.Children {
+				var names map[string]dwarf.Offset
+				switch entry.Tag {
+				case dwarf.TagSubprogram:
+					names = d.subprograms
+				case dwarf.TagStructType:
+					names = d.structs
+				}
+				if _, ok := names[name]; names != nil && !ok {
+					names[name] = entry.Offset
+				}
+			}
+			reader.SkipChildren()
+		}
+	})
+	return d.indexErr
+}
+
+// children returns a reader positioned at the children of the entry at
+// offset
+func (d *Data) children(offset dwarf.Offset) (*dwarf.Reader, error) {
+	reader := d.data.Reader()
+	reader.Seek(offset)
+	if _, err := reader.Next(); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+// FieldOffset is FieldOffset for the indexed data
+func (d *Data) FieldOffset(structName, field string) (int64, error) {
+	if err := d.index(); err != nil {
+		return 0, err
+	}
+	offset, ok := d.structs[structName]
+	if !ok {
+		return 0, ErrStructNotFound
+	}
+	reader, err := d.children(offset)
+	if err != nil {
+		return 0, err
+	}
+	return memberOffset(reader, field)
+}
+
+// Field returns the offset of field within the struct called structName
+// and its type, for following fields through the structs and pointers to
+// them they're given by e.g. embedded fields
+func (d *Data) Field(structName, field string) (int64, dwarf.Type, error) {
+	if err := d.index(); err != nil {
+		return 0, nil, err
+	}
+	offset, ok := d.structs[structName]
+	if !ok {
+		return 0, nil, ErrStructNotFound
+	}
+	reader, err := d.children(offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	entry, err := member(reader, field)
+	if err != nil {
+		return 0, nil, err
+	}
+	fieldOffset, ok := entry.Val(dwarf.AttrDataMemberLoc).(int64)
+	if !ok {
+		return 0, nil, ErrFieldNotFound
+	}
+	typeOffset, ok := entry.Val(dwarf.AttrType).(dwarf.Offset)
+	if !ok {
+		return 0, nil, ErrFieldNotFound
+	}
+	d.typeMu.Lock()
+	defer d.typeMu.Unlock()
+	typ, err := d.data.Type(typeOffset)
+	if err != nil {
+		return 0, nil, err
+	}
+	return fieldOffset, typ, nil
+}
+
+// Params is Params for the indexed data
+func (d *Data) Params(function string) ([]Param, error) {
+	return d.subprogramParams(function, false)
+}
+
+// Results is Results for the indexed data
+func (d *Data) Results(function string) ([]Param, error) {
+	return d.subprogramParams(function, true)
+}
+
+func (d *Data) subprogramParams(function string, results bool) ([]Param, error) {
+	if err := d.index(); err != nil {
+		return nil, err
+	}
+	offset, ok := d.subprograms[function]
+	if !ok {
+		return nil, ErrFunctionNotFound
+	}
+	reader, err := d.children(offset)
+	if err != nil {
+		return nil, err
+	}
+	d.typeMu.Lock()
+	defer d.typeMu.Unlock()
+	return formalParams(d.data, reader, results)
+}
+
+// RuntimeTypes is RuntimeTypes for the indexed data. The types are found
+// once and the same slice is returned each time so it mustn't be modified.
+func (d *Data) RuntimeTypes() ([]Type, error) {
+	d.typesOnce.Do(func() {
+		d.types, d.typesErr = runtimeTypes(d.data, d.symbols)
+	})
+	return d.types, d.typesErr
+}
+
+// InlinedCallers returns the names of the functions which function was
+// inlined into, sorted, or none if it never was. A function inlined into
+// another which was itself inlined is given the function whose code it
+// ended up in. The whole of the DWARF data is read on first use.
+func (d *Data) InlinedCallers(function string) ([]string, error) {
+	d.inlinedOnce.Do(func() {
+		d.inlined, d.inlinedErr = inlinedCallers(d.data)
+	})
+	return d.inlined[function], d.inlinedErr
+}
+
+// inlinedCallers maps the names of the functions described by the abstract
+// subprograms of data to the names of the subprograms with inlined copies
+// of them
+func inlinedCallers(data *dwarf.Data) (map[string][]string, error) {
+	names := map[dwarf.Offset]string{}
+	// inlinings maps the offsets of the subprograms of inlined functions
+	// to those of the subprograms they were inlined into
+	inlinings := map[dwarf.Offset]map[dwarf.Offset]bool{}
+	reader := data.Reader()
+	// caller is the top level subprogram being read and depth how deep in
+	// it the reader is
+	var caller dwarf.Offset
+	depth := 0
+	for {
+		entry, err := reader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Tag == 0 {
+			// the end of an entry's children, or of a compile unit's
+			if depth > 0 {
+				depth--
+			}
+			continue
+		}
+		if entry.Tag == dwarf.TagCompileUnit {
+			depth = 0
+			continue
+		}
+		if depth == 0 {
+			if entry.Tag != dwarf.TagSubprogram {
+				reader.SkipChildren()
+				continue
+			}
+			caller = entry.Offset
+			if name, ok := entry.Val(dwarf.AttrName).(string); ok {
+				names[entry.Offset] = name
+			} else if origin, ok := entry.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset); ok {
+				// an out of line copy of an inlined function is named by
+				// its abstract subprogram
+				caller = origin
+			}
+		}
+		if entry.Tag == dwarf.TagInlinedSubroutine {
+			if origin, ok := entry.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset); ok {
+				if inlinings[origin] == nil {
+					inlinings[origin] = map[dwarf.Offset]bool{}
+				}
+				inlinings[origin][caller] = true
+			}
+		}
+		if entry.Children {
+			depth++
+		}
+	}
+	callers := map[string][]string{}
+	for origin, into := range inlinings {
+		name, ok := names[origin]
+		if !ok {
+			continue
+		}
+		for c := range into {
+			if n, ok := names[c]; ok {
+				callers[name] = append(callers[name], n)
+			}
+		}
+		sort.Strings(callers[name])
+		// functions can have the same name in more than one compile unit
+		unique := callers[name][:0]
+		for i, n := range callers[name] {
+			if i == 0 || n != callers[name][i-1] {
+				unique = append(unique, n)
+			}
+		}
+		callers[name] = unique
+	}
+	return callers, nil
+}
@@ -0,0 +1,450 @@
+package layout
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrStructNotFound is returned when the DWARF data doesn't describe
+	// the requested struct
+	ErrStructNotFound = errors.New("struct not found")
+	// ErrFieldNotFound is returned when the struct has no field with the
+	// requested name
+	ErrFieldNotFound = errors.New("field not found")
+)
+
+// FieldOffset returns the offset of field within the struct called
+// structName (e.g. "runtime.g") using the DWARF data in the ELF file
+func FieldOffset(r io.ReaderAt, structName, field string) (int64, error) {
+	data, err := readDWARF(r)
+	if err != nil {
+		return 0, err
+	}
+	return fieldOffset(data, structName, field)
+}
+
+func fieldOffset(data *dwarf.Data, structName, field string) (int64, error) {
+	reader := data.Reader()
+	for {
+		entry, err := reader.Next()
+		if err != nil {
+			return 0, err
+		}
+		if entry == nil {
+			return 0, ErrStructNotFound
+		}
+		if entry.Tag != dwarf.TagStructType || entry.Val(dwarf.AttrName) != structName {
+			if entry.Tag != dwarf.TagCompileUnit {
+				reader.SkipChildren()
+			}
+			continue
+		}
+		if !entry.Children {
+			// declaration only
+			continue
+		}
+		return memberOffset(reader, field)
+	}
+}
+
+func memberOffset(reader *dwarf.Reader, field string) (int64, error) {
+	entry, err := member(reader, field)
+	if err != nil {
+		return 0, err
+	}
+	offset, ok := entry.Val(dwarf.AttrDataMemberLoc).(int64)
+	if !ok {
+		return 0, ErrFieldNotFound
+	}
+	return offset, nil
+}
+
+// member returns the entry of the member called field among the children
+// of a struct read by reader
+func member(reader *dwarf.Reader, field string) (*dwarf.Entry, error) {
+	for {
+		entry, err := reader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil || entry.Tag == 0 {
+			return nil, ErrFieldNotFound
+		}
+		if entry.Tag == dwarf.TagMember && entry.Val(dwarf.AttrName) == field {
+			return entry, nil
+		}
+	}
+}
+
+// readDWARF reads the DWARF data of the ELF file
+func readDWARF(r io.ReaderAt) (*dwarf.Data, error) {
+	file, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return file.DWARF()
+}
+
+// attrGoRuntimeType is the Go specific DWARF attribute giving the address
+// of a type's runtime type descriptor
+const attrGoRuntimeType dwarf.Attr = 0x2904
+
+// Type is a runtime type descriptor in the target
+type Type struct {
+	Name    string
+	Address uint64
+}
+
+// RuntimeTypes returns the types described by the DWARF data in the ELF
+// file which have runtime type descriptors, sorted by name
+func RuntimeTypes(r io.ReaderAt) ([]Type, error) {
+	file, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := file.DWARF()
+	if err != nil {
+		return nil, err
+	}
+	symbols, err := file.Symbols()
+	if err != nil {
+		return nil, err
+	}
+	return runtimeTypes(data, symbols)
+}
+
+func runtimeTypes(data *dwarf.Data, symbols []elf.Symbol) ([]Type, error) {
+	// recent toolchains record descriptor addresses relative to the start
+	// of the type data, runtime.types, rather than absolute addresses
+	var base uint64
+	for _, s := range symbols {
+		if s.Name == "runtime.types" {
+			base = s.Value
+			break
+		}
+	}
+
+	types := []Type{}
+	seen := map[uint64]bool{}
+	reader := data.Reader()
+	for {
+		entry, err := reader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			break
+		}
+		address, ok := entry.Val(attrGoRuntimeType).(uint64)
+		name, _ := entry.Val(dwarf.AttrName).(string)
+		if ok && address < base {
+			address += base
+		}
+		if ok && address != 0 && name != "" && !seen[address] {
+			seen[address] = true
+			types = append(types, Type{Name: name, Address: address})
+		}
+	}
+	sortTypes(types)
+	return types, nil
+}
+
+// TypeSymbols returns the types named by the type descriptor symbols in the
+// ELF file's symbol table such as "type:*os.File" ("type.*os.File" before
+// go1.20). Recent linkers merge the descriptors into one "type:*" symbol so
+// this finds little in their output; RuntimeTypes should be preferred where
+// there's DWARF data.
+func TypeSymbols(r io.ReaderAt) ([]Type, error) {
+	file, err := elf.NewFile(r)
+	if err != nil {
+		return nil, err
+	}
+	symbols, err := file.Symbols()
+	if err != nil {
+		return nil, err
+	}
+	return SymbolTypes(symbols), nil
+}
+
+// SymbolTypes is TypeSymbols for symbols which have already been read
+func SymbolTypes(symbols []elf.Symbol) []Type {
+	types := []Type{}
+	for _, s := range symbols {
+		if elf.ST_TYPE(s.Info) != elf.STT_OBJECT {
+			continue
+		}
+		var name string
+		switch {
+		case strings.HasPrefix(s.Name, "type:"):
+			name = strings.TrimPrefix(s.Name, "type:")
+		case strings.HasPrefix(s.Name, "type."):
+			name = strings.TrimPrefix(s.Name, "type.")
+		default:
+			continue
+		}
+		// skip the merged descriptors and the likes of type:.namedata.*
+		if name == "*" || name == "" || strings.HasPrefix(name, ".") {
+			continue
+		}
+		types = append(types, Type{Name: name, Address: s.Value})
+	}
+	sortTypes(types)
+	return types
+}
+
+// sortTypes sorts types by name and then address so types of the same name,
+// such as those local to functions, are in the same order each time
+func sortTypes(types []Type) {
+	sort.Slice(types, func(i, j int) bool {
+		if types[i].Name != types[j].Name {
+			return types[i].Name < types[j].Name
+		}
+		return types[i].Address < types[j].Address
+	})
+}
+
+// ErrFunctionNotFound is returned when the DWARF data doesn't describe the
+// requested function
+var ErrFunctionNotFound = errors.New("function not found")
+
+// Param is a parameter of a function
+type Param struct {
+	Name string
+	// Type is the name of the parameter's type e.g. "*runtime._type"
+	Type string
+	// Kind is how templates should read the parameter: "int", "uint",
+	// "bool", "float", "pointer", "string" or "other"
+	Kind string
+	// Size is the size of the parameter in bytes
+	Size int
+	// Align is the alignment of the parameter's type in bytes
+	Align int
+	// Offset is the offset of the parameter in bytes from the first of
+	// the parameters passed on the stack, which are laid out like the
+	// fields of a struct. Parameters smaller than a word may share one.
+	Offset int
+	// Word is the index of the 8 byte word the parameter starts in,
+	// counting from the first parameter, and Words is the number of words
+	// it takes. Templates pass Word to Arg.
+	Word  int
+	Words int
+	// IntRegs and FloatRegs are the number of integer and floating point
+	// registers the register ABI passes the parameter in, one for each of
+	// the basic values it's made of, when there are enough left.
+	// StackOnly is true for those it always passes on the stack, such as
+	// arrays of more than one element.
+	IntRegs   int
+	FloatRegs int
+	StackOnly bool
+	// Stack is true if the register ABI passes the parameter on the stack,
+	// with Offset giving where from the first one so passed. It's set by
+	// those assigning the registers, which DWARF data doesn't describe.
+	Stack bool
+}
+
+// Params returns the parameters of function in order using the DWARF data
+// in the ELF file. Results are left out. The parameters are laid out as the
+// stack calling convention, ABI0, passes them: aligned to their types one
+// after the other from the first word, so Word is the word each starts in.
+func Params(r io.ReaderAt, function string) ([]Param, error) {
+	data, err := readDWARF(r)
+	if err != nil {
+		return nil, err
+	}
+	return subprogramParams(data, function, false)
+}
+
+// Results returns the results of function in order using the DWARF data in
+// the ELF file. Words are counted from the first result as Ret expects.
+func Results(r io.ReaderAt, function string) ([]Param, error) {
+	data, err := readDWARF(r)
+	if err != nil {
+		return nil, err
+	}
+	return subprogramParams(data, function, true)
+}
+
+func subprogramParams(data *dwarf.Data, function string, results bool) ([]Param, error) {
+	reader := data.Reader()
+	for {
+		entry, err := reader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			return nil, ErrFunctionNotFound
+		}
+		if entry.Tag != dwarf.TagSubprogram || entry.Val(dwarf.AttrName) != function {
+			if entry.Tag != dwarf.TagCompileUnit {
+				reader.SkipChildren()
+			}
+			continue
+		}
+		if !entry.Children {
+			continue
+		}
+		return formalParams(data, reader, results)
+	}
+}
+
+// formalParams reads the parameters, or the results if results is true, of
+// the subprogram whose children reader is positioned at
+func formalParams(data *dwarf.Data, reader *dwarf.Reader, results bool) ([]Param, error) {
+	params := []Param{}
+	offset := 0
+	for {
+		entry, err := reader.Next()
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil || entry.Tag == 0 {
+			return params, nil
+		}
+		if entry.Tag != dwarf.TagFormalParameter {
+			if entry.Children {
+				reader.SkipChildren()
+			}
+			continue
+		}
+		// Go marks results as variable parameters
+		if result, _ := entry.Val(dwarf.AttrVarParam).(bool); result != results {
+			continue
+		}
+		p := Param{Words: 1, Align: 8, IntRegs: 1}
+		p.Name, _ = entry.Val(dwarf.AttrName).(string)
+		if off, ok := entry.Val(dwarf.AttrType).(dwarf.Offset); ok {
+			typ, err := data.Type(off)
+			if err != nil {
+				return nil, err
+			}
+			p.Type = typ.String()
+			p.Kind = kind(typ)
+			p.Size = int(typ.Size())
+			p.Align = alignment(typ)
+			p.IntRegs, p.FloatRegs, p.StackOnly = registers(typ)
+			if p.Size > 8 {
+				p.Words = (p.Size + 7) / 8
+			}
+		}
+		offset = AlignUp(offset, p.Align)
+		p.Offset = offset
+		p.Word = offset / 8
+		switch {
+		case p.Size > 0:
+			offset += p.Size
+		case p.Type == "":
+			// parameters of unknown type are taken to fill a word
+			offset += 8
+		}
+		params = append(params, p)
+	}
+}
+
+// AlignUp rounds n up to a multiple of align
+func AlignUp(n, align int) int {
+	if align <= 1 {
+		return n
+	}
+	return (n + align - 1) / align * align
+}
+
+// alignment gives the alignment of typ on a 64 bit architecture: that of
+// its largest field or element, or its size for the basic types
+func alignment(typ dwarf.Type) int {
+	switch t := typ.(type) {
+	case *dwarf.TypedefType:
+		return alignment(t.Type)
+	case *dwarf.StructType:
+		align := 1
+		for _, f := range t.Field {
+			if a := alignment(f.Type); a > align {
+				align = a
+			}
+		}
+		return align
+	case *dwarf.ArrayType:
+		return alignment(t.Type)
+	case *dwarf.ComplexType:
+		// complex numbers are aligned as their parts
+		if t.ByteSize >= 16 {
+			return 8
+		}
+		return 4
+	}
+	switch size := typ.Size(); {
+	case size >= 8:
+		return 8
+	case size >= 4:
+		return 4
+	case size >= 2:
+		return 2
+	}
+	return 1
+}
+
+// registers gives the number of integer and floating point registers the
+// register ABI passes a value of typ in: the basic values it's made of
+// once structs and arrays of one element are taken apart. stackOnly is
+// true if it's always passed on the stack.
+func registers(typ dwarf.Type) (ints, floats int, stackOnly bool) {
+	switch t := typ.(type) {
+	case *dwarf.TypedefType:
+		return registers(t.Type)
+	case *dwarf.StructType:
+		for _, field := range t.Field {
+			i, f, stack := registers(field.Type)
+			if stack {
+				return 0, 0, true
+			}
+			ints += i
+			floats += f
+		}
+		return ints, floats, false
+	case *dwarf.ArrayType:
+		switch t.Count {
+		case 0:
+			return 0, 0, false
+		case 1:
+			return registers(t.Type)
+		}
+		return 0, 0, true
+	case *dwarf.FloatType:
+		return 0, 1, false
+	case *dwarf.ComplexType:
+		return 0, 2, false
+	}
+	switch size := typ.Size(); {
+	case size == 0:
+		return 0, 0, false
+	case size <= 8:
+		return 1, 0, false
+	}
+	return 0, 0, true
+}
+
+func kind(typ dwarf.Type) string {
+	switch t := typ.(type) {
+	case *dwarf.IntType:
+		return "int"
+	case *dwarf.UintType:
+		return "uint"
+	case *dwarf.BoolType:
+		return "bool"
+	case *dwarf.FloatType:
+		return "float"
+	case *dwarf.PtrType:
+		return "pointer"
+	case *dwarf.StructType:
+		if t.StructName == "string" {
+			return "string"
+		}
+	case *dwarf.TypedefType:
+		return kind(t.Type)
+	}
+	return "other"
+}
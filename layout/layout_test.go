@@ -0,0 +1,126 @@
+package layout
+
+import (
+	"debug/elf"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// buildFixture builds testdata/<name>, skipping the test if there's no go
+// command to build it with
+func buildFixture(t *testing.T, name string) *os.File {
+	t.Helper()
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command to build the fixture with")
+	}
+	exe := filepath.Join(t.TempDir(), name)
+	cmd := exec.Command(goCmd, "build", "-o", exe, "./testdata/"+name)
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("building fixture: %v\n%s", err, out)
+	}
+	f, err := os.Open(exe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestParams(t *testing.T) {
+	f := buildFixture(t, "params")
+	tests := []struct {
+		function string
+		results  bool
+		want     []Param
+	}{
+		{"main.packed", false, []Param{
+			{Name: "a", Type: "bool", Kind: "bool", Size: 1, Align: 1, Offset: 0, Word: 0, Words: 1, IntRegs: 1},
+			{Name: "b", Type: "int32", Kind: "int", Size: 4, Align: 4, Offset: 4, Word: 0, Words: 1, IntRegs: 1},
+			{Name: "c", Type: "*main.T", Kind: "pointer", Size: 8, Align: 8, Offset: 8, Word: 1, Words: 1, IntRegs: 1},
+		}},
+		{"main.packed", true, []Param{
+			{Name: "~r0", Type: "bool", Kind: "bool", Size: 1, Align: 1, Offset: 0, Word: 0, Words: 1, IntRegs: 1},
+			{Name: "~r1", Type: "int16", Kind: "int", Size: 2, Align: 2, Offset: 2, Word: 0, Words: 1, IntRegs: 1},
+			{Name: "~r2", Type: "error", Kind: "other", Size: 16, Align: 8, Offset: 8, Word: 1, Words: 2, IntRegs: 2},
+		}},
+		{"main.mixed", false, []Param{
+			{Name: "a", Type: "uint8", Kind: "uint", Size: 1, Align: 1, Offset: 0, Word: 0, Words: 1, IntRegs: 1},
+			{Name: "b", Type: "uint16", Kind: "uint", Size: 2, Align: 2, Offset: 2, Word: 0, Words: 1, IntRegs: 1},
+			{Name: "s", Type: "struct string", Kind: "string", Size: 16, Align: 8, Offset: 8, Word: 1, Words: 2, IntRegs: 2},
+			{Name: "c", Type: "int8", Kind: "int", Size: 1, Align: 1, Offset: 24, Word: 3, Words: 1, IntRegs: 1},
+			{Name: "d", Type: "[3]uint8", Kind: "other", Size: 3, Align: 1, Offset: 25, Word: 3, Words: 1, StackOnly: true},
+			{Name: "e", Type: "int64", Kind: "int", Size: 8, Align: 8, Offset: 32, Word: 4, Words: 1, IntRegs: 1},
+		}},
+		{"main.regs", false, []Param{
+			{Name: "s", Type: "struct []uint8", Kind: "other", Size: 24, Align: 8, Offset: 0, Word: 0, Words: 3, IntRegs: 3},
+			{Name: "e", Type: "error", Kind: "other", Size: 16, Align: 8, Offset: 24, Word: 3, Words: 2, IntRegs: 2},
+			{Name: "f", Type: "float64", Kind: "float", Size: 8, Align: 8, Offset: 40, Word: 5, Words: 1, FloatRegs: 1},
+			{Name: "c", Type: "complex128", Kind: "other", Size: 16, Align: 8, Offset: 48, Word: 6, Words: 2, FloatRegs: 2},
+			{Name: "a", Type: "[2]int", Kind: "other", Size: 16, Align: 8, Offset: 64, Word: 8, Words: 2, StackOnly: true},
+			{Name: "one", Type: "[1]struct string", Kind: "other", Size: 16, Align: 8, Offset: 80, Word: 10, Words: 2, IntRegs: 2},
+			{Name: "p", Type: "main.pair", Kind: "other", Size: 8, Align: 4, Offset: 96, Word: 12, Words: 1, IntRegs: 1, FloatRegs: 1},
+			{Name: "z", Type: "struct struct {}", Kind: "other", Size: 0, Align: 1, Offset: 104, Word: 13, Words: 1},
+		}},
+	}
+	for _, test := range tests {
+		var got []Param
+		var err error
+		if test.results {
+			got, err = Results(f, test.function)
+		} else {
+			got, err = Params(f, test.function)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.function, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s results=%v:\n got %+v\nwant %+v", test.function, test.results, got, test.want)
+		}
+	}
+}
+
+func TestAlignUp(t *testing.T) {
+	for _, test := range []struct{ n, align, want int }{
+		{0, 8, 0}, {1, 8, 8}, {8, 8, 8}, {9, 4, 12}, {5, 1, 5}, {5, 0, 5},
+	} {
+		if got := AlignUp(test.n, test.align); got != test.want {
+			t.Errorf("AlignUp(%d, %d) = %d, want %d", test.n, test.align, got, test.want)
+		}
+	}
+}
+
+func TestInlinedCallers(t *testing.T) {
+	f, err := elf.NewFile(buildFixture(t, "inlined"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := f.DWARF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbols, err := f.Symbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewData(data, symbols)
+	for function, want := range map[string][]string{
+		"main.square": {"main.area", "main.volume"},
+		"main.cube":   {"main.volume"},
+		"main.double": {"main.area"},
+		"main.area":   nil,
+		"main.none":   nil,
+	} {
+		got, err := d.InlinedCallers(function)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s was inlined into %v, want %v", function, got, want)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+// The inlined functions fixture: square is small enough to always be
+// inlined so it has no symbol, into area directly and into volume through
+// cube, which is inlined too. double is inlined into area but also called
+// through a func value so it has an out of line copy.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func square(n int) int { return n * n }
+
+func cube(n int) int { return square(n) * n }
+
+func double(n int) int { return 2 * n }
+
+//go:noinline
+func area(w, h int) int { return square(w) - double(h) }
+
+//go:noinline
+func volume(n int) int { return cube(n) }
+
+func main() {
+	f := double
+	if len(os.Args) > 1 {
+		f = volume
+	}
+	fmt.Println(area(len(os.Args), 3), volume(len(os.Args)), f(3))
+}
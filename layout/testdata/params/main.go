@@ -0,0 +1,31 @@
+// The layout tests' fixture: functions whose parameters the stack calling
+// convention packs into shared words
+package main
+
+import "fmt"
+
+type T struct{ n int }
+
+//go:noinline
+func packed(a bool, b int32, c *T) (bool, int16, error) { return a, int16(b), nil }
+
+//go:noinline
+func mixed(a uint8, b uint16, s string, c int8, d [3]byte, e int64) int {
+	return int(a) + int(b) + len(s) + int(c) + len(d) + int(e)
+}
+
+type pair struct {
+	x int32
+	y float32
+}
+
+//go:noinline
+func regs(s []byte, e error, f float64, c complex128, a [2]int, one [1]string, p pair, z struct{}) int {
+	return len(s) + len(a) + len(one[0]) + int(f) + int(real(c)) + int(p.x)
+}
+
+func main() {
+	fmt.Println(packed(true, 1, &T{}))
+	fmt.Println(mixed(1, 2, "s", 3, [3]byte{}, 4))
+	fmt.Println(regs(nil, nil, 1, 2, [2]int{}, [1]string{""}, pair{}, struct{}{}))
+}
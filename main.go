@@ -1,156 +1,405 @@
 package main
 
 import (
-	"embed"
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
-	"text/template"
+	"text/tabwriter"
+	"time"
 
-	"github.com/stevenjohnstone/go-bpf-gen/abi"
-	"github.com/stevenjohnstone/go-bpf-gen/ret"
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
 )
 
-//go:embed templates
-var templates embed.FS
+func parseArguments(args []string) (scriptFile, targetExe string, kv map[string][]string, err error) {
+	kv = map[string][]string{}
+	if len(args) < 3 {
+		err = fmt.Errorf("usage %s [-format=<format>] [-offsets] [-fleet] [-wrapper] [-wait] [-offline] [-jobs=<n>] [-no-cache] [-v] [-pack=<dir>] [-map-prefix=<prefix>] [-max-probes=<n>] [-strict-args] [-o <file>] <template file> <target file, pid:<pid>, unit:<name>, container:<name> or k8s:<namespace>/<pod>[/<container>]> or %s selftest [<executable>]", args[0], args[0])
+		return
+	}
+	scriptFile, targetExe = args[1], args[2]
 
-type Target struct {
-	ExePath   string
-	Arguments func(string) []string
-	RegsABI   bool
-	offsets   map[string][]int
-}
+	args = args[3:]
 
-func (t Target) SymbolReturns(symbol string) ([]int, error) {
-	v, ok := t.offsets[symbol]
-	if ok {
-		return v, nil
-	}
-	f, err := os.Open(t.ExePath)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	offsets, err := ret.FindOffsets(f, symbol)
-	if err != nil {
-		return nil, err
+	for _, arg := range args {
+		s := strings.Split(arg, "=")
+		if len(s) != 2 {
+			err = fmt.Errorf("malformed argument %s, must be of form key=value", arg)
+			return
+		}
+		k, v := s[0], s[1]
+		kv[k] = append(kv[k], v)
 	}
-	t.offsets[symbol] = offsets
-	return offsets, nil
+	return
 }
 
-func (t Target) SymbolReturnsNoFail(symbol string) []int {
-	v, err := t.SymbolReturns(symbol)
-	if err != nil {
-		return []int{1}
+// splitTargets splits the arguments following the template of a fleet
+// command line into targets and key=value pairs
+func splitTargets(args []string) (targets, kv []string) {
+	for _, arg := range args {
+		if strings.Contains(arg, "=") {
+			kv = append(kv, arg)
+		} else {
+			targets = append(targets, arg)
+		}
 	}
-	return v
+	return targets, kv
 }
 
-func regsabi(exe string) (bool, error) {
-	f, err := os.Open(exe)
-	if err != nil {
-		return false, err
-	}
-	defer f.Close()
-	return abi.Regs(f)
+// hostFS opens template files by the paths given on the command line,
+// relative to the working directory or absolute, before the bundled
+// templates are tried
+type hostFS struct{}
+
+func (hostFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
 }
 
-var regs = [...]string{"ax", "bx", "cx", "di", "si", "r8", "r9", "r10", "r11"}
+// packs are the directories given by -pack
+type packs []string
+
+func (p *packs) String() string {
+	return strings.Join(*p, ",")
+}
 
-// Arg maps argument indices to bpftrace built-ins taking into account which ABI
-// is in use
-func (t Target) Arg(i int) string {
-	if t.RegsABI {
-		// rax, rbx, rcx, rdi, rsi, r8, r9, r10, r11 should do
-		if i < 0 || i >= len(regs) {
-			panic("argument out of bounds. roll your own")
+func (p *packs) Set(dir string) error {
+	*p = append(*p, dir)
+	return nil
+}
+
+// packDirs are the directories of the packs registered by registerPacks by
+// name
+var packDirs = map[string]string{}
+
+// registerPacks makes the templates in each of dirs available named after
+// the directory e.g. mypack/latency.bt for one in ./mypack. A directory
+// which is already registered, as by an earlier run in the same process,
+// is left as it is.
+func registerPacks(dirs []string) error {
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("template pack %s isn't a directory", dir)
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
 		}
-		return fmt.Sprintf("reg(\"%s\")", regs[i])
+		name := filepath.Base(abs)
+		if packDirs[name] == abs {
+			continue
+		}
+		if err := gen.RegisterTemplates(name, os.DirFS(abs)); err != nil {
+			return err
+		}
+		packDirs[name] = abs
 	}
+	return nil
+}
 
-	return fmt.Sprintf("sarg%d", i)
+// the exit statuses of the command
+const (
+	exitOK = iota
+	// exitFailed is for failures other than those below
+	exitFailed
+	// exitUsage is for bad flags or arguments
+	exitUsage
+	// exitTarget is for targets which couldn't be opened or understood
+	exitTarget
+	// exitGenerate is for templates which couldn't be found, parsed or
+	// rendered and symbols which couldn't be resolved
+	exitGenerate
+)
+
+func main() {
+	os.Exit(run(os.Args, os.Stdout, os.Stderr))
 }
 
-func NewTarget(exe string, arguments func(string) []string) (*Target, error) {
-	exe, err := filepath.Abs(exe)
-	if err != nil {
-		return nil, err
+// run runs the command with the command line args, writing the script to
+// stdout and messages to stderr, and returns the exit status. Nothing is
+// written to stdout unless the whole script was generated.
+func run(args []string, stdout, stderr io.Writer) int {
+	log.SetOutput(stderr)
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "", "output format: bpftrace, bcc, libbpf, stap, uprobe_events, perf or json (default from the template's extension)")
+	offsets := flags.Bool("offsets", false, "probe the target by address rather than symbol name (bpftrace only)")
+	offline := flags.Bool("offline", false, "only use debug files already in the debuginfod cache")
+	wait := flags.Bool("wait", false, "wait for a unit:<name> target to start")
+	wrapper := flags.Bool("wrapper", false, "give a shell script checking the host and running the bpftrace script")
+	fleet := flags.Bool("fleet", false, "render the template for each of several targets into one script (bpftrace only)")
+	jobs := flags.Int("jobs", runtime.GOMAXPROCS(0), "how many symbols to resolve at once")
+	noCache := flags.Bool("no-cache", false, "don't use or update the cache of what's been found in targets")
+	pruneAge := flags.String("prune-cache", "", "remove cache entries unused for longer than the given duration, 0 for all, and exit")
+	verbose := flags.Bool("v", false, "list the symbols resolved up front and report cache hits and misses")
+	var templatePacks packs
+	flags.Var(&templatePacks, "pack", "make the templates in a directory available as <directory name>/<template> (repeatable)")
+	list := flags.Bool("list", false, "list the bundled templates and those of the packs and exit")
+	mapPrefix := flags.String("map-prefix", "", "prefix the script's maps with <prefix>_, or a hash of the template and target with auto, so it can run alongside others")
+	maxProbes := flags.Int("max-probes", 0, "the most probes a bpftrace script may need, overriding max_probes= (default 512)")
+	strictArgs := flags.Bool("strict-args", false, "fail rather than warn when key=value arguments aren't read by the template")
+	output := flags.String("o", "", "write the script to a file, replacing it only once the script has been generated, rather than to stdout")
+	if err := flags.Parse(args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
 	}
-	f, err := os.Open(exe)
-	if err != nil {
-		return nil, err
+	if err := registerPacks(templatePacks); err != nil {
+		log.Print(err)
+		return exitUsage
 	}
-	defer f.Close()
-
-	regsAbi, err := regsabi(exe)
+	if *list {
+		names, err := gen.TemplateNames()
+		if err != nil {
+			log.Print(err)
+			return exitFailed
+		}
+		fmt.Fprintln(stdout, strings.Join(names, "\n"))
+		return exitOK
+	}
+	if *pruneAge != "" {
+		age, err := time.ParseDuration(*pruneAge)
+		if err != nil {
+			log.Printf("bad -prune-cache age: %s", err)
+			return exitUsage
+		}
+		removed, err := gen.PruneCache(gen.DefaultCacheDir(), age)
+		if err != nil {
+			log.Printf("failed to prune cache: %s", err)
+			return exitFailed
+		}
+		log.Printf("removed %d cache entries", removed)
+		return exitOK
+	}
+	if flags.Arg(0) == "selftest" {
+		return selfTest(flags.Args()[1:], stdout, *verbose)
+	}
+	args = append([]string{args[0]}, flags.Args()...)
+	if *format == gen.FormatJSON {
+		// a probe plan doesn't need a template
+		args = append([]string{args[0], ""}, args[1:]...)
+	}
+	var fleetTargets []string
+	if *fleet && len(args) > 2 {
+		// the targets are all the arguments without an =
+		var kv []string
+		fleetTargets, kv = splitTargets(args[2:])
+		args = args[:2]
+		if len(fleetTargets) > 0 {
+			args = append(args, fleetTargets[0])
+		}
+		args = append(args, kv...)
+	}
+	scriptFile, targetExe, kv, err := parseArguments(args)
 	if err != nil {
-		log.Printf("couldn't get regs abi (%s). falling back to stack calling convention", err)
+		log.Print(err)
+		return exitUsage
+	}
+	if *maxProbes > 0 {
+		// templates such as summary.bt check max_probes themselves
+		kv["max_probes"] = []string{strconv.Itoa(*maxProbes)}
+	}
+	if *format == "" {
+		*format = gen.FormatFor(scriptFile)
+	}
+	if *fleet && *format != gen.FormatBpftrace {
+		log.Print("-fleet is only supported for bpftrace output")
+		return exitUsage
 	}
 
-	return &Target{
-		ExePath:   exe,
-		Arguments: arguments,
-		RegsABI:   regsAbi,
-		offsets:   map[string][]int{},
-	}, nil
-}
-
-func parseArguments(args []string) (scriptFile, targetExe string, kv map[string][]string, err error) {
-	kv = map[string][]string{}
-	if len(args) < 3 {
-		err = fmt.Errorf("usage %s <template file> <target file>", args[0])
-		return
+	if *wait {
+		for _, t := range append([]string{targetExe}, fleetTargets...) {
+			if strings.HasPrefix(t, "unit:") {
+				if err := gen.WaitForUnit(strings.TrimPrefix(t, "unit:")); err != nil {
+					log.Print(err)
+					return exitFailed
+				}
+			}
+		}
 	}
-	scriptFile, targetExe = args[1], args[2]
 
-	args = args[3:]
+	opts := []gen.Option{
+		gen.WithArguments(kv),
+		gen.WithFormat(*format),
+		gen.WithJobs(*jobs),
+		gen.WithTemplates(hostFS{}),
+	}
+	if !*noCache {
+		opts = append(opts, gen.WithCacheDir(gen.DefaultCacheDir()))
+	}
+	if *offline {
+		opts = append(opts, gen.WithOffline())
+	}
+	if *verbose {
+		opts = append(opts, gen.WithVerbose())
+	}
+	if *offsets {
+		opts = append(opts, gen.WithAddressProbes())
+	}
+	if *wrapper {
+		opts = append(opts, gen.WithWrapper())
+	}
+	if *mapPrefix != "" {
+		opts = append(opts, gen.WithMapPrefix(*mapPrefix))
+	}
+	if *strictArgs {
+		opts = append(opts, gen.WithStrictArguments())
+	}
 
-	for _, arg := range args {
-		s := strings.Split(arg, "=")
-		if len(s) != 2 {
-			err = fmt.Errorf("malformed argument %s, must be of form key=value", arg)
-			return
+	if *fleet {
+		var targets []*gen.Target
+		for _, exe := range fleetTargets {
+			target, err := gen.NewTarget(exe, opts...)
+			if err != nil {
+				log.Printf("failed to process target %s: %s", exe, err)
+				return exitTarget
+			}
+			defer target.Close()
+			targets = append(targets, target)
 		}
-		k, v := s[0], s[1]
-		kv[k] = append(kv[k], v)
+		var script bytes.Buffer
+		if err := gen.GenerateFleet(&script, scriptFile, targets, nil); err != nil {
+			log.Print(err)
+			return generateStatus(err)
+		}
+		return writeScript(stdout, *output, script.Bytes(), *wrapper)
 	}
-	return
-}
 
-func main() {
-
-	scriptFile, targetExe, kv, err := parseArguments(os.Args)
+	target, err := gen.NewTarget(targetExe, opts...)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("failed to process target: %s", err)
+		return exitTarget
+	}
+	defer target.Close()
+	var script bytes.Buffer
+	if err := gen.Generate(&script, scriptFile, target, nil); err != nil {
+		log.Print(err)
+		return generateStatus(err)
 	}
+	return writeScript(stdout, *output, script.Bytes(), *wrapper)
+}
 
-	scriptTemplate, err := ioutil.ReadFile(scriptFile)
+// selfTest runs the selftest subcommand: every bundled template is
+// rendered against the executable given or, if none is, the fixture built
+// for it and the results are written to stdout as a table
+func selfTest(args []string, stdout io.Writer, verbose bool) int {
+	if len(args) > 1 {
+		log.Print("usage: selftest [<executable>]")
+		return exitUsage
+	}
+	var exe string
+	if len(args) == 1 {
+		exe = args[0]
+	} else {
+		dir, err := os.MkdirTemp("", "go-bpf-gen-selftest")
+		if err != nil {
+			log.Print(err)
+			return exitFailed
+		}
+		defer os.RemoveAll(dir)
+		if exe, err = gen.BuildSelfTestFixture(dir); err != nil {
+			log.Print(err)
+			return exitFailed
+		}
+	}
+	out := log.Writer()
+	if !verbose {
+		// the warnings of each template rendered would bury the table
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(out)
+	}
+	results, err := gen.SelfTest(exe)
 	if err != nil {
-		// try embedded files
-		f, err1 := templates.Open(scriptFile)
-		if err1 != nil {
-			log.Fatalf("failed to open %s on filesystem: (%s), tried embedded files got %s", scriptFile, err, err1)
+		log.SetOutput(out)
+		log.Printf("failed to process target: %s", err)
+		return exitTarget
+	}
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TEMPLATE\tARGS\tRESULT\tDETAIL")
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.Status]++
+		status := r.Status
+		if r.DryRun {
+			status += " (dry run)"
 		}
-		scriptTemplate, err = ioutil.ReadAll(f)
-		if err != nil {
-			panic(err)
+		detail := ""
+		if r.Err != nil {
+			// template errors go on to quote the template
+			detail, _, _ = strings.Cut(r.Err.Error(), "\n")
 		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Template, strings.Join(r.Args, " "), status, detail)
+	}
+	w.Flush()
+	fmt.Fprintf(stdout, "%d passed, %d failed, %d skipped\n", counts[gen.SelfTestPass], counts[gen.SelfTestFail], counts[gen.SelfTestSkip])
+	if counts[gen.SelfTestFail] > 0 {
+		return exitFailed
 	}
+	return exitOK
+}
 
-	target, err := NewTarget(targetExe, func(key string) []string {
-		return kv[key]
-	})
+// generateStatus is the exit status for err from generating a script:
+// arguments the template didn't read, with -strict-args, are bad usage
+func generateStatus(err error) int {
+	var argsErr *gen.ArgumentsError
+	if errors.As(err, &argsErr) {
+		return exitUsage
+	}
+	return exitGenerate
+}
 
-	if err != nil {
-		log.Fatalf("failed to process target: %s", err)
+// writeScript writes a generated script to stdout or, when given -o, the
+// file output. The file is replaced by renaming a temporary file so that
+// it's never left with part of a script. Wrapper scripts are made
+// executable.
+func writeScript(stdout io.Writer, output string, script []byte, executable bool) int {
+	if output == "" {
+		if _, err := stdout.Write(script); err != nil {
+			log.Printf("failed to write script: %s", err)
+			return exitFailed
+		}
+		return exitOK
 	}
+	mode := os.FileMode(0644)
+	if executable {
+		mode = 0755
+	}
+	if err := writeFile(output, script, mode); err != nil {
+		log.Printf("failed to write script: %s", err)
+		return exitFailed
+	}
+	return exitOK
+}
 
-	tmpl := template.Must(template.New("bpf").Funcs(template.FuncMap{"panic": func(s string) string { panic(s) }}).Parse(string(scriptTemplate)))
-	if err := tmpl.Execute(os.Stdout, target); err != nil {
-		log.Fatalf("failed to process template: %s", err)
+// writeFile replaces the file at path with data
+func writeFile(path string, data []byte, mode os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
 	}
+	return os.Rename(f.Name(), path)
 }
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+)
+
+var (
+	fixtureOnce sync.Once
+	fixtureDir  string
+	fixturePath string
+	fixtureErr  error
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if fixtureDir != "" {
+		os.RemoveAll(fixtureDir)
+	}
+	os.Exit(code)
+}
+
+// fixture returns the selftest's fixture, built once for all the tests.
+// Tests are skipped if there's no go command to build it with.
+func fixture(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go command to build the fixture with")
+	}
+	fixtureOnce.Do(func() {
+		if fixtureDir, fixtureErr = os.MkdirTemp("", "go-bpf-gen-fixture"); fixtureErr != nil {
+			return
+		}
+		fixturePath, fixtureErr = gen.BuildSelfTestFixture(fixtureDir)
+	})
+	if fixtureErr != nil {
+		t.Fatal(fixtureErr)
+	}
+	return fixturePath
+}
+
+// runCommand runs the command with args, after the program name and
+// -no-cache, and returns what it wrote and its exit status
+func runCommand(args ...string) (stdout, stderr string, status int) {
+	var out, errs bytes.Buffer
+	status = run(append([]string{"go-bpf-gen", "-no-cache"}, args...), &out, &errs)
+	return out.String(), errs.String(), status
+}
+
+func TestExitStatus(t *testing.T) {
+	exe := fixture(t)
+	missingDir := filepath.Join(t.TempDir(), "nothing", "script.bt")
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"generated", []string{"latency.bt", exe, "symbol=main.handle"}, exitOK},
+		{"listed", []string{"-list"}, exitOK},
+		{"help", []string{"-h"}, exitOK},
+		{"unwritable output", []string{"-o", missingDir, "latency.bt", exe, "symbol=main.handle"}, exitFailed},
+		{"unknown flag", []string{"-nothing", "latency.bt", exe}, exitUsage},
+		{"too few arguments", []string{"latency.bt"}, exitUsage},
+		{"malformed argument", []string{"latency.bt", exe, "symbol"}, exitUsage},
+		{"fleet with another format", []string{"-fleet", "-format=bcc", "latency.py.tmpl", exe}, exitUsage},
+		{"unread argument with -strict-args", []string{"-strict-args", "latency.bt", exe, "symbol=main.handle", "nothing=1"}, exitUsage},
+		{"missing target", []string{"latency.bt", filepath.Join(t.TempDir(), "nothing")}, exitTarget},
+		{"missing template", []string{"nothing.bt", exe}, exitGenerate},
+		{"template failing", []string{"slowest.bt", exe}, exitGenerate},
+		{"symbol not in the target", []string{"latency.bt", exe, "symbol=main.nothing"}, exitGenerate},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stdout, stderr, status := runCommand(test.args...)
+			if status != test.want {
+				t.Fatalf("exit status %d, want %d\nstderr: %s", status, test.want, stderr)
+			}
+			if status != exitOK && stdout != "" {
+				t.Errorf("%d bytes written to stdout for a failure", len(stdout))
+			}
+		})
+	}
+}
+
+// TestGenerated checks the command's script is the library's
+func TestGenerated(t *testing.T) {
+	exe := fixture(t)
+	stdout, stderr, status := runCommand("latency.bt", exe, "symbol=main.handle")
+	if status != exitOK {
+		t.Fatalf("exit status %d\n%s", status, stderr)
+	}
+	target, err := gen.NewTarget(exe, gen.WithArguments(map[string][]string{"symbol": {"main.handle"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	want, err := gen.GenerateString("latency.bt", target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout != want {
+		t.Errorf("the command wrote\n%s\nthe library gave\n%s", stdout, want)
+	}
+	if !strings.Contains(stdout, `"main.handle"`) {
+		t.Errorf("no probe of main.handle in\n%s", stdout)
+	}
+}
+
+// TestErrors checks the command's messages for what users get wrong and
+// that nothing is written to stdout for them
+func TestErrors(t *testing.T) {
+	exe := fixture(t)
+	dir := t.TempDir()
+	script := filepath.Join(dir, "script.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho hi\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	text := filepath.Join(dir, "text")
+	if err := os.WriteFile(text, []byte("not an executable\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	unreadable := filepath.Join(dir, "unreadable")
+	if err := os.WriteFile(unreadable, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		args   []string
+		status int
+		want   string
+		// root reads files whatever their permissions
+		notRoot bool
+	}{
+		{"missing executable", []string{"latency.bt", filepath.Join(dir, "nothing")}, exitTarget,
+			"failed to process target: open " + filepath.Join(dir, "nothing") + ": no such file or directory", false},
+		{"unreadable executable", []string{"latency.bt", unreadable}, exitTarget,
+			"failed to process target: open " + unreadable + ": permission denied", true},
+		{"directory", []string{"latency.bt", dir}, exitTarget, "failed to process target: ", false},
+		{"script", []string{"latency.bt", script}, exitTarget,
+			"failed to process target: " + script + " is a script run by /bin/sh; the target must be the ELF binary it runs", false},
+		{"not ELF", []string{"latency.bt", text}, exitTarget, "failed to process target: bad magic number", false},
+		{"bad template path", []string{"nothing/latency.bt", exe}, exitGenerate,
+			"failed to open nothing/latency.bt (open nothing/latency.bt: no such file or directory), tried embedded files", false},
+		{"argument without =", []string{"latency.bt", exe, "symbol"}, exitUsage,
+			"malformed argument symbol, must be of form key=value", false},
+		{"argument with two =", []string{"latency.bt", exe, "a=b=c"}, exitUsage,
+			"malformed argument a=b=c, must be of form key=value", false},
+		{"bad abi", []string{"latency.bt", exe, "symbol=main.handle", "abi=nothing"}, exitGenerate,
+			"bad abi=nothing", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.notRoot && os.Geteuid() == 0 {
+				t.Skip("root can read the file")
+			}
+			stdout, stderr, status := runCommand(test.args...)
+			if status != test.status {
+				t.Errorf("exit status %d, want %d", status, test.status)
+			}
+			if !strings.Contains(stderr, test.want) {
+				t.Errorf("stderr is %q, want %q in it", stderr, test.want)
+			}
+			if strings.Contains(stderr, "panic") {
+				t.Errorf("panicked: %s", stderr)
+			}
+			if stdout != "" {
+				t.Errorf("%d bytes written to stdout: %q", len(stdout), stdout)
+			}
+		})
+	}
+}
+
+// TestFailureWritesNothing checks a script failing to generate, in any
+// format, writes nothing to stdout and leaves the -o file as it was
+func TestFailureWritesNothing(t *testing.T) {
+	exe := fixture(t)
+	tests := []struct {
+		format string
+		args   []string
+	}{
+		{gen.FormatBpftrace, []string{"latency.bt"}},
+		{gen.FormatBCC, []string{"latency.py.tmpl"}},
+		{gen.FormatLibbpf, []string{"latency.bpf.c.tmpl"}},
+		{gen.FormatSystemTap, []string{"skeleton.stp"}},
+		{gen.FormatUprobeEvents, []string{"probes.events.tmpl"}},
+		{gen.FormatPerf, []string{"probes.perf.tmpl"}},
+		{gen.FormatJSON, []string{"-format=json"}},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			args := append(append([]string{}, test.args...), exe, "symbol=main.nothing")
+			stdout, stderr, status := runCommand(args...)
+			if status != exitGenerate {
+				t.Fatalf("exit status %d, want %d\nstderr: %s", status, exitGenerate, stderr)
+			}
+			if stdout != "" {
+				t.Errorf("%d bytes written to stdout", len(stdout))
+			}
+
+			dir := t.TempDir()
+			missing := filepath.Join(dir, "missing")
+			existing := filepath.Join(dir, "existing")
+			if err := os.WriteFile(existing, []byte("the last script\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			for _, output := range []string{missing, existing} {
+				stdout, _, status := runCommand(append([]string{"-o", output}, args...)...)
+				if status != exitGenerate {
+					t.Errorf("-o %s: exit status %d, want %d", filepath.Base(output), status, exitGenerate)
+				}
+				if stdout != "" {
+					t.Errorf("-o %s: %d bytes written to stdout", filepath.Base(output), len(stdout))
+				}
+			}
+			if _, err := os.Stat(missing); !os.IsNotExist(err) {
+				t.Errorf("-o missing: the file was created (%v)", err)
+			}
+			data, err := os.ReadFile(existing)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "the last script\n" {
+				t.Errorf("-o existing: the file was changed to %q", data)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				var names []string
+				for _, e := range entries {
+					names = append(names, e.Name())
+				}
+				t.Errorf("files left in the -o directory: %s", strings.Join(names, ", "))
+			}
+		})
+	}
+}
+
+// TestOutputFile checks -o replaces the file with the whole script and no
+// temporary file is left beside it
+func TestOutputFile(t *testing.T) {
+	exe := fixture(t)
+	want, _, status := runCommand("latency.bt", exe, "symbol=main.handle")
+	if status != exitOK {
+		t.Fatalf("exit status %d", status)
+	}
+	dir := t.TempDir()
+	output := filepath.Join(dir, "latency.bt")
+	if err := os.WriteFile(output, []byte("the last script\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, status := runCommand("-o", output, "latency.bt", exe, "symbol=main.handle")
+	if status != exitOK {
+		t.Fatalf("exit status %d\n%s", status, stderr)
+	}
+	if stdout != "" {
+		t.Errorf("%d bytes written to stdout with -o", len(stdout))
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("-o wrote\n%s\nstdout has\n%s", data, want)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("%d files in the -o directory (%v), want 1", len(entries), err)
+	}
+}
+
+// TestPacks checks the templates of the example pack given with -pack are
+// listed and rendered as examplepack/<template> and that packs which can't
+// be registered are usage errors
+func TestPacks(t *testing.T) {
+	exe := fixture(t)
+	pack := filepath.Join("testdata", "examplepack")
+	stdout, stderr, status := runCommand("-pack", pack, "-list")
+	if status != exitOK {
+		t.Fatalf("exit status %d\n%s", status, stderr)
+	}
+	listed := strings.Split(strings.TrimSpace(stdout), "\n")
+	if !contains(listed, "examplepack/calls.bt") || !contains(listed, "latency.bt") {
+		t.Errorf("-list gave\n%s", stdout)
+	}
+
+	// the pack is registered again for each run
+	stdout, stderr, status = runCommand("-pack", pack, "examplepack/calls.bt", exe, "symbol=main.handle")
+	if status != exitOK {
+		t.Fatalf("exit status %d\n%s", status, stderr)
+	}
+	if probe := `uprobe:` + exe + `:"main.handle"`; !strings.Contains(stdout, probe) {
+		t.Errorf("no %s in\n%s", probe, stdout)
+	}
+	if _, stderr, status := runCommand("-pack", pack, "examplepack/nothing.bt", exe); status != exitGenerate || !strings.Contains(stderr, "failed to open examplepack/nothing.bt") {
+		t.Errorf("a template the pack doesn't have gave exit status %d\n%s", status, stderr)
+	}
+
+	other := filepath.Join(t.TempDir(), "examplepack")
+	if err := os.Mkdir(other, 0755); err != nil {
+		t.Fatal(err)
+	}
+	bundled := filepath.Join(t.TempDir(), "http")
+	if err := os.Mkdir(bundled, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		dir, want string
+	}{
+		{other, "template pack examplepack is already registered"},
+		{bundled, "template pack http would hide bundled templates of the same name"},
+		{filepath.Join(pack, "calls.bt"), "template pack " + filepath.Join(pack, "calls.bt") + " isn't a directory"},
+		{filepath.Join(t.TempDir(), "nothing"), "no such file or directory"},
+	} {
+		stdout, stderr, status := runCommand("-pack", test.dir, "-list")
+		if status != exitUsage || stdout != "" || !strings.Contains(stderr, test.want) {
+			t.Errorf("-pack %s: got exit status %d\n%s\nwant %d and %s", test.dir, status, stderr, exitUsage, test.want)
+		}
+	}
+}
+
+func contains(s []string, want string) bool {
+	for _, v := range s {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
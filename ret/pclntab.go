@@ -0,0 +1,60 @@
+package ret
+
+import (
+	"debug/elf"
+	"debug/gosym"
+	"errors"
+	"fmt"
+)
+
+// ErrNoPclntab is returned for files without the .gopclntab section which
+// Go executables keep even when their symbol tables are stripped
+var ErrNoPclntab = errors.New("no .gopclntab section")
+
+// PclntabSymbols makes function symbols from the Go function table in the
+// .gopclntab section of file, for executables built with -ldflags=-s whose
+// symbol tables are gone. Only functions are found and their sizes run to
+// the start of the next function.
+func PclntabSymbols(file *elf.File) ([]elf.Symbol, error) {
+	pclntab := file.Section(".gopclntab")
+	if pclntab == nil {
+		return nil, ErrNoPclntab
+	}
+	data, err := pclntab.Data()
+	if err != nil {
+		return nil, fmt.Errorf(".gopclntab: %w", err)
+	}
+	text := file.Section(".text")
+	if text == nil {
+		return nil, errors.New("no .text section")
+	}
+	// go1.18 and later give the start of the text in the table itself
+	table, err := gosym.NewTable(nil, gosym.NewLineTable(data, text.Addr))
+	if err != nil {
+		return nil, fmt.Errorf(".gopclntab: %w", err)
+	}
+	symbols := make([]elf.Symbol, 0, len(table.Funcs))
+	for _, f := range table.Funcs {
+		section, err := Section(file, elf.Symbol{Value: f.Entry, Size: f.End - f.Entry})
+		if err != nil {
+			continue
+		}
+		index := elf.SHN_UNDEF
+		for i, s := range file.Sections {
+			if s == section {
+				index = elf.SectionIndex(i)
+			}
+		}
+		symbols = append(symbols, elf.Symbol{
+			Name:    f.Name,
+			Info:    elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC),
+			Section: index,
+			Value:   f.Entry,
+			Size:    f.End - f.Entry,
+		})
+	}
+	if len(symbols) == 0 {
+		return nil, errors.New(".gopclntab has no functions")
+	}
+	return symbols, nil
+}
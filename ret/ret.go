@@ -1,8 +1,11 @@
 package ret
 
 import (
+	"bytes"
 	"debug/elf"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 
 	"golang.org/x/arch/x86/x86asm"
@@ -15,6 +18,9 @@ var (
 	// ErrNoRetFound is returned when no RET instructions are found in
 	// the function
 	ErrNoRetFound = errors.New("no RET instructions found")
+	// ErrUnsupportedMachine is returned for code of an architecture
+	// whose return instructions can't be found
+	ErrUnsupportedMachine = errors.New("unsupported machine")
 )
 
 // FindOffsets finds all the offsets within a given function
@@ -25,6 +31,17 @@ func FindOffsets(r io.ReaderAt, symbolName string) ([]int, error) {
 		return nil, err
 	}
 	symbols, err := file.Symbols()
+	// shared objects export symbols in the dynamic symbol table which is
+	// kept when they're stripped
+	if dynamic, dynErr := file.DynamicSymbols(); dynErr == nil && len(dynamic) > 0 {
+		symbols, err = append(symbols, dynamic...), nil
+	}
+	// executables stripped of their symbol tables still have .gopclntab
+	if file.Section(".symtab") == nil {
+		if pclntab, pclnErr := PclntabSymbols(file); pclnErr == nil {
+			symbols, err = append(symbols, pclntab...), nil
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -41,18 +58,41 @@ func FindOffsets(r io.ReaderAt, symbolName string) ([]int, error) {
 	if !found {
 		return nil, ErrSymbolNotFound
 	}
+	return Offsets(file, symbol)
+}
 
-	section := file.Sections[symbol.Section]
-
-	text, err := section.Data()
+// Offsets finds the offsets of RET instructions in the function symbol
+// within the code of file. The symbol can come from another file such as a
+// separate debug file for file.
+func Offsets(file *elf.File, symbol elf.Symbol) ([]int, error) {
+	section, err := Section(file, symbol)
 	if err != nil {
 		return nil, err
 	}
+	// read just the function rather than the whole section as this is
+	// called for many symbols
+	function := make([]byte, symbol.Size)
+	if _, err := section.ReadAt(function, int64(symbol.Value-section.Addr)); err != nil {
+		return nil, err
+	}
+	return DecodeMachine(function, file.Machine, file.ByteOrder)
+}
 
-	start := symbol.Value - section.Addr
-	end := start + symbol.Size
+// Section returns the section of file holding the code of the function
+// symbol
+func Section(file *elf.File, symbol elf.Symbol) (*elf.Section, error) {
+	for _, s := range file.Sections {
+		if s.Type != elf.SHT_NOBITS && s.Flags&elf.SHF_EXECINSTR != 0 &&
+			symbol.Value >= s.Addr && symbol.Value+symbol.Size <= s.Addr+s.Size {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("no code for symbol %s at 0x%x", symbol.Name, symbol.Value)
+}
 
-	function := text[start:end]
+// Decode finds the offsets of RET instructions in the amd64 machine code of
+// a function in increasing order
+func Decode(function []byte) ([]int, error) {
 	returns := []int{}
 
 	for i := 0; i < len(function); {
@@ -71,3 +111,84 @@ func FindOffsets(r io.ReaderAt, symbolName string) ([]int, error) {
 
 	return returns, nil
 }
+
+// DecodeMachine finds the offsets of return instructions in the machine
+// code of a function for the architecture machine with the byte order
+// order, as given by the ELF header, in increasing order. amd64, arm64,
+// s390x and ppc64 in either byte order are supported.
+func DecodeMachine(function []byte, machine elf.Machine, order binary.ByteOrder) ([]int, error) {
+	switch machine {
+	case elf.EM_X86_64:
+		return Decode(function)
+	case elf.EM_S390:
+		return decodeS390x(function)
+	case elf.EM_PPC64:
+		return decodePPC64(function, order)
+	case elf.EM_AARCH64:
+		return decodeFixed(function, order, arm64Return)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedMachine, machine)
+}
+
+// s390xReturn is BR R14 (BCR 15, R14) which Go returns with
+var s390xReturn = []byte{0x07, 0xfe}
+
+// decodeS390x finds the returns in s390x code. Instructions are 2, 4 or 6
+// bytes long as given by the top two bits of their first byte so only
+// their lengths need decoding.
+func decodeS390x(function []byte) ([]int, error) {
+	returns := []int{}
+	for i := 0; i < len(function); {
+		var n int
+		switch function[i] >> 6 {
+		case 0:
+			n = 2
+		case 1, 2:
+			n = 4
+		default:
+			n = 6
+		}
+		if i+n > len(function) {
+			return nil, fmt.Errorf("truncated instruction at offset %d", i)
+		}
+		if bytes.Equal(function[i:i+n], s390xReturn) {
+			returns = append(returns, i)
+		}
+		i += n
+	}
+	if len(returns) == 0 {
+		return returns, ErrNoRetFound
+	}
+	return returns, nil
+}
+
+// ppc64Return is BLR (branch to the link register) which Go returns with
+const ppc64Return = 0x4e800020
+
+// arm64Return is RET (to the address in R30) which Go returns with
+const arm64Return = 0xd65f03c0
+
+// decodePPC64 finds the returns in ppc64 code, whose instructions are all
+// 4 bytes long in the byte order of the executable
+func decodePPC64(function []byte, order binary.ByteOrder) ([]int, error) {
+	return decodeFixed(function, order, ppc64Return)
+}
+
+// decodeFixed finds the return instructions ret in code whose instructions
+// are all 4 bytes long in the byte order of the executable, as on arm64
+// and ppc64
+func decodeFixed(function []byte, order binary.ByteOrder, ret uint32) ([]int, error) {
+	if len(function)%4 != 0 {
+		return nil, fmt.Errorf("function of %d bytes isn't made of 4 byte instructions", len(function))
+	}
+	returns := []int{}
+	for i := 0; i < len(function); i += 4 {
+		if order.Uint32(function[i:]) == ret {
+			returns = append(returns, i)
+		}
+	}
+	if len(returns) == 0 {
+		return returns, ErrNoRetFound
+	}
+	return returns, nil
+}
@@ -0,0 +1,96 @@
+package ret
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeMachine(t *testing.T) {
+	tests := []struct {
+		name    string
+		machine elf.Machine
+		order   binary.ByteOrder
+		code    []byte
+		want    []int
+		err     error
+	}{
+		// MOV EAX, 0xc3 has a C3 which isn't a RET
+		{"amd64", elf.EM_X86_64, binary.LittleEndian, []byte{0xb8, 0xc3, 0, 0, 0, 0xc3, 0x90, 0xc3}, []int{5, 7}, nil},
+		{"amd64 without returns", elf.EM_X86_64, binary.LittleEndian, []byte{0x90, 0x90}, []int{}, ErrNoRetFound},
+		// BR R14 after a 2, a 4 and a 6 byte instruction, and 07fe in the
+		// middle of the 4 byte one which isn't a return
+		{"s390x", elf.EM_S390, binary.BigEndian, []byte{
+			0x07, 0xfe,
+			0x18, 0x12,
+			0x07, 0xfe,
+			0x58, 0x07, 0xfe, 0x00,
+			0x07, 0xfe,
+			0xe3, 0x10, 0xf0, 0x08, 0x00, 0x04,
+			0x07, 0xfe,
+		}, []int{0, 4, 10, 18}, nil},
+		{"s390x truncated", elf.EM_S390, binary.BigEndian, []byte{0x07, 0xfe, 0xe3, 0x10}, nil, errors.New("truncated instruction at offset 2")},
+		{"s390x without returns", elf.EM_S390, binary.BigEndian, []byte{0x07, 0x0e}, []int{}, ErrNoRetFound},
+		{"ppc64", elf.EM_PPC64, binary.BigEndian, []byte{0x60, 0, 0, 0, 0x4e, 0x80, 0x00, 0x20, 0x4e, 0x80, 0x00, 0x20}, []int{4, 8}, nil},
+		{"ppc64le", elf.EM_PPC64, binary.LittleEndian, []byte{0, 0, 0, 0x60, 0x20, 0x00, 0x80, 0x4e}, []int{4}, nil},
+		// BLR in the other byte order isn't one
+		{"ppc64 in the wrong order", elf.EM_PPC64, binary.LittleEndian, []byte{0x4e, 0x80, 0x00, 0x20}, []int{}, ErrNoRetFound},
+		{"ppc64 misaligned", elf.EM_PPC64, binary.BigEndian, []byte{0x4e, 0x80, 0x00, 0x20, 0x60}, nil, errors.New("function of 5 bytes isn't made of 4 byte instructions")},
+		{"arm64", elf.EM_AARCH64, binary.LittleEndian, []byte{0x1f, 0x20, 0x03, 0xd5, 0xc0, 0x03, 0x5f, 0xd6}, []int{4}, nil},
+		{"unsupported", elf.EM_MIPS, binary.BigEndian, []byte{0x03, 0xe0, 0x00, 0x08}, nil, ErrUnsupportedMachine},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := DecodeMachine(test.code, test.machine, test.order)
+			switch {
+			case test.err == nil && err != nil:
+				t.Fatal(err)
+			case test.err != nil && !errors.Is(err, test.err) && (err == nil || err.Error() != test.err.Error()):
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// TestDecodeBigEndian decodes main.classify from testdata/bigendian as
+// built for s390x and ppc64, and for ppc64le by swapping the bytes of each
+// instruction. The returns are those go tool objdump gives.
+func TestDecodeBigEndian(t *testing.T) {
+	tests := []struct {
+		file    string
+		machine elf.Machine
+		order   binary.ByteOrder
+		want    []int
+	}{
+		{"classify.s390x", elf.EM_S390, binary.BigEndian, []int{96, 126, 272, 328, 348}},
+		{"classify.ppc64", elf.EM_PPC64, binary.BigEndian, []int{128, 164, 320, 380, 404}},
+		{"classify.ppc64", elf.EM_PPC64, binary.LittleEndian, []int{128, 164, 320, 380, 404}},
+	}
+	for _, test := range tests {
+		t.Run(test.file+" "+test.order.String(), func(t *testing.T) {
+			code, err := os.ReadFile(filepath.Join("testdata", "bigendian", test.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.order == binary.LittleEndian {
+				for i := 0; i+4 <= len(code); i += 4 {
+					binary.LittleEndian.PutUint32(code[i:], binary.BigEndian.Uint32(code[i:]))
+				}
+			}
+			got, err := DecodeMachine(code, test.machine, test.order)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
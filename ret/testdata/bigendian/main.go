@@ -0,0 +1,39 @@
+// Command bigendian is the source of the s390x and ppc64 code in
+// ret/testdata, built with
+//
+//	GOOS=linux GOARCH=s390x go build -o bigendian.s390x .
+//	GOOS=linux GOARCH=ppc64 go build -o bigendian.ppc64 .
+//
+// with main.classify's code copied out of each into classify.s390x and
+// classify.ppc64. go tool objdump -s main.classify gives where its returns
+// are.
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// classify returns from several places so its code has several returns
+//
+//go:noinline
+func classify(s string, n int) (string, error) {
+	switch {
+	case n < 0:
+		return "", fmt.Errorf("negative %d", n)
+	case len(s) == 0:
+		return "empty", nil
+	case s[0] == '/':
+		return "path", nil
+	}
+	for i := 0; i < n && i < len(s); i++ {
+		if s[i] == ':' {
+			return s[:i], nil
+		}
+	}
+	return s, nil
+}
+
+func main() {
+	fmt.Println(classify(os.Args[0], len(os.Args)))
+}
@@ -0,0 +1,152 @@
+package schema_test
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/schema"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// fields lists the JSON fields of typ, and of the structs it holds, as
+// lines of path, Go type and whether it's left out when empty
+func fields(typ reflect.Type, path string) []string {
+	var lines []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		line := fmt.Sprintf("%s%s %s", path, name, field.Type)
+		if options == "omitempty" {
+			line += " omitempty"
+		}
+		lines = append(lines, line)
+		elem := field.Type
+		suffix := "."
+		for elem.Kind() == reflect.Slice || elem.Kind() == reflect.Ptr {
+			if elem.Kind() == reflect.Slice {
+				suffix = "[]" + suffix
+			}
+			elem = elem.Elem()
+		}
+		if elem.Kind() == reflect.Struct {
+			lines = append(lines, fields(elem, path+name+suffix)...)
+		}
+	}
+	return lines
+}
+
+// TestCompatible checks the fields of a plan are those of
+// testdata/v<Version>.fields. Removing or changing one needs Version bumped
+// and a new file written with -update; adding one only needs the file
+// updated.
+func TestCompatible(t *testing.T) {
+	got := fields(reflect.TypeOf(schema.Plan{}), "")
+	golden := filepath.Join("testdata", fmt.Sprintf("v%d.fields", schema.Version))
+	if *update {
+		if err := os.WriteFile(golden, []byte(strings.Join(got, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%s; write it with go test -update", err)
+	}
+	want := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	have := map[string]bool{}
+	for _, line := range got {
+		have[line] = true
+	}
+	known := map[string]bool{}
+	for _, line := range want {
+		known[line] = true
+		if !have[line] {
+			t.Errorf("%s was removed or changed without schema.Version going up from %d", line, schema.Version)
+		}
+	}
+	for _, line := range got {
+		if !known[line] {
+			t.Errorf("%s was added; add it to %s with go test -update", line, golden)
+		}
+	}
+}
+
+// TestSchemaMatchesTypes checks tools/plan.schema.json documents the fields
+// of the types and requires those which are never left out
+func TestSchemaMatchesTypes(t *testing.T) {
+	s := readSchema(t)
+	if s.Properties["version"].Const != float64(schema.Version) {
+		t.Errorf("the schema's version is %v, want %d", s.Properties["version"].Const, schema.Version)
+	}
+	for _, test := range []struct {
+		name string
+		s    *jsonSchema
+		typ  reflect.Type
+	}{
+		{"plan", s, reflect.TypeOf(schema.Plan{})},
+		{"probe", s.Defs["probe"], reflect.TypeOf(schema.Probe{})},
+		{"value", s.Defs["value"], reflect.TypeOf(schema.Value{})},
+	} {
+		if test.s == nil {
+			t.Errorf("no %s in the schema", test.name)
+			continue
+		}
+		var names, required, properties []string
+		for i := 0; i < test.typ.NumField(); i++ {
+			name, options, _ := strings.Cut(test.typ.Field(i).Tag.Get("json"), ",")
+			names = append(names, name)
+			if options != "omitempty" {
+				required = append(required, name)
+			}
+		}
+		for name := range test.s.Properties {
+			properties = append(properties, name)
+		}
+		sort.Strings(names)
+		sort.Strings(properties)
+		sort.Strings(required)
+		schemaRequired := append([]string{}, test.s.Required...)
+		sort.Strings(schemaRequired)
+		if !reflect.DeepEqual(properties, names) {
+			t.Errorf("%s: the schema has properties %s, the type %s", test.name, properties, names)
+		}
+		if !reflect.DeepEqual(schemaRequired, required) {
+			t.Errorf("%s: the schema requires %s, the type always has %s", test.name, schemaRequired, required)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "plan.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := schema.Decode(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Executable != "/srv/fixture" || len(plan.Probes) != 1 {
+		t.Fatalf("got %+v", plan)
+	}
+	probe := plan.Probes[0]
+	if probe.Symbol != "main.handle" || probe.FileOffset != 0x2fd740 || len(probe.ReturnOffsets) != 3 {
+		t.Errorf("got probe %+v", probe)
+	}
+	if len(probe.Args) != 2 || probe.Args[1].Name != "name" || probe.Args[1].Words != 2 {
+		t.Errorf("got args %+v", probe.Args)
+	}
+
+	next := strings.Replace(string(data), `"version": 1`, `"version": 2`, 1)
+	if _, err := schema.Decode(strings.NewReader(next)); err == nil || err.Error() != "probe plan version 2 isn't 1" {
+		t.Errorf("decoding version 2 gave %v", err)
+	}
+	if _, err := schema.Decode(strings.NewReader("{")); err == nil {
+		t.Error("no error decoding a truncated plan")
+	}
+}
@@ -0,0 +1,83 @@
+// Package schema has the types of the JSON probe plan go-bpf-gen gives with
+// -format=json, and gen.Generate with gen.FormatJSON, for programs reading
+// plans rather than scraping generated scripts. The schema is also
+// tools/plan.schema.json.
+//
+//	plan, err := schema.Decode(os.Stdin)
+//	if err != nil {
+//		return err
+//	}
+//	for _, probe := range plan.Probes {
+//		fmt.Printf("%s at 0x%x returns at %v\n", probe.Symbol, probe.Address, probe.ReturnOffsets)
+//	}
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Version is the version of the schema. It goes up when a field is removed
+// or changes meaning but not when one is added.
+const Version = 1
+
+// Plan is the probes a template would attach for the symbol=<function or
+// glob> arguments.
+type Plan struct {
+	Version    int    `json:"version"`
+	Executable string `json:"executable"`
+	// BuildID is the GNU build ID in hex and GoBuildID the Go build ID,
+	// each empty when the target hasn't one
+	BuildID   string `json:"build_id,omitempty"`
+	GoBuildID string `json:"go_build_id,omitempty"`
+	GoVersion string `json:"go_version"`
+	Arch      string `json:"arch"`
+	RegsABI   bool   `json:"regs_abi"`
+	// ABISource is where RegsABI came from: detected, from the Go version,
+	// assumed when neither could tell, or forced by abi=regs|stack
+	ABISource string  `json:"abi_source,omitempty"`
+	Probes    []Probe `json:"probes"`
+}
+
+// Probe is the entry and return probes of one function. Offsets are from
+// Address and Locations are uprobe_events fetch arguments e.g. %ax or
+// +8(%sp):u64.
+type Probe struct {
+	Symbol        string `json:"symbol"`
+	Address       uint64 `json:"address"`
+	FileOffset    uint64 `json:"file_offset"`
+	Size          uint64 `json:"size"`
+	ReturnOffsets []int  `json:"return_offsets"`
+	// RegsABI is set when abi=regs:<function> or abi=stack:<function>
+	// forced the ABI of the function, which Args and Results use
+	RegsABI *bool `json:"regs_abi,omitempty"`
+	// Args and Results are left out without DWARF data
+	Args    []Value `json:"args,omitempty"`
+	Results []Value `json:"results,omitempty"`
+}
+
+// Value is where a parameter or result is found. Locations has a location
+// for each word of the value and is empty for floats and values which
+// aren't passed in the integer registers.
+type Value struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Kind      string   `json:"kind"`
+	Word      int      `json:"word"`
+	Words     int      `json:"words"`
+	Locations []string `json:"locations"`
+}
+
+// Decode reads a plan, failing for a version of the schema other than
+// Version
+func Decode(r io.Reader) (*Plan, error) {
+	var plan Plan
+	if err := json.NewDecoder(r).Decode(&plan); err != nil {
+		return nil, err
+	}
+	if plan.Version != Version {
+		return nil, fmt.Errorf("probe plan version %d isn't %d", plan.Version, Version)
+	}
+	return &plan, nil
+}
@@ -0,0 +1,264 @@
+package schema_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+)
+
+var (
+	fixtureOnce sync.Once
+	fixtureDir  string
+	fixturePath string
+	fixtureErr  error
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	code := m.Run()
+	if fixtureDir != "" {
+		os.RemoveAll(fixtureDir)
+	}
+	os.Exit(code)
+}
+
+// fixture returns the selftest's fixture, built once for all the tests.
+// Tests are skipped if there's no go command to build it with.
+func fixture(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go command to build the fixture with")
+	}
+	fixtureOnce.Do(func() {
+		if fixtureDir, fixtureErr = os.MkdirTemp("", "go-bpf-gen-fixture"); fixtureErr != nil {
+			return
+		}
+		fixturePath, fixtureErr = gen.BuildSelfTestFixture(fixtureDir)
+	})
+	if fixtureErr != nil {
+		t.Fatal(fixtureErr)
+	}
+	return fixturePath
+}
+
+// jsonSchema is the part of JSON Schema tools/plan.schema.json uses
+type jsonSchema struct {
+	Ref        string                 `json:"$ref"`
+	Type       string                 `json:"type"`
+	Const      interface{}            `json:"const"`
+	Enum       []interface{}          `json:"enum"`
+	Minimum    *float64               `json:"minimum"`
+	Required   []string               `json:"required"`
+	Properties map[string]*jsonSchema `json:"properties"`
+	Items      *jsonSchema            `json:"items"`
+	Defs       map[string]*jsonSchema `json:"$defs"`
+}
+
+func readSchema(t *testing.T) *jsonSchema {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("..", "tools", "plan.schema.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s jsonSchema
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+	return &s
+}
+
+// validate returns what's wrong with the JSON value v, at path, going by s.
+// Properties the schema doesn't have are errors so that fields can't be
+// added to plans without being documented.
+func (root *jsonSchema) validate(s *jsonSchema, path string, v interface{}) []string {
+	if s.Ref != "" {
+		def := root.Defs[strings.TrimPrefix(s.Ref, "#/$defs/")]
+		if def == nil {
+			return []string{fmt.Sprintf("%s: no definition %s", path, s.Ref)}
+		}
+		s = def
+	}
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, path+": "+fmt.Sprintf(format, args...))
+	}
+	if s.Const != nil && v != s.Const {
+		fail("%v isn't %v", v, s.Const)
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			found = found || v == e
+		}
+		if !found {
+			fail("%v isn't one of %v", v, s.Enum)
+		}
+	}
+	switch s.Type {
+	case "object":
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			fail("%v isn't an object", v)
+			return errs
+		}
+		for _, name := range s.Required {
+			if _, ok := object[name]; !ok {
+				fail("no %s", name)
+			}
+		}
+		for name, value := range object {
+			property, ok := s.Properties[name]
+			if !ok {
+				fail("%s isn't in the schema", name)
+				continue
+			}
+			errs = append(errs, root.validate(property, path+"."+name, value)...)
+		}
+	case "array":
+		array, ok := v.([]interface{})
+		if !ok {
+			fail("%v isn't an array", v)
+			return errs
+		}
+		for i, item := range array {
+			errs = append(errs, root.validate(s.Items, fmt.Sprintf("%s[%d]", path, i), item)...)
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			fail("%v isn't a string", v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			fail("%v isn't a boolean", v)
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != float64(int64(n)) {
+			fail("%v isn't an integer", v)
+		} else if s.Minimum != nil && n < *s.Minimum {
+			fail("%v is less than %v", n, *s.Minimum)
+		}
+	}
+	return errs
+}
+
+// validatePlan returns what's wrong with the plan in data
+func validatePlan(t *testing.T, data []byte) []string {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	s := readSchema(t)
+	errs := s.validate(s, "plan", v)
+	sort.Strings(errs)
+	return errs
+}
+
+// TestGeneratedPlans checks the plans made for the fixture are valid
+func TestGeneratedPlans(t *testing.T) {
+	exe := fixture(t)
+	tests := []struct {
+		name string
+		args map[string][]string
+	}{
+		{"function", map[string][]string{"symbol": {"main.handle"}}},
+		{"glob", map[string][]string{"symbol": {"main.*"}}},
+		{"several", map[string][]string{"symbol": {"main.handle", "runtime.mallocgc"}}},
+		{"forced ABI", map[string][]string{"symbol": {"main.handle"}, "abi": {"stack:main.handle"}}},
+		{"stack ABI", map[string][]string{"symbol": {"main.handle"}, "abi": {"stack"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, err := gen.NewTarget(exe, gen.WithFormat(gen.FormatJSON))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer target.Close()
+			plan, err := gen.GenerateString("", target, test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range validatePlan(t, []byte(plan)) {
+				t.Error(e)
+			}
+		})
+	}
+}
+
+// TestInvalidPlans checks plans which break the schema fail validation
+func TestInvalidPlans(t *testing.T) {
+	valid, err := os.ReadFile(filepath.Join("testdata", "plan.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := validatePlan(t, valid); len(errs) > 0 {
+		t.Fatalf("testdata/plan.json isn't valid: %s", strings.Join(errs, "; "))
+	}
+	tests := []struct {
+		name     string
+		old, new string
+		want     string
+	}{
+		{"another version", `"version": 1`, `"version": 2`, "plan.version: 2 isn't 1"},
+		{"no executable", `"executable": "/srv/fixture",`, ``, "plan: no executable"},
+		{"string address", `"address": 7329600`, `"address": "0x6fd740"`, "plan.probes[0].address: 0x6fd740 isn't an integer"},
+		{"negative offset", `"file_offset": 3135296`, `"file_offset": -1`, "plan.probes[0].file_offset: -1 is less than 0"},
+		{"unknown kind", `"kind": "int"`, `"kind": "integer"`, "plan.probes[0].args[0].kind: integer isn't one of"},
+		{"undocumented field", `"size": 349,`, `"size": 349, "inlined": true,`, "plan.probes[0]: inlined isn't in the schema"},
+		{"no locations", `"locations": [
+            "%ax"
+          ]`, `"locations": null`, "plan.probes[0].args[0].locations: <nil> isn't an array"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plan := bytes.Replace(valid, []byte(test.old), []byte(test.new), 1)
+			if bytes.Equal(plan, valid) {
+				t.Fatalf("%q isn't in testdata/plan.json", test.old)
+			}
+			errs := validatePlan(t, plan)
+			if len(errs) != 1 || !strings.HasPrefix(errs[0], test.want) {
+				t.Errorf("got %q, want one error starting %q", errs, test.want)
+			}
+		})
+	}
+}
+
+// TestConsumer runs the example consumer in testdata on testdata/plan.json
+func TestConsumer(t *testing.T) {
+	goCmd, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command to run the consumer with")
+	}
+	plan, err := os.Open(filepath.Join("testdata", "plan.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plan.Close()
+	cmd := exec.Command(goCmd, "run", "./testdata/consumer")
+	cmd.Stdin = plan
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	got, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("%s\n%s", err, stderr.Bytes())
+	}
+	want, err := os.ReadFile(filepath.Join("testdata", "consumer.golden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
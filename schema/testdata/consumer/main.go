@@ -0,0 +1,51 @@
+// Command consumer is an example of reading a probe plan with the schema
+// package: it prints uprobe_events definitions for the entry and returns of
+// each function, fetching its arguments at entry, as tools/plan-events.py
+// does.
+//
+//	go-bpf-gen -format=json <target binary> symbol=main.main | go run ./schema/testdata/consumer
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/stevenjohnstone/go-bpf-gen/schema"
+)
+
+var notName = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// eventName makes an event name of a symbol
+func eventName(symbol string) string {
+	name := strings.Trim(notName.ReplaceAllString(symbol[strings.LastIndex(symbol, "/")+1:], "_"), "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		return "_" + name
+	}
+	return name
+}
+
+func main() {
+	plan, err := schema.Decode(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i, probe := range plan.Probes {
+		name := fmt.Sprintf("%s_%d", eventName(probe.Symbol), i)
+		event := []string{fmt.Sprintf("p:gobpf/%s %s:0x%x", name, plan.Executable, probe.FileOffset)}
+		for _, arg := range probe.Args {
+			if arg.Name == "" {
+				arg.Name = "arg"
+			}
+			for j, location := range arg.Locations {
+				event = append(event, fmt.Sprintf("%s%d=%s", arg.Name, j, location))
+			}
+		}
+		fmt.Println(strings.Join(event, " "))
+		for j, offset := range probe.ReturnOffsets {
+			fmt.Printf("p:gobpf/%s_return%d %s:0x%x\n", name, j, plan.Executable, probe.FileOffset+uint64(offset))
+		}
+	}
+}
@@ -0,0 +1,10 @@
+// Package templates has the bundled templates for go-bpf-gen to render.
+package templates
+
+import "embed"
+
+// FS has the bundled templates by name e.g. "latency.bt" or
+// "http/server.bt"
+//
+//go:embed *.bt *.stp *.tmpl http
+var FS embed.FS
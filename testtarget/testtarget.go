@@ -0,0 +1,383 @@
+// Package testtarget makes small amd64, s390x and ppc64 ELF executables in
+// memory for trying templates without building real Go programs. The
+// executables have a symbol table, build info and functions made of NOPs
+// with return instructions at the offsets asked for, which is all most
+// helpers look at; there's no DWARF data.
+//
+// A golden test of a template renders it for a canned target and compares
+// the script with one kept beside the test:
+//
+//	target, err := testtarget.New("/usr/local/bin/server", testtarget.Runtime(),
+//		gen.WithArguments(map[string][]string{"symbol": {"main.main"}}))
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer target.Close()
+//	var script strings.Builder
+//	if err := gen.Generate(&script, "latency.bt", target, nil); err != nil {
+//		t.Fatal(err)
+//	}
+package testtarget
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"runtime/debug"
+	"sort"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+)
+
+// Function is a function of a made up executable
+type Function struct {
+	Name string
+	// Returns are the offsets of the function's return instructions. The
+	// rest of the function is NOPs. On s390x and ppc64 the offsets must
+	// be multiples of 2 and 4, the length of the instructions used.
+	Returns []int
+	// Size is the length of the function in bytes. It defaults to just
+	// past the last return or 16 bytes for a function that doesn't return.
+	Size int
+	// Code, if given, is the function's machine code and Returns and Size
+	// are ignored
+	Code []byte
+}
+
+// code returns the machine code of the function for the architecture a
+func (f Function) code(a arch) []byte {
+	if f.Code != nil {
+		return f.Code
+	}
+	size := f.Size
+	for _, r := range f.Returns {
+		if r+len(a.ret) > size {
+			size = r + len(a.ret)
+		}
+	}
+	if size == 0 {
+		size = 16
+	}
+	code := bytes.Repeat(a.nop, (size+len(a.nop)-1)/len(a.nop))[:size]
+	for _, r := range f.Returns {
+		copy(code[r:], a.ret)
+	}
+	return code
+}
+
+// Binary describes a made up executable
+type Binary struct {
+	// GoVersion is the version of Go the executable claims to be built
+	// with, go1.21.0 by default
+	GoVersion string
+	// Path is the main module's path, example.com/main by default
+	Path string
+	// Deps maps the paths of the modules the executable depends on to
+	// their versions
+	Deps map[string]string
+	// StackABI has the executable pass arguments on the stack as before
+	// go1.17 rather than in registers. On ppc64, whose runtime.memequal0
+	// is the same either way, GoVersion decides.
+	StackABI bool
+	// Arch is the GOARCH of the executable: amd64, the default, s390x,
+	// ppc64 or ppc64le
+	Arch string
+	// Functions are the executable's functions. runtime.memequal0, which
+	// tells which calling convention is used, is added.
+	Functions []Function
+}
+
+// Runtime returns an executable with the functions the bundled templates
+// use most: the scheduler's, allocation and main.main
+func Runtime() Binary {
+	return Binary{
+		Functions: []Function{
+			{Name: "main.main", Returns: []int{40, 96}},
+			{Name: "runtime.execute", Returns: []int{64}},
+			{Name: "runtime.newproc1", Returns: []int{120}},
+			{Name: "runtime.goexit1", Size: 32},
+			{Name: "runtime.gopark", Returns: []int{80}},
+			{Name: "runtime.goready", Returns: []int{24}},
+			{Name: "runtime.mallocgc", Returns: []int{200, 312, 400}},
+			{Name: "runtime.gcStart", Returns: []int{150}},
+			{Name: "runtime.gcMarkDone", Returns: []int{90}},
+		},
+	}
+}
+
+const (
+	base      = 0x400000
+	textStart = 0x1000
+)
+
+// arch is how the code of an architecture is made up
+type arch struct {
+	machine elf.Machine
+	order   binary.ByteOrder
+	nop     []byte
+	ret     []byte
+	// pad is put between functions
+	pad byte
+	// memequal0 is runtime.memequal0 for each calling convention, which
+	// abi.Regs decodes
+	memequal0Regs, memequal0Stack []byte
+}
+
+var arches = map[string]arch{
+	"amd64": {
+		machine:        elf.EM_X86_64,
+		order:          binary.LittleEndian,
+		nop:            []byte{0x90},
+		ret:            []byte{0xc3},
+		pad:            0xcc,                                       // INT3
+		memequal0Regs:  []byte{0xb8, 0x01, 0x00, 0x00, 0x00, 0xc3}, // MOVL $0x1, AX; RET
+		memequal0Stack: []byte{0xc6, 0x44, 0x24, 0x18, 0x01, 0xc3}, // MOVB $0x1, 0x18(SP); RET
+	},
+	"s390x": {
+		machine:        elf.EM_S390,
+		order:          binary.BigEndian,
+		nop:            []byte{0x07, 0x00},                         // BCR 0, R0
+		ret:            []byte{0x07, 0xfe},                         // BR R14
+		memequal0Regs:  []byte{0xa7, 0x29, 0x00, 0x01, 0x07, 0xfe}, // MOVB $1, R2; BR R14
+		memequal0Stack: []byte{0x92, 0x01, 0xf0, 0x18, 0x07, 0xfe}, // MVI 24(R15), $1; BR R14
+	},
+	"ppc64": {
+		machine:        elf.EM_PPC64,
+		order:          binary.BigEndian,
+		nop:            []byte{0x60, 0x00, 0x00, 0x00},                         // ORI R0, R0, 0
+		ret:            []byte{0x4e, 0x80, 0x00, 0x20},                         // BLR
+		memequal0Regs:  []byte{0x38, 0x60, 0x00, 0x01, 0x4e, 0x80, 0x00, 0x20}, // MOVD $1, R3; BLR
+		memequal0Stack: []byte{0x38, 0x60, 0x00, 0x01, 0x4e, 0x80, 0x00, 0x20},
+	},
+}
+
+func init() {
+	// ppc64le is ppc64 with each instruction's bytes reversed
+	le := arches["ppc64"]
+	le.order = binary.LittleEndian
+	reverse := func(code []byte) []byte {
+		r := make([]byte, len(code))
+		for i := 0; i < len(code); i += 4 {
+			binary.LittleEndian.PutUint32(r[i:], binary.BigEndian.Uint32(code[i:]))
+		}
+		return r
+	}
+	le.nop, le.ret = reverse(le.nop), reverse(le.ret)
+	le.memequal0Regs, le.memequal0Stack = reverse(le.memequal0Regs), reverse(le.memequal0Stack)
+	arches["ppc64le"] = le
+}
+
+// arch returns how the code of the executable is made up
+func (b Binary) arch() arch {
+	if a, ok := arches[b.Arch]; ok {
+		return a
+	}
+	return arches["amd64"]
+}
+
+// align pads buf with zeros to a multiple of n
+func align(buf *bytes.Buffer, n int) {
+	for buf.Len()%n != 0 {
+		buf.WriteByte(0)
+	}
+}
+
+// buildInfo returns the contents of .go.buildinfo as go1.18 and later
+// write it, with the version and module strings inline
+func (b Binary) buildInfo(a arch) []byte {
+	version := b.GoVersion
+	if version == "" {
+		version = "go1.21.0"
+	}
+	info := debug.BuildInfo{
+		GoVersion: version,
+		Path:      b.Path,
+		Main:      debug.Module{Path: b.Path, Version: "(devel)"},
+	}
+	if info.Path == "" {
+		info.Path = "example.com/main"
+		info.Main.Path = info.Path
+	}
+	for path, version := range b.Deps {
+		info.Deps = append(info.Deps, &debug.Module{Path: path, Version: version})
+	}
+	sort.Slice(info.Deps, func(i, j int) bool {
+		return info.Deps[i].Path < info.Deps[j].Path
+	})
+	// the module information is framed by 16 byte sentinels
+	sentinel := string(bytes.Repeat([]byte{0xff}, 16))
+	mod := sentinel + info.String() + sentinel
+
+	var buf bytes.Buffer
+	buf.WriteString("\xff Go buildinf:")
+	buf.WriteByte(8)   // pointer size
+	flags := byte(0x2) // inline strings
+	if a.order == binary.BigEndian {
+		flags |= 0x1
+	}
+	buf.WriteByte(flags)
+	buf.Write(make([]byte, 16))
+	for _, s := range []string{version, mod} {
+		var n [binary.MaxVarintLen64]byte
+		buf.Write(n[:binary.PutUvarint(n[:], uint64(len(s)))])
+		buf.WriteString(s)
+	}
+	return buf.Bytes()
+}
+
+// strtab is a string table being built
+type strtab struct {
+	bytes.Buffer
+}
+
+func newStrtab() *strtab {
+	s := &strtab{}
+	s.WriteByte(0)
+	return s
+}
+
+// add adds name and returns its index
+func (s *strtab) add(name string) uint32 {
+	i := uint32(s.Len())
+	s.WriteString(name)
+	s.WriteByte(0)
+	return i
+}
+
+// Build returns the ELF executable described by b. The whole file is loaded
+// by one segment at 0x400000 so addresses are the file offset plus 0x400000.
+// An Arch other than those listed is taken to be amd64.
+func Build(b Binary) []byte {
+	a := b.arch()
+	memequal0 := a.memequal0Regs
+	if b.StackABI {
+		memequal0 = a.memequal0Stack
+	}
+	functions := append([]Function{{Name: "runtime.memequal0", Code: memequal0}}, b.Functions...)
+
+	var file bytes.Buffer
+	file.Write(make([]byte, textStart))
+
+	// functions are 16 byte aligned and padded as Go does
+	symtab := &bytes.Buffer{}
+	symtab.Write(make([]byte, 24))
+	strs := newStrtab()
+	for _, f := range functions {
+		for file.Len()%16 != 0 {
+			file.WriteByte(a.pad)
+		}
+		code := f.code(a)
+		sym := elf.Sym64{
+			Name:  strs.add(f.Name),
+			Info:  elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC),
+			Shndx: 1,
+			Value: uint64(base + file.Len()),
+			Size:  uint64(len(code)),
+		}
+		binary.Write(symtab, a.order, sym)
+		file.Write(code)
+	}
+	textEnd := file.Len()
+
+	align(&file, 16)
+	buildInfoStart := file.Len()
+	file.Write(b.buildInfo(a))
+	buildInfoEnd := file.Len()
+
+	align(&file, 8)
+	symtabStart := file.Len()
+	file.Write(symtab.Bytes())
+	strtabStart := file.Len()
+	file.Write(strs.Bytes())
+
+	shstrs := newStrtab()
+	type section struct {
+		name             string
+		typ              elf.SectionType
+		flags            elf.SectionFlag
+		start, end, link int
+		entsize          uint64
+		align            uint64
+	}
+	sections := []section{
+		{name: ".text", typ: elf.SHT_PROGBITS, flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR, start: textStart, end: textEnd, align: 16},
+		{name: ".go.buildinfo", typ: elf.SHT_PROGBITS, flags: elf.SHF_ALLOC | elf.SHF_WRITE, start: buildInfoStart, end: buildInfoEnd, align: 16},
+		{name: ".symtab", typ: elf.SHT_SYMTAB, start: symtabStart, end: strtabStart, link: 4, entsize: 24, align: 8},
+		{name: ".strtab", typ: elf.SHT_STRTAB, start: strtabStart, end: strtabStart + strs.Len(), align: 1},
+		{name: ".shstrtab", typ: elf.SHT_STRTAB, align: 1},
+	}
+	names := make([]uint32, len(sections))
+	for i, s := range sections {
+		names[i] = shstrs.add(s.name)
+	}
+	shstrtabStart := file.Len()
+	file.Write(shstrs.Bytes())
+	sections[4].start, sections[4].end = shstrtabStart, file.Len()
+
+	align(&file, 8)
+	shoff := file.Len()
+	binary.Write(&file, a.order, elf.Section64{})
+	for i, s := range sections {
+		header := elf.Section64{
+			Name:      names[i],
+			Type:      uint32(s.typ),
+			Flags:     uint64(s.flags),
+			Off:       uint64(s.start),
+			Size:      uint64(s.end - s.start),
+			Link:      uint32(s.link),
+			Addralign: s.align,
+			Entsize:   s.entsize,
+		}
+		if s.flags&elf.SHF_ALLOC != 0 {
+			header.Addr = uint64(base + s.start)
+		}
+		if s.typ == elf.SHT_SYMTAB {
+			// the index of the first global symbol
+			header.Info = 1
+		}
+		binary.Write(&file, a.order, header)
+	}
+
+	data := file.Bytes()
+	header := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(a.machine),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     uint64(base + textStart),
+		Phoff:     64,
+		Shoff:     uint64(shoff),
+		Ehsize:    64,
+		Phentsize: 56,
+		Phnum:     1,
+		Shentsize: 64,
+		Shnum:     uint16(len(sections) + 1),
+		Shstrndx:  uint16(len(sections)),
+	}
+	copy(header.Ident[:], elf.ELFMAG)
+	header.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	if a.order == binary.BigEndian {
+		header.Ident[elf.EI_DATA] = byte(elf.ELFDATA2MSB)
+	}
+	header.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	prog := elf.Prog64{
+		Type:   uint32(elf.PT_LOAD),
+		Flags:  uint32(elf.PF_R | elf.PF_W | elf.PF_X),
+		Vaddr:  base,
+		Paddr:  base,
+		Filesz: uint64(len(data)),
+		Memsz:  uint64(len(data)),
+		Align:  0x1000,
+	}
+	var headers bytes.Buffer
+	binary.Write(&headers, a.order, header)
+	binary.Write(&headers, a.order, prog)
+	copy(data, headers.Bytes())
+	return data
+}
+
+// New returns a Target for the executable described by b as if it were at
+// path, which only names it in probes
+func New(path string, b Binary, opts ...gen.Option) (*gen.Target, error) {
+	return gen.NewTargetReader(bytes.NewReader(Build(b)), path, opts...)
+}
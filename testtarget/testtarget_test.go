@@ -0,0 +1,145 @@
+package testtarget_test
+
+import (
+	"bytes"
+	"debug/buildinfo"
+	"debug/elf"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stevenjohnstone/go-bpf-gen/gen"
+	"github.com/stevenjohnstone/go-bpf-gen/ret"
+	"github.com/stevenjohnstone/go-bpf-gen/testtarget"
+)
+
+// TestBuild checks the made up executables of each architecture are ELF
+// files with the functions asked for, at addresses 0x400000 above their
+// file offsets, whose returns are found where they were put, and build info
+// saying how they were built
+func TestBuild(t *testing.T) {
+	functions := []testtarget.Function{
+		{Name: "main.main", Returns: []int{40, 96}},
+		{Name: "main.handle", Returns: []int{8}, Size: 64},
+		{Name: "main.loop", Size: 32},
+	}
+	for _, test := range []struct {
+		arch    string
+		machine elf.Machine
+		order   binary.ByteOrder
+	}{
+		{"amd64", elf.EM_X86_64, binary.LittleEndian},
+		{"s390x", elf.EM_S390, binary.BigEndian},
+		{"ppc64", elf.EM_PPC64, binary.BigEndian},
+		{"ppc64le", elf.EM_PPC64, binary.LittleEndian},
+	} {
+		t.Run(test.arch, func(t *testing.T) {
+			exe := testtarget.Build(testtarget.Binary{
+				GoVersion: "go1.20.5",
+				Path:      "example.com/server",
+				Deps:      map[string]string{"golang.org/x/net": "v0.10.0"},
+				Arch:      test.arch,
+				Functions: functions,
+			})
+			f, err := elf.NewFile(bytes.NewReader(exe))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Machine != test.machine || f.ByteOrder != test.order || f.Type != elf.ET_EXEC {
+				t.Errorf("got a %s %s %s, want a %s %s executable", f.ByteOrder, f.Machine, f.Type, test.order, test.machine)
+			}
+			symbols, err := f.Symbols()
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := map[string]elf.Symbol{}
+			for _, s := range symbols {
+				found[s.Name] = s
+			}
+			if _, ok := found["runtime.memequal0"]; !ok {
+				t.Error("no runtime.memequal0")
+			}
+			for _, function := range functions {
+				s, ok := found[function.Name]
+				if !ok {
+					t.Errorf("no symbol %s", function.Name)
+					continue
+				}
+				if s.Value < 0x400000 || s.Value%16 != 0 || elf.ST_TYPE(s.Info) != elf.STT_FUNC {
+					t.Errorf("%s is at %#x, want a function 16 byte aligned above 0x400000", function.Name, s.Value)
+				}
+				if function.Size != 0 && s.Size != uint64(function.Size) {
+					t.Errorf("%s is %d bytes, want %d", function.Name, s.Size, function.Size)
+				}
+				returns, err := ret.FindOffsets(bytes.NewReader(exe), function.Name)
+				if len(function.Returns) == 0 {
+					if err != ret.ErrNoRetFound {
+						t.Errorf("%s: got returns %v, %v, want %s", function.Name, returns, err, ret.ErrNoRetFound)
+					}
+					continue
+				}
+				if err != nil || !reflect.DeepEqual(returns, function.Returns) {
+					t.Errorf("%s: got returns %v, %v, want %v", function.Name, returns, err, function.Returns)
+				}
+			}
+
+			info, err := buildinfo.Read(bytes.NewReader(exe))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.GoVersion != "go1.20.5" || info.Main.Path != "example.com/server" ||
+				len(info.Deps) != 1 || info.Deps[0].Path != "golang.org/x/net" || info.Deps[0].Version != "v0.10.0" {
+				t.Errorf("got build info %+v", info)
+			}
+		})
+	}
+}
+
+// TestFunctionCode checks a function given by its code has that code
+func TestFunctionCode(t *testing.T) {
+	code := []byte{0x48, 0x89, 0xc3, 0xc3} // MOVQ AX, BX; RET
+	exe := testtarget.Build(testtarget.Binary{Functions: []testtarget.Function{{Name: "main.main", Code: code, Returns: []int{100}}}})
+	returns, err := ret.FindOffsets(bytes.NewReader(exe), "main.main")
+	if err != nil || !reflect.DeepEqual(returns, []int{3}) {
+		t.Errorf("got returns %v, %v, want [3]", returns, err)
+	}
+}
+
+// TestNew checks a Target for a made up executable is named by the path
+// given and has the calling convention and Go version it was made with
+func TestNew(t *testing.T) {
+	for _, test := range []struct {
+		b    testtarget.Binary
+		regs bool
+	}{
+		{testtarget.Runtime(), true},
+		{testtarget.Binary{StackABI: true, GoVersion: "go1.16.15", Functions: testtarget.Runtime().Functions}, false},
+		{testtarget.Binary{Arch: "s390x", StackABI: true, Functions: testtarget.Runtime().Functions}, false},
+	} {
+		target, err := testtarget.New("/srv/server", test.b, gen.WithArguments(map[string][]string{"symbol": {"main.main"}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer target.Close()
+		version := test.b.GoVersion
+		if version == "" {
+			version = "go1.21.0"
+		}
+		if target.ExePath != "/srv/server" || target.RegsABI != test.regs || target.GoVersion() != version {
+			t.Errorf("got %s built with %s, register ABI %v, want /srv/server built with %s, register ABI %v",
+				target.ExePath, target.GoVersion(), target.RegsABI, version, test.regs)
+		}
+		returns, err := target.SymbolReturns("main.main")
+		if err != nil || !reflect.DeepEqual(returns, []int{40, 96}) {
+			t.Errorf("got returns %v, %v, want [40 96]", returns, err)
+		}
+		script, err := gen.GenerateString("latency.bt", target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(script, `uprobe:/srv/server:"main.main"`) {
+			t.Errorf("script doesn't probe /srv/server:\n%s", script)
+		}
+	}
+}
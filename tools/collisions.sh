@@ -0,0 +1,33 @@
+#!/bin/bash -e
+# Renders every bundled bpftrace template for a target with -map-prefix=auto
+# and fails if any two of the scripts share a map, as they would if run
+# alongside each other without their maps being prefixed.
+#
+#   tools/collisions.sh <target> [key=value...]
+#
+# Templates which fail for the target, e.g. those for libraries it doesn't
+# use, are skipped.
+
+target=${1:?usage: $0 <target> [key=value...]}
+shift
+gen=$(mktemp -d)
+trap 'rm -rf "$gen"' EXIT
+go build -o "$gen/go-bpf-gen" .
+
+for template in $("$gen/go-bpf-gen" -list | grep '\.bt$'); do
+	if ! "$gen/go-bpf-gen" -no-cache -map-prefix=auto "templates/$template" "$target" "$@" >"$gen/script" 2>/dev/null; then
+		continue
+	fi
+	# the maps of each template once, outside comments and strings as far
+	# as grep can tell
+	sed -e 's://.*$::' -e 's/"[^"]*"//g' "$gen/script" | grep -o '@[A-Za-z0-9_]*' | sort -u |
+		sed "s|\$| $template|" >>"$gen/maps"
+done
+collisions=$(awk '{ print $1 }' "$gen/maps" | sort | uniq -d)
+if [ -n "$collisions" ]; then
+	for m in $collisions; do
+		echo "$m is used by $(grep "^$m " "$gen/maps" | awk '{ print $2 }' | tr '\n' ' ')"
+	done
+	exit 1
+fi
+echo "$(sort -u -k2,2 "$gen/maps" | wc -l) templates, no maps shared"
@@ -0,0 +1,28 @@
+#!/usr/bin/env python3
+# Example consumer of a probe plan: prints uprobe_events definitions for the
+# entry and returns of each function with its arguments fetched at entry.
+#
+#   go-bpf-gen -format=json <target binary> symbol=main.main | tools/plan-events.py
+import json
+import re
+import sys
+
+plan = json.load(sys.stdin)
+if plan["version"] != 1:
+    sys.exit("unsupported probe plan version %d" % plan["version"])
+
+
+def event_name(symbol):
+    name = re.sub(r"[^A-Za-z0-9]+", "_", symbol.split("/")[-1]).strip("_")
+    return "_" + name if name[:1].isdigit() else name
+
+
+for i, probe in enumerate(plan["probes"]):
+    name = "%s_%d" % (event_name(probe["symbol"]), i)
+    fetch = []
+    for arg in probe.get("args", []):
+        for j, location in enumerate(arg["locations"]):
+            fetch.append("%s%d=%s" % (arg["name"] or "arg", j, location))
+    print(" ".join(["p:gobpf/%s %s:0x%x" % (name, plan["executable"], probe["file_offset"])] + fetch))
+    for j, offset in enumerate(probe["return_offsets"]):
+        print("p:gobpf/%s_return%d %s:0x%x" % (name, j, plan["executable"], probe["file_offset"] + offset))
@@ -0,0 +1,29 @@
+#!/bin/bash -e
+# Renders every bundled template twice for a target, without the cache and
+# then with it, and fails if any script differs between the runs.
+#
+#   tools/reproducible.sh <target> [key=value...]
+#
+# Templates which fail for the target, e.g. those for libraries it doesn't
+# use, are skipped.
+
+target=${1:?usage: $0 <target> [key=value...]}
+shift
+gen=$(mktemp -d)
+trap 'rm -rf "$gen"' EXIT
+go build -o "$gen/go-bpf-gen" .
+export XDG_CACHE_HOME=$gen/cache
+
+failed=0
+for template in $("$gen/go-bpf-gen" -list); do
+	if ! "$gen/go-bpf-gen" -no-cache "templates/$template" "$target" "$@" >"$gen/first" 2>/dev/null; then
+		continue
+	fi
+	"$gen/go-bpf-gen" "templates/$template" "$target" "$@" >/dev/null 2>&1
+	"$gen/go-bpf-gen" "templates/$template" "$target" "$@" >"$gen/second" 2>/dev/null
+	if ! cmp -s "$gen/first" "$gen/second"; then
+		echo "$template differs between runs"
+		failed=1
+	fi
+done
+exit $failed